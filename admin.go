@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// reloader rereads part of the configuration when an admin asks for it.
+type reloader struct {
+	name   string
+	reload func() error
+}
+
+// adminHandler serves the operational endpoints under /admin/. Requests
+// must carry token as bearer token.
+func (s *server) adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/reload", s.adminReload)
+	mux.HandleFunc("POST /admin/caches/purge", s.adminPurgeCaches)
+	mux.HandleFunc("GET /admin/policies", s.adminPolicies)
+	mux.HandleFunc("GET /admin/config", s.adminConfig)
+	mux.HandleFunc("GET /admin/config/drift", s.adminConfigDrift)
+	mux.HandleFunc("GET /admin/decisions", s.adminDecisions)
+	mux.HandleFunc("POST /admin/introspect", s.adminIntrospect)
+	mux.HandleFunc("GET /admin/log-level", s.adminLogLevel)
+	mux.HandleFunc("PUT /admin/log-level", s.adminLogLevel)
+	mux.HandleFunc("POST /admin/revocations", s.adminRevocations)
+	mux.HandleFunc("DELETE /admin/revocations", s.adminRevocations)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminReload runs every reloader, like SIGHUP does.
+func (s *server) adminReload(w http.ResponseWriter, r *http.Request) {
+	reloaded, failed := s.reloadAll()
+	status := http.StatusOK
+	if failed != nil {
+		status = http.StatusInternalServerError
+	}
+	writeJSON(w, status, struct {
+		Reloaded []string          `json:"reloaded"`
+		Failed   map[string]string `json:"failed,omitempty"`
+	}{reloaded, failed})
+}
+
+// adminPurgeCaches empties the in-process caches. Results in redis or
+// memcached are shared with other replicas and left alone.
+func (s *server) adminPurgeCaches(w http.ResponseWriter, r *http.Request) {
+	purged := map[string]int{"params": s.params.purge()}
+	if s.Rejected != nil {
+		purged["rejected"] = s.Rejected.purge()
+	}
+	if purgedResults, ok := s.purgeResults(); ok {
+		purged["results"] = purgedResults
+	}
+	s.Logger.Infow("Admin purged caches", "purged", purged)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"purged": purged})
+}
+
+// adminPolicies lists the named policies, DEFAULT_PARAMS and the params of
+// recent requests.
+func (s *server) adminPolicies(w http.ResponseWriter, r *http.Request) {
+	named := map[string]url.Values{}
+	if set := s.policies.Load(); set != nil {
+		for name, p := range set.named {
+			named[name] = p.values
+		}
+	}
+	defaults, _ := s.defaults()
+	cached := s.params.snapshot()
+	recent := make([]string, 0, len(cached))
+	for _, entry := range cached {
+		recent = append(recent, entry.key)
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Named   map[string]url.Values `json:"named"`
+		Default url.Values            `json:"default"`
+		Recent  []string              `json:"recent"`
+	}{named, defaults, recent})
+}
+
+// adminDecisions lists the most recent decisions, newest first. The limit
+// and reason query params narrow them down.
+func (s *server) adminDecisions(w http.ResponseWriter, r *http.Request) {
+	if s.Decisions == nil {
+		http.Error(w, "decisions are not recorded", http.StatusNotFound)
+		return
+	}
+	limit := -1
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	reason := r.URL.Query().Get("reason")
+	decisions := []decision{}
+	for _, d := range s.Decisions.recent() {
+		if len(decisions) == limit {
+			break
+		}
+		if reason == "" || d.Reason == reason {
+			decisions = append(decisions, d)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"decisions": decisions})
+}
+
+// adminLogLevel reports the log level, and on PUT changes it to the level
+// of the body, e.g. {"level":"debug"}.
+func (s *server) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+			return
+		}
+		previous := s.Logger.Level()
+		if err := s.Logger.SetLevel(body.Level); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Logged at warn so the change shows at any level
+		s.Logger.Warnw("Admin changed log level", "from", previous, "to", s.Logger.Level())
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": s.Logger.Level()})
+}
+
+// adminRevocations revokes the tokens with a jti or sub, or with DELETE
+// lifts such a revocation:
+//
+//	{"jti": "...", "sub": "...", "ttl": "24h"}
+//
+// Without ttl, a revocation lasts until it is lifted, or the restart for
+// those kept in process.
+func (s *server) adminRevocations(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		JTI string `json:"jti"`
+		Sub string `json:"sub"`
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+		return
+	}
+	if body.JTI == "" && body.Sub == "" {
+		http.Error(w, "jti or sub required", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if body.TTL != "" {
+		var err error
+		if ttl, err = time.ParseDuration(body.TTL); err != nil || ttl < 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+	entries := map[string]string{revokeJTI: body.JTI, revokeSub: body.Sub}
+	for _, claimName := range []string{revokeJTI, revokeSub} {
+		value := entries[claimName]
+		if value == "" {
+			continue
+		}
+		var err error
+		if r.Method == http.MethodDelete {
+			err = s.Revocations.unrevoke(claimName, value)
+		} else {
+			err = s.Revocations.revoke(claimName, value, ttl)
+		}
+		if err != nil {
+			s.Logger.Errorw("Admin failed to change revocations", "claim", claimName, "value", value, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Logged at warn so revocations can be audited at any level
+		s.Logger.Warnw("Admin changed revocations", "method", r.Method, "claim", claimName, "value", value, "ttl", ttl)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"shared": s.Revocations.redis != nil})
+}
+
+// decision is the outcome of a validation request.
+type decision struct {
+	Time    time.Time       `json:"time"`
+	Status  int             `json:"status"`
+	Reason  string          `json:"reason,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Subject string          `json:"sub,omitempty"`
+	Params  url.Values      `json:"params,omitempty"`
+	Request originalRequest `json:"request"`
+}
+
+// decisionLog keeps the last decisions in a ring buffer.
+type decisionLog struct {
+	mu      sync.Mutex
+	entries []decision
+	next    int
+	full    bool
+}
+
+func newDecisionLog(size int) *decisionLog {
+	return &decisionLog{entries: make([]decision, size)}
+}
+
+// record adds the decision on r, err being why it was denied if not nil.
+func (l *decisionLog) record(s *server, r *http.Request, params url.Values, claims jwt.MapClaims, err error) {
+	d := decision{Time: time.Now(), Status: http.StatusOK, Params: params, Request: s.originalRequest(r)}
+	if err != nil {
+		denied := denialOf(err)
+		d.Status, d.Reason, d.Error = denied.status, denied.code, err.Error()
+	} else {
+		d.Subject, _ = claims["sub"].(string)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[l.next] = d
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// recent returns the recorded decisions, newest first.
+func (l *decisionLog) recent() []decision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.entries)
+	}
+	recent := make([]decision, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return recent
+}
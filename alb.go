@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/sync/singleflight"
+)
+
+var albKeyID = regexp.MustCompile(`^[\w-]+$`)
+
+// albKeys fetches the public keys AWS ALB signs x-amzn-oidc-data with. They
+// are published per region as a PEM file named after the key id, and don't
+// change once published, so they are cached for good.
+type albKeys struct {
+	client *http.Client
+	// url has the key id appended
+	url     string
+	signers []string
+
+	// keys is replaced, never modified, when a key is added, so lookups
+	// need no lock. mu serializes adding keys.
+	mu      sync.Mutex
+	keys    atomic.Pointer[map[string]*ecdsa.PublicKey]
+	fetches singleflight.Group
+	// failed holds the kids that couldn't be fetched for albFailedKeyTTL,
+	// so tokens with made up kids don't each cause a fetch.
+	failed *ttlCache[error]
+}
+
+// albFailedKeyTTL is how long a kid that couldn't be fetched is refused
+// without trying again.
+const albFailedKeyTTL = time.Minute
+
+func (a *albKeys) Keyfunc(token *jwt.Token) (interface{}, error) {
+	// The signer header names the ALB that produced the token, anyone else's
+	// ALB in the same region signs with the same keys.
+	signer, _ := token.Header["signer"].(string)
+	if !slices.Contains(a.signers, signer) {
+		return nil, fmt.Errorf("signer %q not accepted", signer)
+	}
+	kid, _ := token.Header["kid"].(string)
+	if !albKeyID.MatchString(kid) {
+		return nil, fmt.Errorf("invalid kid %q", kid)
+	}
+
+	if key, ok := (*a.keys.Load())[kid]; ok {
+		return key, nil
+	}
+	if err, failed := a.failed.get(kid); failed {
+		return nil, err
+	}
+	// Fetch without holding the lock, so tokens signed with keys we already
+	// have aren't held up by a new key
+	fetched, err, _ := a.fetches.Do(kid, func() (interface{}, error) {
+		key, err := a.fetch(kid)
+		if err != nil {
+			a.failed.set(kid, err, albFailedKeyTTL)
+			return nil, err
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		keys := maps.Clone(*a.keys.Load())
+		keys[kid] = key
+		a.keys.Store(&keys)
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fetched, nil
+}
+
+func (a *albKeys) fetch(kid string) (*ecdsa.PublicKey, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.url+kid, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch ALB key %s: status %d", kid, resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		return nil, errors.New("ALB key is not PEM encoded")
+	}
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ecPubKey, ok := pubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("ALB key is not an EC public key")
+	}
+	return ecPubKey, nil
+}
+
+// albPreset validates the x-amzn-oidc-data header AWS ALB adds after
+// authenticating a user, for ALBs in ALB_REGION whose ARNs are listed in
+// ALB_ARNS. ALB_KEYS_URL overrides the key endpoint, e.g. for GovCloud.
+func albPreset() (*preset, error) {
+	region := getenv("ALB_REGION", "")
+	arns := splitList(getenv("ALB_ARNS", ""))
+	if region == "" || len(arns) == 0 {
+		return nil, errors.New("alb preset requires ALB_REGION and ALB_ARNS")
+	}
+	keysURL := getenv("ALB_KEYS_URL", fmt.Sprintf("https://public-keys.auth.elb.%s.amazonaws.com/", region))
+	if !strings.HasSuffix(keysURL, "/") {
+		keysURL += "/"
+	}
+	return &preset{
+		KeysURL: keysURL,
+		// ALB pads the base64 segments of the token, which RFC 7515 doesn't allow
+		ParserOptions: []jwt.ParserOption{jwt.WithPaddingAllowed()},
+		NewKeyfunc: func(client *http.Client) jwt.Keyfunc {
+			keys := &albKeys{client: client, url: keysURL, signers: arns, failed: newTTLCache[error](10000)}
+			keys.keys.Store(&map[string]*ecdsa.PublicKey{})
+			return keys.Keyfunc
+		},
+		TokenHeader: "X-Amzn-Oidc-Data",
+	}, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+)
+
+// batchRequest is the body of POST /validate/batch. Params are in query
+// string form, as for /validate; a token's own params replace the shared
+// ones, which in turn default to DEFAULT_PARAMS.
+type batchRequest struct {
+	Params string       `json:"params,omitempty"`
+	Tokens []batchToken `json:"tokens"`
+}
+
+type batchToken struct {
+	Token  string `json:"token"`
+	Params string `json:"params,omitempty"`
+}
+
+type batchResult struct {
+	Valid   bool              `json:"valid"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Reason is the code of the reason an invalid token was denied
+	Reason string `json:"reason,omitempty"`
+}
+
+// validateBatch validates many tokens in one request, for jobs that have to
+// check stored tokens. Results are returned in the order of the tokens.
+// Authorizers see an empty original request, as there is none.
+func (s *server) validateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var batch batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, s.BatchMaxBytes)).Decode(&batch); err != nil {
+		http.Error(w, "invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(batch.Tokens) > s.BatchMaxTokens {
+		http.Error(w, "too many tokens in batch", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	params, policy := s.defaults()
+	if batch.Params != "" {
+		params, policy = s.parseParams(batch.Params)
+	}
+	results := make([]batchResult, len(batch.Tokens))
+	for i, token := range batch.Tokens {
+		tokenParams, tokenPolicy := params, policy
+		if token.Params != "" {
+			tokenParams, tokenPolicy = s.parseParams(token.Params)
+		}
+		results[i] = s.validateBatchToken(r, token.Token, tokenParams, tokenPolicy)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Results []batchResult `json:"results"`
+	}{results}); err != nil {
+		s.Logger.Warnw("Failed to write batch results", "err", err)
+	}
+}
+
+func (s *server) validateBatchToken(r *http.Request, token string, params url.Values, policy *policy.Policy) batchResult {
+	claims, err := s.validateBatchClaims(r, token, policy)
+	if err != nil {
+		d := denialOf(err)
+		s.logDenial(err, d, token)
+		return batchResult{Reason: d.code}
+	}
+	return batchResult{Valid: true, Headers: s.responseHeaderValues(params, claims)}
+}
+
+// validateBatchClaims validates a token of the batch r. Each counts against
+// the RateLimit like a request of its own.
+func (s *server) validateBatchClaims(r *http.Request, token string, policy *policy.Policy) (jwt.MapClaims, error) {
+	if token == "" {
+		return nil, ErrNoToken
+	}
+	claims, err := s.validateLimited(r, token, policy)
+	if err != nil {
+		return nil, err
+	}
+	return claims, s.authorize(claims, originalRequest{})
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// newBenchServer returns a server accepting tokens signed by a fresh EC key,
+// and such a token.
+func newBenchServer(b *testing.B) (*server, string) {
+	b.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"sub":    "alice",
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"email":  "alice@example.com",
+		"groups": []string{"users", "developers", "ops"},
+		"scope":  "read write",
+	}).SignedString(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := &server{
+		Validator: validator.Validator{
+			Keyfunc: func(*jwt.Token) (interface{}, error) { return &key.PublicKey, nil },
+		},
+		Logger: logger.NewLogger("error"),
+	}
+	return s, token
+}
+
+func benchPolicy(b *testing.B, params url.Values) *policy.Policy {
+	b.Helper()
+	compiled, err := policy.Compile(params)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return compiled
+}
+
+var benchParams = url.Values{
+	"claims_groups":        {"admins", "developers"},
+	"claims_regexp_email":  {`@example\.com$`},
+	"headers_X-User":       {"sub"},
+	"headers_X-Groups":     {"groups"},
+	"headers_X-Auth-Email": {"email"},
+}
+
+func BenchmarkValidate(b *testing.B) {
+	s, token := newBenchServer(b)
+	s.policies.Store(&policySet{defaults: &parsedParams{values: benchParams, policy: benchPolicy(b, benchParams)}})
+	r := httptest.NewRequest(http.MethodGet, "/validate", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		w := httptest.NewRecorder()
+		s.validate(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkValidateCached(b *testing.B) {
+	s, token := newBenchServer(b)
+	s.policies.Store(&policySet{defaults: &parsedParams{values: benchParams, policy: benchPolicy(b, benchParams)}})
+	s.Results = &cachedResults{cache: &memoryCache{lru: newLRUCache[jwt.MapClaims](100)}, ttl: time.Minute}
+	r := httptest.NewRequest(http.MethodGet, "/validate", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		w := httptest.NewRecorder()
+		s.validate(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d", w.Code)
+		}
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	s, token := newBenchServer(b)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if _, err := s.Verify(token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClaimRequirements(b *testing.B) {
+	s, token := newBenchServer(b)
+	policy := benchPolicy(b, benchParams)
+	claims, err := s.Verify(token)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := s.queryStringClaimValidator(claims, policy); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLargePolicy checks claims against hundreds of allowed values and
+// patterns.
+func BenchmarkLargePolicy(b *testing.B) {
+	s, token := newBenchServer(b)
+	params := url.Values{}
+	for i := range 300 {
+		params.Add("claims_groups", fmt.Sprintf("group-%d", i))
+		params.Add("claims_regexp_email", fmt.Sprintf(`^user-%d@example\.com$`, i))
+		params.Add("claims_regexp_sub", fmt.Sprintf(`^service-%d-[a-z]+$`, i))
+	}
+	params.Add("claims_groups", "ops")
+	params.Add("claims_regexp_email", `^alice@example\.com$`)
+	params.Add("claims_regexp_sub", `^alice$`)
+	policy := benchPolicy(b, params)
+	claims, err := s.Verify(token)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := s.queryStringClaimValidator(claims, policy); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResponseHeaders(b *testing.B) {
+	s, token := newBenchServer(b)
+	claims, err := s.Verify(token)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if len(s.responseHeaderValues(benchParams, claims)) != 3 {
+			b.Fatal("headers missing")
+		}
+	}
+}
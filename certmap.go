@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+// certMap is a key set in Google's x509 format, a JSON object mapping key ids
+// to PEM encoded certificates, as served by the googleapis.com and
+// securetoken certificate endpoints. It is refreshed whenever the
+// Cache-Control max-age of the last response runs out.
+type certMap struct {
+	url     string
+	client  *http.Client
+	logger  logger.Logger
+	timeout time.Duration
+	// onRefresh is told about every successful refresh
+	onRefresh func(raw []byte, keys int, maxAge time.Duration)
+
+	keys atomic.Pointer[map[string]interface{}]
+}
+
+func newCertMap(client *http.Client, logger logger.Logger, url string, timeout time.Duration, onRefresh func(raw []byte, keys int, maxAge time.Duration)) (*certMap, error) {
+	c := &certMap{url: url, client: client, logger: logger, timeout: timeout, onRefresh: onRefresh}
+	maxAge, err := c.refresh()
+	if err != nil {
+		return nil, err
+	}
+	go c.refreshLoop(maxAge)
+	return c, nil
+}
+
+func (c *certMap) refreshLoop(maxAge time.Duration) {
+	for {
+		time.Sleep(maxAge)
+		var err error
+		if maxAge, err = c.refresh(); err != nil {
+			keySetRefreshErrors.WithLabelValues(c.url).Inc()
+			c.logger.Errorw("Failed to refresh certificates", "url", c.url, "err", err)
+			maxAge = time.Minute
+		}
+	}
+}
+
+func (c *certMap) refresh() (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, c.url)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read certificates from %s: %w", c.url, err)
+	}
+	keys, err := parseCerts(raw)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode certificates from %s: %w", c.url, err)
+	}
+
+	c.keys.Store(&keys)
+	maxAge := cacheMaxAge(resp.Header, time.Hour)
+	if c.onRefresh != nil {
+		c.onRefresh(raw, len(keys), maxAge)
+	}
+	return maxAge, nil
+}
+
+func (c *certMap) Keyfunc(token *jwt.Token) (interface{}, error) {
+	return keyByID(*c.keys.Load(), token)
+}
+
+// parseCerts parses a JSON object of key ids to PEM encoded certificates
+// into their public keys.
+func parseCerts(raw []byte) (map[string]interface{}, error) {
+	var certs map[string]string
+	if err := json.Unmarshal(raw, &certs); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(certs))
+	for kid, certPEM := range certs {
+		block, _ := pem.Decode([]byte(certPEM))
+		if block == nil {
+			return nil, fmt.Errorf("certificate %q is not PEM encoded", kid)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %q: %w", kid, err)
+		}
+		keys[kid] = cert.PublicKey
+	}
+	return keys, nil
+}
+
+func keyByID(keys map[string]interface{}, token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	return key, nil
+}
+
+// cacheMaxAge returns the max-age of a Cache-Control header, or fallback.
+func cacheMaxAge(header http.Header, fallback time.Duration) time.Duration {
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if value, ok := strings.CutPrefix(directive, "max-age="); ok {
+			if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return fallback
+}
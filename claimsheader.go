@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Encodings of the claims header
+const (
+	claimsEncodingJSON   = "json"
+	claimsEncodingBase64 = "base64"
+)
+
+// claimsHeader passes all claims, or those of Claims, upstream in a single
+// header, so services don't need a headers_* param for each of them.
+type claimsHeader struct {
+	Name     string
+	Encoding string
+	// Claims are the claims to include, all if empty.
+	Claims []string
+}
+
+func newClaimsHeader() (*claimsHeader, error) {
+	name := getenv("CLAIMS_HEADER", "")
+	if name == "" {
+		return nil, nil
+	}
+	encoding := getenv("CLAIMS_HEADER_ENCODING", claimsEncodingBase64)
+	if encoding != claimsEncodingJSON && encoding != claimsEncodingBase64 {
+		return nil, fmt.Errorf("unknown CLAIMS_HEADER_ENCODING %q, expected json or base64", encoding)
+	}
+	return &claimsHeader{Name: name, Encoding: encoding, Claims: splitList(getenv("CLAIMS_HEADER_CLAIMS", ""))}, nil
+}
+
+// value encodes claims for the header.
+func (h *claimsHeader) value(claims jwt.MapClaims) (string, bool) {
+	included := claims
+	if len(h.Claims) > 0 {
+		included = make(jwt.MapClaims, len(h.Claims))
+		for _, name := range h.Claims {
+			if claim, ok := claims[name]; ok {
+				included[name] = claim
+			}
+		}
+	}
+	b, err := json.Marshal(included)
+	if err != nil {
+		return "", false
+	}
+	if h.Encoding == claimsEncodingBase64 {
+		return base64.StdEncoding.EncodeToString(b), true
+	}
+	return string(b), true
+}
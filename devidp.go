@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// devIdP is the mock identity provider of --dev mode. It serves the JWKS
+// of its signing key and issues tokens with whatever claims it is asked
+// for. The server accepts its tokens in addition to those of the configured
+// key sets.
+type devIdP struct {
+	key *devKey
+}
+
+// newDevIdP signs with the key at keyFile, which is created if missing, or
+// with a new key for every run if keyFile is empty.
+func newDevIdP(keyFile string) (*devIdP, error) {
+	var private *ecdsa.PrivateKey
+	var err error
+	if keyFile != "" {
+		private, err = signingKey(keyFile)
+	} else {
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &devIdP{key: newDevKey(private)}, nil
+}
+
+// keyfunc returns the key of the tokens the IdP issued, and otherwise asks
+// next, if any.
+func (d *devIdP) keyfunc(next jwt.Keyfunc) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		if kid, _ := token.Header["kid"].(string); kid == d.key.jwk["kid"] {
+			return &d.key.private.PublicKey, nil
+		}
+		if next == nil {
+			return nil, fmt.Errorf("unknown kid %v", token.Header["kid"])
+		}
+		return next(token)
+	}
+}
+
+func (d *devIdP) serveJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.key.jwks())
+}
+
+// issue responds with a token. The claims are the JSON object in the body
+// of a POST, or else the query parameters, as strings or, if repeated,
+// lists of strings. The ttl parameter sets the lifetime, 1h by default.
+func (d *devIdP) issue(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ttl := time.Hour
+	if value := query.Get("ttl"); value != "" {
+		var err error
+		if ttl, err = time.ParseDuration(value); err != nil {
+			http.Error(w, "invalid ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		query.Del("ttl")
+	}
+
+	claims := jwt.MapClaims{}
+	switch r.Method {
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&claims); err != nil {
+			http.Error(w, "invalid claims: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	case http.MethodGet:
+		for name, values := range query {
+			if len(values) == 1 {
+				claims[name] = values[0]
+				continue
+			}
+			list := make([]interface{}, len(values))
+			for i, value := range values {
+				list[i] = value
+			}
+			claims[name] = list
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	signed, err := d.key.sign(claims, "", ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, signed)
+}
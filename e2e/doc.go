@@ -0,0 +1,6 @@
+// Package e2e tests nginx-jwt-auth behind nginx's auth_request, with the
+// service built from the repository's Dockerfile and a static mock IdP, all
+// run in containers. The tests need Docker and the e2e build tag:
+//
+//	go test -tags e2e ./e2e
+package e2e
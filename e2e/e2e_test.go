@@ -0,0 +1,288 @@
+//go:build e2e
+
+package e2e
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/network"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// nginxConf protects /api/ with the Authorization header and /web/ with the
+// session cookie, and echoes the X-User header of the validation response.
+// It resolves the service on every request, as it gets a new address when
+// restarted.
+const nginxConf = `
+server {
+	listen 80;
+	resolver 127.0.0.11 valid=1s;
+
+	location = /_auth {
+		internal;
+		set $jwt_auth jwt-auth:8080;
+		proxy_pass http://$jwt_auth/validate?claims_groups=admin&headers_X-User=sub;
+		proxy_pass_request_body off;
+		proxy_set_header Content-Length "";
+		proxy_set_header X-Original-URI $request_uri;
+	}
+
+	location = /_auth_cookie {
+		internal;
+		set $jwt_auth jwt-auth:8080;
+		proxy_pass http://$jwt_auth/validate?cookie=session&claims_groups=admin&headers_X-User=sub;
+		proxy_pass_request_body off;
+		proxy_set_header Content-Length "";
+		proxy_set_header X-Original-URI $request_uri;
+	}
+
+	location /api/ {
+		auth_request /_auth;
+		auth_request_set $user $upstream_http_x_user;
+		add_header X-User $user always;
+		return 200 "ok\n";
+	}
+
+	location /web/ {
+		auth_request /_auth_cookie;
+		auth_request_set $user $upstream_http_x_user;
+		add_header X-User $user always;
+		return 200 "ok\n";
+	}
+}
+`
+
+// signer is a signing key the mock IdP may publish.
+type signer struct {
+	kid string
+	key *ecdsa.PrivateKey
+}
+
+func newSigner(t *testing.T, kid string) signer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer{kid: kid, key: key}
+}
+
+func (s signer) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func jwks(t *testing.T, signers ...signer) string {
+	t.Helper()
+	var keys []map[string]string
+	for _, s := range signers {
+		encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		keys = append(keys, map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": s.kid,
+			"alg": "ES256",
+			"use": "sig",
+			"x":   encode(s.key.X.FillBytes(make([]byte, 32))),
+			"y":   encode(s.key.Y.FillBytes(make([]byte, 32))),
+		})
+	}
+	raw, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+// stack is the mock IdP, the service and nginx, reached at url.
+type stack struct {
+	url  string
+	idp  testcontainers.Container
+	auth testcontainers.Container
+}
+
+// startStack runs the mock IdP, the service and nginx in a shared network.
+// The IdP publishes the JWKS of signers.
+func startStack(t *testing.T, signers ...signer) stack {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+	ctx := context.Background()
+	nw, err := network.New(ctx)
+	testcontainers.CleanupNetwork(t, nw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp, err := testcontainers.Run(ctx, "nginx:alpine",
+		network.WithNetwork([]string{"idp"}, nw),
+		testcontainers.WithFiles(testcontainers.ContainerFile{
+			Reader:            strings.NewReader(jwks(t, signers...)),
+			ContainerFilePath: "/usr/share/nginx/html/jwks.json",
+			FileMode:          0o644,
+		}),
+		testcontainers.WithWaitStrategy(wait.ForHTTP("/jwks.json").WithPort("80/tcp")),
+	)
+	testcontainers.CleanupContainer(t, idp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := testcontainers.Run(ctx, "",
+		testcontainers.WithDockerfile(testcontainers.FromDockerfile{Context: "..", Dockerfile: "Dockerfile"}),
+		network.WithNetwork([]string{"jwt-auth"}, nw),
+		testcontainers.WithEnv(map[string]string{
+			"JWKS_URL":                   "http://idp/jwks.json",
+			"LOG_LEVEL":                  "debug",
+			"FORBID_INSUFFICIENT_CLAIMS": "true",
+		}),
+		testcontainers.WithExposedPorts("8080/tcp"),
+		testcontainers.WithWaitStrategy(wait.ForHTTP("/healthz").WithPort("8080/tcp").WithStartupTimeout(5*time.Minute)),
+	)
+	testcontainers.CleanupContainer(t, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy, err := testcontainers.Run(ctx, "nginx:alpine",
+		network.WithNetwork([]string{"nginx"}, nw),
+		testcontainers.WithFiles(testcontainers.ContainerFile{
+			Reader:            strings.NewReader(nginxConf),
+			ContainerFilePath: "/etc/nginx/conf.d/default.conf",
+			FileMode:          0o644,
+		}),
+		testcontainers.WithExposedPorts("80/tcp"),
+		testcontainers.WithWaitStrategy(wait.ForListeningPort("80/tcp")),
+	)
+	testcontainers.CleanupContainer(t, proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint, err := proxy.PortEndpoint(ctx, "80/tcp", "http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stack{url: endpoint, idp: idp, auth: auth}
+}
+
+// rotate makes the IdP publish the JWKS of signers instead. The service only
+// refreshes it hourly, so it is restarted to fetch it now.
+func (s stack) rotate(t *testing.T, signers ...signer) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.idp.CopyToContainer(ctx, []byte(jwks(t, signers...)), "/usr/share/nginx/html/jwks.json", 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.auth.Stop(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.auth.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, url string, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func cookie(token string) http.Header {
+	return http.Header{"Cookie": {"session=" + token}}
+}
+
+func TestNginxAuthRequest(t *testing.T) {
+	current, next, unpublished := newSigner(t, "current"), newSigner(t, "next"), newSigner(t, "unpublished")
+	// The IdP is in the middle of a rotation, publishing both keys
+	stack := startStack(t, current, next)
+
+	admin := jwt.MapClaims{"sub": "alice", "groups": []string{"admin"}}
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+		user   string
+	}{
+		{"header token", "/api/", bearer(current.sign(t, admin)), http.StatusOK, "alice"},
+		{"no token", "/api/", nil, http.StatusUnauthorized, ""},
+		{"malformed token", "/api/", bearer("not-a-jwt"), http.StatusUnauthorized, ""},
+		{"expired token", "/api/", bearer(current.sign(t, jwt.MapClaims{"sub": "alice", "groups": "admin", "exp": time.Now().Add(-time.Minute).Unix()})), http.StatusUnauthorized, ""},
+		// With FORBID_INSUFFICIENT_CLAIMS the service answers valid tokens
+		// without the claims with 403, which nginx passes on
+		{"insufficient claims", "/api/", bearer(current.sign(t, jwt.MapClaims{"sub": "bob", "groups": []string{"users"}})), http.StatusForbidden, ""},
+		{"cookie token", "/web/", cookie(current.sign(t, admin)), http.StatusOK, "alice"},
+		{"header token for cookie location", "/web/", bearer(current.sign(t, admin)), http.StatusUnauthorized, ""},
+		{"cookie token for header location", "/api/", cookie(current.sign(t, admin)), http.StatusUnauthorized, ""},
+		{"rotated key", "/api/", bearer(next.sign(t, jwt.MapClaims{"sub": "carol", "groups": []string{"admin"}})), http.StatusOK, "carol"},
+		{"unpublished key", "/api/", bearer(unpublished.sign(t, admin)), http.StatusUnauthorized, ""},
+		{"published kid, wrong key", "/api/", bearer(signer{kid: current.kid, key: unpublished.key}.sign(t, admin)), http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := get(t, stack.url+tt.path, tt.header)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if user := resp.Header.Get("X-User"); user != tt.user {
+				t.Errorf("X-User = %q, want %q", user, tt.user)
+			}
+		})
+	}
+
+	// The IdP finishes the rotation, retiring the current key and
+	// publishing the one after next
+	afterNext := newSigner(t, "after-next")
+	stack.rotate(t, next, afterNext)
+	rotated := []struct {
+		name   string
+		signer signer
+		status int
+	}{
+		{"retired key", current, http.StatusUnauthorized},
+		{"current key", next, http.StatusOK},
+		{"newly published key", afterNext, http.StatusOK},
+	}
+	for _, tt := range rotated {
+		t.Run("after rotation/"+tt.name, func(t *testing.T) {
+			resp := get(t, stack.url+"/api/", bearer(tt.signer.sign(t, admin)))
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// Supported values of SERVER_ENGINE.
+const (
+	engineNetHTTP = "net/http"
+	// fasthttp reuses connections, requests and buffers, which saves most of
+	// the per request overhead of net/http at very high request rates. The
+	// handlers stay the same, requests are adapted to net/http ones.
+	engineFastHTTP = "fasthttp"
+)
+
+// httpServer is the HTTP server implementation selected by SERVER_ENGINE.
+type httpServer interface {
+	Serve(listener net.Listener) error
+	// Shutdown stops accepting connections and waits for the requests in
+	// flight until ctx is done.
+	Shutdown(ctx context.Context) error
+}
+
+// serverLimits bound how long clients may take and how large their headers
+// may be, so slow or stuck clients can't tie up connections.
+type serverLimits struct {
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	// IdleTimeout closes keep-alive connections proxies left unused.
+	IdleTimeout time.Duration
+	// MaxHeaderBytes is 0 for the default of the engine.
+	MaxHeaderBytes int
+}
+
+func newServerLimits() (serverLimits, error) {
+	var limits serverLimits
+	for _, timeout := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", "10s", &limits.ReadHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", "30s", &limits.ReadTimeout},
+		{"HTTP_WRITE_TIMEOUT", "30s", &limits.WriteTimeout},
+		{"HTTP_IDLE_TIMEOUT", "90s", &limits.IdleTimeout},
+	} {
+		var err error
+		if *timeout.to, err = time.ParseDuration(getenv(timeout.name, timeout.value)); err != nil {
+			return limits, fmt.Errorf("couldn't parse %s: %w", timeout.name, err)
+		}
+	}
+	if maxHeaderBytes := getenv("HTTP_MAX_HEADER_BYTES", ""); maxHeaderBytes != "" {
+		var err error
+		if limits.MaxHeaderBytes, err = strconv.Atoi(maxHeaderBytes); err != nil || limits.MaxHeaderBytes <= 0 {
+			return limits, fmt.Errorf("invalid HTTP_MAX_HEADER_BYTES %q", maxHeaderBytes)
+		}
+	}
+	return limits, nil
+}
+
+// newHTTPServer returns a server of handler, implemented by engine.
+func newHTTPServer(engine string, handler http.Handler) (httpServer, error) {
+	limits, err := newServerLimits()
+	if err != nil {
+		return nil, err
+	}
+	switch engine {
+	case engineNetHTTP:
+		return &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: limits.ReadHeaderTimeout,
+			ReadTimeout:       limits.ReadTimeout,
+			WriteTimeout:      limits.WriteTimeout,
+			IdleTimeout:       limits.IdleTimeout,
+			MaxHeaderBytes:    limits.MaxHeaderBytes,
+		}, nil
+	case engineFastHTTP:
+		concurrency, err := strconv.Atoi(getenv("FASTHTTP_CONCURRENCY", strconv.Itoa(fasthttp.DefaultConcurrency)))
+		if err != nil || concurrency <= 0 {
+			return nil, fmt.Errorf("invalid FASTHTTP_CONCURRENCY %q", getenv("FASTHTTP_CONCURRENCY", ""))
+		}
+		return &fastHTTPServer{Server: &fasthttp.Server{
+			Handler:     fasthttpadaptor.NewFastHTTPHandler(handler),
+			Concurrency: concurrency,
+			// fasthttp reads the header and the body within ReadTimeout
+			ReadTimeout:  limits.ReadTimeout,
+			WriteTimeout: limits.WriteTimeout,
+			IdleTimeout:  limits.IdleTimeout,
+			// Headers have to fit into the read buffer
+			ReadBufferSize:        limits.MaxHeaderBytes,
+			NoDefaultServerHeader: true,
+			NoDefaultDate:         true,
+			NoDefaultContentType:  true,
+		}}, nil
+	default:
+		return nil, fmt.Errorf("unknown SERVER_ENGINE %q", engine)
+	}
+}
+
+// fastHTTPServer adapts a fasthttp server to httpServer.
+type fastHTTPServer struct {
+	*fasthttp.Server
+}
+
+func (s *fastHTTPServer) Shutdown(ctx context.Context) error {
+	return s.Server.ShutdownWithContext(ctx)
+}
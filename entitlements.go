@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// entitlements queries a REST service mapping subjects to permissions. The
+// response is either a JSON array, stored in Claim, or a JSON object whose
+// members are added as claims the token doesn't already have.
+type entitlements struct {
+	Client *http.Client
+	// URL contains {sub}, replaced by the escaped subject.
+	URL       string
+	Token     string
+	Claim     string
+	CacheTTL  time.Duration
+	FailOpen  bool
+	breaker   *breaker
+	responses *ttlCache[interface{}]
+}
+
+func newEntitlements(client *http.Client) *entitlements {
+	ttl, err := time.ParseDuration(getenv("ENTITLEMENTS_CACHE_TTL", "1m"))
+	if err != nil {
+		ttl = time.Minute
+	}
+	failures, err := strconv.Atoi(getenv("ENTITLEMENTS_BREAKER_FAILURES", "5"))
+	if err != nil {
+		failures = 5
+	}
+	cooldown, err := time.ParseDuration(getenv("ENTITLEMENTS_BREAKER_COOLDOWN", "30s"))
+	if err != nil {
+		cooldown = 30 * time.Second
+	}
+	return &entitlements{
+		Client:    client,
+		URL:       getenv("ENTITLEMENTS_URL", ""),
+		Token:     getenv("ENTITLEMENTS_TOKEN", ""),
+		Claim:     getenv("ENTITLEMENTS_CLAIM", "permissions"),
+		CacheTTL:  ttl,
+		FailOpen:  getenv("ENTITLEMENTS_FAIL_OPEN", "false") == "true",
+		breaker:   &breaker{threshold: failures, cooldown: cooldown},
+		responses: newTTLCache[interface{}](10000),
+	}
+}
+
+func (e *entitlements) enrich(raw string, claims jwt.MapClaims) error {
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return errors.New("token has no sub to look up entitlements for")
+	}
+	response, ok := e.responses.get(sub)
+	if !ok {
+		var err error
+		if response, err = e.fetch(sub); err != nil {
+			if e.FailOpen {
+				return fmt.Errorf("%w: entitlement lookup of %q failed: %w", validator.ErrIncomplete, sub, err)
+			}
+			return fmt.Errorf("entitlement lookup of %q failed: %w", sub, err)
+		}
+		e.responses.set(sub, response, e.CacheTTL)
+	}
+
+	switch v := response.(type) {
+	case []interface{}:
+		claims[e.Claim] = v
+	case map[string]interface{}:
+		for name, value := range v {
+			if _, exists := claims[name]; !exists {
+				claims[name] = value
+			}
+		}
+	}
+	return nil
+}
+
+func (e *entitlements) fetch(sub string) (interface{}, error) {
+	if !e.breaker.allow() {
+		return nil, errBreakerOpen
+	}
+	response, err := e.get(sub)
+	e.breaker.record(err == nil)
+	return response, err
+}
+
+func (e *entitlements) get(sub string) (interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, strings.ReplaceAll(e.URL, "{sub}", url.PathEscape(sub)), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if e.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+e.Token)
+	}
+	resp, err := e.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// Unknown subjects simply have no entitlements
+		return []interface{}{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var response interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	switch response.(type) {
+	case []interface{}, map[string]interface{}:
+		return response, nil
+	default:
+		return nil, fmt.Errorf("unexpected response of type %T", response)
+	}
+}
+
+// breaker stops calling a failing dependency for cooldown once threshold
+// calls in a row failed. After the cooldown a single trial call is let
+// through, and its outcome closes or reopens the breaker.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+}
+
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if time.Now().Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+func (b *breaker) record(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
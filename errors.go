@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// The reasons a request is denied besides those of package validator, which
+// cover the token itself.
+var (
+	ErrMethod  = errors.New("method not allowed")
+	ErrNoToken = errors.New("no token")
+	// ErrRateLimited is returned for clients exceeding RATE_LIMIT.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrCachedRejection is returned for tokens that failed verification
+	// before, as cached by RESULT_CACHE or NEGATIVE_CACHE_TTL.
+	ErrCachedRejection = errors.New("token was rejected before")
+	// ErrNotAuthorized is returned when an authorizer denies the request,
+	// ErrAuthorization when it fails to decide.
+	ErrNotAuthorized = errors.New("not authorized")
+	ErrAuthorization = errors.New("authorization failed")
+	// ErrInactive is returned for opaque tokens the introspection endpoint
+	// doesn't consider active, ErrIntrospection when asking it fails.
+	ErrInactive      = errors.New("token is not active")
+	ErrIntrospection = errors.New("introspection failed")
+)
+
+// denial is how a request denied for a reason is answered.
+type denial struct {
+	reason error
+	status int
+	// code names the reason in logs and response bodies
+	code string
+	// stage is where validation stopped: request, token, policy or
+	// authorization
+	stage string
+	// internal reasons are failures of this service or its dependencies
+	// rather than of the request, and are logged as errors
+	internal bool
+}
+
+// denials lists the reasons for denying a request, the first one an error
+// wraps applies.
+var denials = []denial{
+	{reason: ErrMethod, status: http.StatusMethodNotAllowed, code: "method", stage: "request"},
+	{reason: ErrNoToken, status: http.StatusUnauthorized, code: "no_token", stage: "request"},
+	{reason: ErrRateLimited, status: http.StatusTooManyRequests, code: "rate_limited", stage: "request"},
+	{reason: ErrCachedRejection, status: http.StatusUnauthorized, code: "cached", stage: "token"},
+	{reason: validator.ErrMalformed, status: http.StatusUnauthorized, code: "malformed", stage: "token"},
+	{reason: validator.ErrAlgorithm, status: http.StatusUnauthorized, code: "algorithm", stage: "token"},
+	// The key lookup failing, rather than the signature, usually means the
+	// key set lacks a rotated key or can't be fetched
+	{reason: jwt.ErrTokenUnverifiable, status: http.StatusUnauthorized, code: "no_key", stage: "token"},
+	{reason: validator.ErrSignature, status: http.StatusUnauthorized, code: "signature", stage: "token"},
+	{reason: ErrInactive, status: http.StatusUnauthorized, code: "inactive", stage: "token"},
+	{reason: ErrIntrospection, status: http.StatusUnauthorized, code: "introspection", stage: "token", internal: true},
+	{reason: validator.ErrExpired, status: http.StatusUnauthorized, code: "expired", stage: "token"},
+	{reason: jwt.ErrTokenInvalidAudience, status: http.StatusUnauthorized, code: "audience", stage: "token"},
+	{reason: jwt.ErrTokenInvalidIssuer, status: http.StatusUnauthorized, code: "issuer", stage: "token"},
+	{reason: validator.ErrClaims, status: http.StatusUnauthorized, code: "claims", stage: "token"},
+	{reason: validator.ErrEnrichment, status: http.StatusUnauthorized, code: "enrichment", stage: "token", internal: true},
+	{reason: validator.ErrPolicy, status: http.StatusUnauthorized, code: "policy", stage: "policy"},
+	{reason: ErrNotAuthorized, status: http.StatusUnauthorized, code: "not_authorized", stage: "authorization"},
+	{reason: ErrAuthorization, status: http.StatusUnauthorized, code: "authorization", stage: "authorization", internal: true},
+}
+
+// forbidInsufficientClaims answers valid tokens whose claims the policy or
+// an authorizer refuses with 403 rather than 401, so nginx doesn't send the
+// user to log in again for nothing. It must be called before serving.
+func forbidInsufficientClaims() {
+	for i, d := range denials {
+		if (d.stage == "policy" || d.stage == "authorization") && !d.internal {
+			denials[i].status = http.StatusForbidden
+		}
+	}
+}
+
+// denialOf returns how to answer a request denied because of err.
+func denialOf(err error) denial {
+	for _, d := range denials {
+		if errors.Is(err, d.reason) {
+			return d
+		}
+	}
+	return denial{reason: err, status: http.StatusUnauthorized, code: "unknown", stage: "token"}
+}
+
+// logDenial logs why a request with token was denied and counts it.
+func (s *server) logDenial(err error, d denial, token string) {
+	denialsTotal.WithLabelValues(d.code, s.issuerLabel(token)).Inc()
+	switch d.status {
+	case http.StatusUnauthorized:
+		outcomesTotal.WithLabelValues("unauthenticated").Inc()
+	case http.StatusForbidden:
+		outcomesTotal.WithLabelValues("forbidden").Inc()
+	}
+	if d.internal {
+		s.Logger.Errorw("Request denied", "reason", d.code, "err", err)
+	} else if s.Logger.DebugEnabled() {
+		s.Logger.Debugw("Request denied", "reason", d.code, "err", err)
+	}
+}
+
+// issuerLabel returns the issuer to count the denial of token for: its iss,
+// read unverified, if it's one of the MetricIssuers, none without one, and
+// other else, so forged tokens can't add label values.
+func (s *server) issuerLabel(token string) string {
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err != nil {
+		return "none"
+	}
+	switch iss, _ := claims["iss"].(string); {
+	case iss == "":
+		return "none"
+	case s.MetricIssuers[iss]:
+		return iss
+	}
+	return "other"
+}
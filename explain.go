@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robbilie/nginx-jwt-auth/policy"
+)
+
+// explainHeader carries the explanation of a denial in the response.
+const explainHeader = "X-Jwt-Auth-Explain"
+
+// explanation tells app teams why a request was denied.
+type explanation struct {
+	Stage  string `json:"stage"`
+	Reason string `json:"reason"`
+	// Claim, Param and Expected name the requirement of the policy a claim
+	// doesn't satisfy.
+	Claim    string   `json:"claim,omitempty"`
+	Param    string   `json:"param,omitempty"`
+	Expected []string `json:"expected,omitempty"`
+	Detail   string   `json:"detail"`
+}
+
+func explain(err error, d denial) explanation {
+	e := explanation{Stage: d.stage, Reason: d.code, Detail: err.Error()}
+	var mismatch *policy.Mismatch
+	if errors.As(err, &mismatch) {
+		e.Claim, e.Param, e.Expected = mismatch.Claim, mismatch.Param, mismatch.Expected
+	}
+	return e
+}
+
+// explains reports whether denials of r are explained: if its params have
+// explain=true, or it carries a debug header signed with EXPLAIN_SECRET.
+func (s *server) explains(r *http.Request, params url.Values) bool {
+	if params.Get("explain") == "true" {
+		return true
+	}
+	if s.ExplainSecret == nil {
+		return false
+	}
+	value := r.Header.Get(s.ExplainHeader)
+	return value != "" && validDebugHeader(s.ExplainSecret, value, time.Now())
+}
+
+// validDebugHeader checks a debug header of the form <expiry>.<mac>, where
+// expiry is a unix time and mac the unpadded base64url HMAC-SHA256 of it.
+func validDebugHeader(secret []byte, value string, now time.Time) bool {
+	expiry, mac, found := strings.Cut(value, ".")
+	if !found {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil || now.Unix() > unix {
+		return false
+	}
+	given, err := base64.RawURLEncoding.DecodeString(mac)
+	if err != nil {
+		return false
+	}
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(expiry))
+	return hmac.Equal(given, h.Sum(nil))
+}
+
+// writeExplanation adds the explanation of a denial to the response and
+// logs it.
+func (s *server) writeExplanation(w http.ResponseWriter, r *http.Request, err error, d denial) {
+	e := explain(err, d)
+	encoded, _ := json.Marshal(e)
+	w.Header().Set(explainHeader, string(encoded))
+	s.Logger.Infow("Denial explained", "stage", e.Stage, "reason", e.Reason, "claim", e.Claim,
+		"param", e.Param, "expected", e.Expected, "detail", e.Detail, "original", s.originalRequest(r))
+}
@@ -0,0 +1,108 @@
+// Package extension lets forks add company specific token extractors, key
+// providers and claim checks to nginx-jwt-auth without changing its code.
+// Extensions register themselves by name in an init function, like
+// database/sql drivers, and are compiled in with a blank import in a file of
+// their own next to main.go:
+//
+//	package main
+//
+//	import _ "example.com/acme/jwtauth-acme"
+//
+// They are then enabled by name with the EXTRACTORS, KEY_PROVIDERS and
+// CHECKS environment variables. Extensions read their own settings from the
+// environment.
+package extension
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// Extractor returns the token of a request, or "" if it has none the
+// extractor knows of.
+type Extractor func(r *http.Request) string
+
+// KeyProvider is called once at startup and returns the Keyfunc to look up
+// keys with. Its keys are used along with the configured key sets.
+type KeyProvider func() (jwt.Keyfunc, error)
+
+// CheckProvider is called once at startup and returns a check for the claims
+// of every valid token.
+type CheckProvider func() (validator.Check, error)
+
+var (
+	mu           sync.RWMutex
+	extractors   = map[string]Extractor{}
+	keyProviders = map[string]KeyProvider{}
+	checks       = map[string]CheckProvider{}
+)
+
+// RegisterExtractor makes an Extractor available by name. It panics if the
+// name is taken.
+func RegisterExtractor(name string, e Extractor) {
+	register(extractors, "extractor", name, e)
+}
+
+// RegisterKeyProvider makes a KeyProvider available by name. It panics if
+// the name is taken.
+func RegisterKeyProvider(name string, p KeyProvider) {
+	register(keyProviders, "key provider", name, p)
+}
+
+// RegisterCheck makes a CheckProvider available by name. It panics if the
+// name is taken.
+func RegisterCheck(name string, p CheckProvider) {
+	register(checks, "check", name, p)
+}
+
+func register[T any](registry map[string]T, kind, name string, value T) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, taken := registry[name]; taken {
+		panic(fmt.Sprintf("extension: %s %q registered twice", kind, name))
+	}
+	registry[name] = value
+}
+
+// Extractors returns the extractors registered by names, in that order.
+func Extractors(names []string) ([]Extractor, error) {
+	return lookup(extractors, "extractor", names)
+}
+
+// KeyProviders returns the key providers registered by names.
+func KeyProviders(names []string) ([]KeyProvider, error) {
+	return lookup(keyProviders, "key provider", names)
+}
+
+// Checks returns the check providers registered by names.
+func Checks(names []string) ([]CheckProvider, error) {
+	return lookup(checks, "check", names)
+}
+
+func lookup[T any](registry map[string]T, kind string, names []string) ([]T, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	found := make([]T, 0, len(names))
+	for _, name := range names {
+		value, ok := registry[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown %s %q, registered are %v", kind, name, registered(registry))
+		}
+		found = append(found, value)
+	}
+	return found, nil
+}
+
+func registered[T any](registry map[string]T) []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
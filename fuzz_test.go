@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// FuzzClaims runs the claims of a verified token through normalization, the
+// claim requirements and the response headers of a validation request, with
+// arbitrary claims and params.
+func FuzzClaims(f *testing.F) {
+	for _, seed := range []struct{ params, claims string }{
+		{"claims_groups=admins&headers_X-User=sub", `{"sub":"alice","groups":["admins"]}`},
+		{`claims_regexp_email=@example\.com$&headers_X-Roles=roles`, `{"https://example.com/roles":["a",1,null],"email":["x@example.com"]}`},
+		{"claims_groups=admins&claims_regexp_groups=(", `{"roles":{"a":"b"},"_claim_names":{"groups":"src1"},"hasgroups":"true"}`},
+		{"headers_X-Overage=groups_overage&headers_X-Groups=groups", `{"_claim_names":[],"hasgroups":true,"groups":1.5}`},
+		{"%zz&claims_sub", `null`},
+	} {
+		f.Add(seed.params, []byte(seed.claims))
+	}
+	s := &server{
+		Validator: validator.Validator{
+			ClaimNamespaces: []string{"https://example.com/"},
+			ClaimAliases:    map[string]string{"groups": "roles"},
+			ClaimTransforms: []func(jwt.MapClaims){func(claims jwt.MapClaims) {
+				if azureGroupsOverage(claims) {
+					claims["groups_overage"] = "true"
+				}
+			}},
+		},
+		Logger: logger.NewLogger("fatal"),
+		params: newLRUCache[*parsedParams](maxCachedParams),
+	}
+	f.Fuzz(func(t *testing.T, rawParams string, rawClaims []byte) {
+		var claims jwt.MapClaims
+		if err := json.Unmarshal(rawClaims, &claims); err != nil || claims == nil {
+			t.Skip()
+		}
+		s.Normalize(claims)
+		params, policy := s.parseParams(rawParams)
+		if s.queryStringClaimValidator(claims, policy) == nil {
+			s.responseHeaderValues(params, claims)
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+var validationTimeDuringGC = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "nginx_subrequest_auth_jwt_token_validation_during_gc_time_seconds",
+	Help:    "Number of seconds spent validating tokens, for validations a garbage collection cycle ended during",
+	Buckets: validationTimeBuckets,
+})
+
+func init() {
+	prometheus.MustRegister(validationTimeDuringGC)
+}
+
+// ballast is never read. It is a large heap allocation that raises the
+// heap size GOGC paces against, so a small live heap isn't collected every
+// few milliseconds. Its pages are never touched and cost no resident memory.
+var ballast []byte
+
+// configureGC applies the GC settings beyond what the runtime reads from
+// GOGC and GOMEMLIMIT itself.
+func configureGC(logger logger.Logger) error {
+	if size := getenv("GC_BALLAST", ""); size != "" {
+		n, err := parseBytes(size)
+		if err != nil {
+			return fmt.Errorf("invalid GC_BALLAST: %w", err)
+		}
+		ballast = make([]byte, n)
+		logger.Infow("Allocated GC ballast", "bytes", n)
+	}
+
+	// An explicit GOMEMLIMIT always wins
+	if ratio := getenv("MEMORY_LIMIT_RATIO", ""); ratio != "" && os.Getenv("GOMEMLIMIT") == "" {
+		r, err := strconv.ParseFloat(ratio, 64)
+		if err != nil || r <= 0 || r > 1 {
+			return fmt.Errorf("invalid MEMORY_LIMIT_RATIO %q, expected a fraction like 0.9", ratio)
+		}
+		limit, err := cgroupMemoryLimit()
+		if err != nil {
+			logger.Warnw("No container memory limit found, MEMORY_LIMIT_RATIO ignored", "err", err)
+			return nil
+		}
+		debug.SetMemoryLimit(int64(float64(limit) * r))
+		logger.Infow("Set memory limit", "bytes", int64(float64(limit)*r), "containerLimit", limit)
+	}
+	return nil
+}
+
+// cgroupMemoryLimit reads the memory limit of the container, cgroup v2 first.
+func cgroupMemoryLimit() (int64, error) {
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(raw))
+		if value == "max" {
+			return 0, fmt.Errorf("%s is unlimited", path)
+		}
+		limit, err := strconv.ParseInt(value, 10, 64)
+		// cgroup v1 reports unlimited as a huge number
+		if err != nil || limit <= 0 || limit >= 1<<62 {
+			return 0, fmt.Errorf("%s: no usable limit %q", path, value)
+		}
+		return limit, nil
+	}
+	return 0, fmt.Errorf("no cgroup memory limit file")
+}
+
+// parseBytes parses sizes like 512MiB, 1GB or 1048576.
+func parseBytes(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"B", 1},
+	}
+	factor := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, factor = number, unit.factor
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * factor, nil
+}
+
+// gcCycles returns the number of completed GC cycles. Unlike
+// runtime.ReadMemStats it doesn't stop the world.
+func gcCycles() uint64 {
+	sample := gcSamples.Get().(*[1]metrics.Sample)
+	defer gcSamples.Put(sample)
+	metrics.Read(sample[:])
+	return sample[0].Value.Uint64()
+}
+
+var gcSamples = sync.Pool{New: func() interface{} {
+	return &[1]metrics.Sample{{Name: "/gc/cycles/total:gc-cycles"}}
+}}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const graphTransitiveGroups = "https://graph.microsoft.com/v1.0/users/%s/transitiveMemberOf/microsoft.graph.group?$select=id&$top=999"
+
+// graphGroups resolves the groups of Azure AD tokens that hit the groups
+// overage limit, by asking Microsoft Graph with the app's own credentials.
+// The app needs the GroupMember.Read.All application permission in every
+// tenant it serves.
+type graphGroups struct {
+	Client       *http.Client
+	ClientID     string
+	ClientSecret string
+	CacheTTL     time.Duration
+
+	groups    *ttlCache[[]string]
+	appTokens *ttlCache[string]
+}
+
+func newGraphGroups(client *http.Client) *graphGroups {
+	ttl, err := time.ParseDuration(getenv("AZURE_GRAPH_CACHE_TTL", "10m"))
+	if err != nil {
+		ttl = 10 * time.Minute
+	}
+	return &graphGroups{
+		Client:       client,
+		ClientID:     getenv("AZURE_GRAPH_CLIENT_ID", ""),
+		ClientSecret: getenv("AZURE_GRAPH_CLIENT_SECRET", ""),
+		CacheTTL:     ttl,
+		groups:       newTTLCache[[]string](10000),
+		appTokens:    newTTLCache[string](100),
+	}
+}
+
+// enrich replaces the overage marker with the user's transitive groups.
+func (g *graphGroups) enrich(raw string, claims jwt.MapClaims) error {
+	if !azureGroupsOverage(claims) {
+		return nil
+	}
+	tid, _ := claims["tid"].(string)
+	oid, _ := claims["oid"].(string)
+	if tid == "" || oid == "" {
+		return fmt.Errorf("token has no tid or oid to look up groups with")
+	}
+
+	key := tid + "/" + oid
+	groups, ok := g.groups.get(key)
+	if !ok {
+		var err error
+		if groups, err = g.lookup(tid, oid); err != nil {
+			return fmt.Errorf("Graph group lookup of %s failed: %w", key, err)
+		}
+		g.groups.set(key, groups, g.CacheTTL)
+	}
+	mergeClaimValues(claims, "groups", groups)
+	delete(claims, "groups_overage")
+	return nil
+}
+
+func (g *graphGroups) lookup(tid, oid string) ([]string, error) {
+	token, err := g.appToken(tid)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	next := fmt.Sprintf(graphTransitiveGroups, url.PathEscape(oid))
+	for next != "" {
+		req, err := http.NewRequest(http.MethodGet, next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		var page struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := g.doJSON(req, &page); err != nil {
+			return nil, err
+		}
+		for _, group := range page.Value {
+			groups = append(groups, group.ID)
+		}
+		next = page.NextLink
+		// The app token must not be sent anywhere but Graph
+		if u, err := url.Parse(next); next != "" && (err != nil || u.Scheme != "https" || u.Host != "graph.microsoft.com") {
+			return nil, fmt.Errorf("refusing to follow next link outside https://graph.microsoft.com/: %q", next)
+		}
+	}
+	return groups, nil
+}
+
+// appToken returns a client credentials token for Graph in tenant tid.
+func (g *graphGroups) appToken(tid string) (string, error) {
+	if token, ok := g.appTokens.get(tid); ok {
+		return token, nil
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {g.ClientID},
+		"client_secret": {g.ClientSecret},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	}
+	endpoint := "https://login.microsoftonline.com/" + url.PathEscape(tid) + "/oauth2/v2.0/token"
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := g.doJSON(req, &resp); err != nil {
+		return "", err
+	}
+	// Renew a minute early so a cached token never expires mid-request
+	g.appTokens.set(tid, resp.AccessToken, time.Duration(resp.ExpiresIn-60)*time.Second)
+	return resp.AccessToken, nil
+}
+
+func (g *graphGroups) doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := g.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s returned status %d", req.Method, req.URL.Host, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
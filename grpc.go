@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// extAuthz implements Envoy's gRPC external authorization service. The
+// validation parameters are read from the params context extension of the
+// route, or else from the ParamsHeader gRPC metadata the filter sends. The
+// headers of the checked request are the client's, so they are never read
+// from there.
+type extAuthz struct {
+	authv3.UnimplementedAuthorizationServer
+	server *server
+}
+
+// newGRPCServer returns a gRPC server offering ext_authz and the standard
+// health checking protocol. Both services report SERVING, since the server
+// only starts once keys have been loaded.
+func newGRPCServer(s *server) (*grpc.Server, *health.Server) {
+	g := grpc.NewServer()
+	authv3.RegisterAuthorizationServer(g, &extAuthz{server: s})
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(authv3.Authorization_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(g, healthServer)
+	return g, healthServer
+}
+
+func (a *extAuthz) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	s := a.server
+	attrs := req.GetAttributes().GetRequest().GetHttp()
+	r := &http.Request{
+		Method: attrs.GetMethod(),
+		Host:   attrs.GetHost(),
+		Header: make(http.Header),
+		URL:    &url.URL{Scheme: attrs.GetScheme(), Host: attrs.GetHost(), Path: attrs.GetPath()},
+	}
+	for name, value := range attrs.GetHeaders() {
+		r.Header.Set(name, value)
+	}
+	// The downstream client as Envoy saw it, for the RateLimit
+	if source := req.GetAttributes().GetSource().GetAddress().GetSocketAddress(); source != nil {
+		r.RemoteAddr = net.JoinHostPort(source.GetAddress(), strconv.Itoa(int(source.GetPortValue())))
+	}
+
+	params, policy := s.defaults()
+	if raw := grpcParams(ctx, req, s.ParamsHeader); raw != "" {
+		params, policy = s.parseParams(raw)
+	}
+
+	token, claims, err := s.validateDeviceToken(r, params, policy)
+	if err == nil {
+		err = s.authorize(claims, originalRequest{
+			Method: attrs.GetMethod(),
+			Scheme: attrs.GetScheme(),
+			Host:   attrs.GetHost(),
+			URI:    attrs.GetPath(),
+		})
+	}
+	if err != nil {
+		d := denialOf(err)
+		s.logDenial(err, d, token)
+		requestsTotal.WithLabelValues(strconv.Itoa(d.status)).Inc()
+		code := codes.Unauthenticated
+		if d.status != http.StatusUnauthorized {
+			code = codes.PermissionDenied
+		}
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(code)},
+			HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+				Status: &typev3.HttpStatus{Code: typev3.StatusCode(d.status)},
+				Body:   http.StatusText(d.status),
+			}},
+		}, nil
+	}
+
+	requestsTotal.WithLabelValues("200").Inc()
+	var headers []*corev3.HeaderValueOption
+	values := s.responseHeaderValues(params, claims)
+	s.forwardToken(values, params, token)
+	for header, value := range values {
+		headers = append(headers, &corev3.HeaderValueOption{
+			Header:       &corev3.HeaderValue{Key: header, Value: value},
+			AppendAction: corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD,
+		})
+	}
+	return &authv3.CheckResponse{
+		Status:       &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{Headers: headers}},
+	}, nil
+}
+
+// grpcParams returns the params Envoy configures for req: the params context
+// extension set per route with check_settings, or else the metadata named
+// header, set for the filter with initial_metadata.
+func grpcParams(ctx context.Context, req *authv3.CheckRequest, header string) string {
+	if raw := req.GetAttributes().GetContextExtensions()["params"]; raw != "" {
+		return raw
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(header); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
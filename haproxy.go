@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+	"github.com/robbilie/nginx-jwt-auth/spoe"
+)
+
+// handleSPOE validates the token argument of every SPOE message and reports
+// the outcome as transaction variables HAProxy can use in ACLs. Response
+// headers are exposed as header_<name> variables.
+func (s *server) handleSPOE(messages []spoe.Message) []spoe.Action {
+	var actions []spoe.Action
+	for _, msg := range messages {
+		token, _ := msg.Args["token"].(string)
+		token = strings.TrimSpace(token)
+		if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+			token = strings.TrimSpace(token[7:])
+		}
+
+		params, policy := s.defaults()
+		if raw, ok := msg.Args["params"].(string); ok && raw != "" {
+			params, policy = s.parseParams(raw)
+		}
+
+		status := 200
+		var headers map[string]string
+		claims, err := s.validateSPOEToken(token, policy, msg)
+		if err == nil {
+			headers = s.responseHeaderValues(params, claims)
+		} else {
+			d := denialOf(err)
+			s.logDenial(err, d, token)
+			status = d.status
+			actions = append(actions, spoe.Action{Scope: spoe.ScopeTransaction, Name: "reason", Value: d.code})
+		}
+		requestsTotal.WithLabelValues(strconv.Itoa(status)).Inc()
+
+		actions = append(actions,
+			spoe.Action{Scope: spoe.ScopeTransaction, Name: "valid", Value: status == 200},
+			spoe.Action{Scope: spoe.ScopeTransaction, Name: "status", Value: status},
+		)
+		for header, value := range headers {
+			name := "header_" + strings.ToLower(strings.ReplaceAll(header, "-", "_"))
+			actions = append(actions, spoe.Action{Scope: spoe.ScopeTransaction, Name: name, Value: value})
+		}
+	}
+	return actions
+}
+
+func (s *server) validateSPOEToken(token string, policy *policy.Policy, msg spoe.Message) (jwt.MapClaims, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w in SPOE message %s", ErrNoToken, msg.Name)
+	}
+	claims, err := s.validateToken(context.Background(), token, policy)
+	if err != nil {
+		return nil, err
+	}
+	return claims, s.authorize(claims, spoeRequest(msg))
+}
+
+// spoeRequest describes the original request from the optional method,
+// scheme, host and path arguments of msg.
+func spoeRequest(msg spoe.Message) originalRequest {
+	var req originalRequest
+	req.Method, _ = msg.Args["method"].(string)
+	req.Scheme, _ = msg.Args["scheme"].(string)
+	req.Host, _ = msg.Args["host"].(string)
+	req.URI, _ = msg.Args["path"].(string)
+	return req
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+)
+
+// headerTemplates compose response headers of several claims, e.g.
+// X-User: '{{.preferred_username}}@{{.tenant}}', by header name.
+type headerTemplates map[string]*template.Template
+
+// headerTemplateFuncs are available to header templates besides the
+// builtins: join joins a list claim with a separator, json encodes a claim.
+var headerTemplateFuncs = template.FuncMap{
+	"join": func(sep string, claim interface{}) string {
+		list, ok := claim.([]interface{})
+		if !ok {
+			return fmt.Sprint(claim)
+		}
+		values := make([]string, len(list))
+		for i, value := range list {
+			values[i] = fmt.Sprint(value)
+		}
+		return strings.Join(values, sep)
+	},
+	"json": func(claim interface{}) (string, error) {
+		b, err := json.Marshal(claim)
+		return string(b), err
+	},
+}
+
+// parseHeaderTemplates parses the templates of the config file. Templates
+// referring to claims a token doesn't have fail, rather than render
+// "<no value>".
+func parseHeaderTemplates(templates map[string]string) (headerTemplates, error) {
+	parsed := make(headerTemplates, len(templates))
+	for header, text := range templates {
+		tmpl, err := template.New(header).Funcs(headerTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("header template %s: %w", header, err)
+		}
+		parsed[header] = tmpl
+	}
+	return parsed, nil
+}
+
+// render sets the headers of the templates in values, encoded with
+// encoding. Headers whose template fails, like for a missing claim, are
+// left out.
+func (t headerTemplates) render(values map[string]string, claims jwt.MapClaims, encoding string) {
+	var value strings.Builder
+	for header, tmpl := range t {
+		value.Reset()
+		if err := tmpl.Execute(&value, map[string]interface{}(claims)); err != nil {
+			delete(values, header)
+			continue
+		}
+		values[header] = policy.EncodeHeaderValue(value.String(), encoding)
+	}
+}
+
+// renderHeaderTemplates sets the headers of the templates of the config
+// file and of the policy params name in values.
+func (s *server) renderHeaderTemplates(values map[string]string, params url.Values, claims jwt.MapClaims) {
+	set := s.policies.Load()
+	if set == nil {
+		return
+	}
+	set.templates.render(values, claims, s.HeaderFormat.Encoding)
+	if named, ok := set.named[params.Get("policy")]; ok {
+		named.templates.render(values, claims, s.HeaderFormat.Encoding)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// evaluate decides on token like /validate does, without the caches, opaque
+// tokens by introspection. key is the key the signature was checked with, if
+// it got that far.
+func (s *server) evaluate(token string, p *policy.Policy, req originalRequest) (claims jwt.MapClaims, key interface{}, err error) {
+	v := s.Validator
+	v.Keyfunc = func(t *jwt.Token) (interface{}, error) {
+		found, err := s.Keyfunc(t)
+		key = found
+		return found, err
+	}
+	claims, err = s.verifyWith(&v, token)
+	if errors.Is(err, validator.ErrIncomplete) {
+		err = nil
+	}
+	if err == nil {
+		err = s.checkRevoked(claims)
+	}
+	if err == nil && !p.Empty() && !p.Allows(claims) {
+		err = fmt.Errorf("%w: %w", validator.ErrPolicy, p.Check(claims))
+	}
+	if err == nil {
+		err = s.authorize(claims, req)
+	}
+	return claims, key, err
+}
+
+// introspection is the answer of /admin/introspect.
+type introspection struct {
+	Decision string                 `json:"decision"`
+	Reason   string                 `json:"reason,omitempty"`
+	Error    string                 `json:"error,omitempty"`
+	Header   map[string]interface{} `json:"header,omitempty"`
+	// Claims are the verified and normalized claims if the token is
+	// valid, and what it claims otherwise.
+	Claims  jwt.MapClaims     `json:"claims,omitempty"`
+	Key     map[string]string `json:"key,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// adminIntrospect explains the decision on a token, given as JSON along
+// with the params and original request to evaluate it for:
+//
+//	{"token": "...", "params": "claims_groups=admin", "request": {"method": "GET", "uri": "/"}}
+//
+// The params default to DEFAULT_PARAMS.
+func (s *server) adminIntrospect(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Token   string          `json:"token"`
+		Params  *string         `json:"params"`
+		Request originalRequest `json:"request"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("invalid body: %s", err), http.StatusBadRequest)
+		return
+	}
+	body.Token = strings.TrimSpace(strings.TrimPrefix(body.Token, "Bearer "))
+	if body.Token == "" {
+		http.Error(w, "no token", http.StatusBadRequest)
+		return
+	}
+	values, p := s.defaults()
+	if body.Params != nil {
+		var err error
+		if values, err = url.ParseQuery(*body.Params); err != nil {
+			http.Error(w, fmt.Sprintf("invalid params: %s", err), http.StatusBadRequest)
+			return
+		}
+		if values, p, err = s.resolveParams(values); err != nil {
+			http.Error(w, fmt.Sprintf("invalid params: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.Request.Method == "" {
+		body.Request.Method = http.MethodGet
+	}
+
+	claims, key, err := s.evaluate(body.Token, p, body.Request)
+	result := introspection{Decision: "allow", Claims: claims, Key: describeKey(key)}
+	if err != nil {
+		d := denialOf(err)
+		result.Decision, result.Reason, result.Error = "deny", d.code, err.Error()
+		// Still show what the token claims, as far as it can be decoded
+		result.Claims = jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(body.Token, result.Claims); err != nil {
+			result.Claims = nil
+		}
+	} else {
+		result.Headers = s.responseHeaderValues(values, claims)
+	}
+	if unverified, _, err := jwt.NewParser().ParseUnverified(body.Token, jwt.MapClaims{}); err == nil {
+		result.Header = unverified.Header
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// describeKey identifies a verification key without revealing secrets. The
+// thumbprint is the RFC 7638 one, as some IdPs use it as kid.
+func describeKey(key interface{}) map[string]string {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return map[string]string{"type": "EC", "curve": key.Curve.Params().Name, "thumbprint": jwkThumbprint(ecJWK(key))}
+	case *rsa.PublicKey:
+		encode := base64.RawURLEncoding.EncodeToString
+		e := encode(big.NewInt(int64(key.E)).Bytes())
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, e, encode(key.N.Bytes()))))
+		return map[string]string{"type": "RSA", "bits": fmt.Sprint(key.N.BitLen()), "thumbprint": base64.RawURLEncoding.EncodeToString(sum[:])}
+	case ed25519.PublicKey:
+		sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":"Ed25519","kty":"OKP","x":%q}`, base64.RawURLEncoding.EncodeToString(key))))
+		return map[string]string{"type": "OKP", "curve": "Ed25519", "thumbprint": base64.RawURLEncoding.EncodeToString(sum[:])}
+	case []byte:
+		return map[string]string{"type": "HMAC"}
+	case nil:
+		return nil
+	default:
+		return map[string]string{"type": fmt.Sprintf("%T", key)}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var errUnknownIssuer = errors.New("unknown issuer")
+
+// issuerConfig is an issuer of the file at CONFIG_PATH. Without jwks_url,
+// the key set is found by OIDC discovery of the issuer.
+type issuerConfig struct {
+	Issuer     string   `yaml:"issuer"`
+	JWKSURL    string   `yaml:"jwks_url"`
+	Algorithms []string `yaml:"algorithms"`
+}
+
+// issuerKey is the key set of an issuer and the algorithms it may use.
+type issuerKey struct {
+	keyfunc jwt.Keyfunc
+	// algs is empty if any algorithm is accepted
+	algs []string
+}
+
+// issuerKeys selects the key set to verify a token with by its iss claim,
+// so tokens of one issuer are never verified with the keys of another.
+// Tokens of any other issuer are left to fallback, if set.
+type issuerKeys struct {
+	issuers  map[string]issuerKey
+	fallback jwt.Keyfunc
+}
+
+// loadIssuers loads the key sets of issuers, which are refreshed in the
+// background from then on like the one at JWKS_URL.
+func loadIssuers(opts keySourceOptions, outbound *outboundPolicy, issuers []issuerConfig, fallback jwt.Keyfunc) (*issuerKeys, error) {
+	keys := &issuerKeys{issuers: make(map[string]issuerKey, len(issuers)), fallback: fallback}
+	for _, issuer := range issuers {
+		if issuer.Issuer == "" {
+			return nil, errors.New("issuer without an issuer URL")
+		}
+		if _, ok := keys.issuers[issuer.Issuer]; ok {
+			return nil, fmt.Errorf("issuer %q is configured twice", issuer.Issuer)
+		}
+		for _, alg := range issuer.Algorithms {
+			if jwt.GetSigningMethod(alg) == nil {
+				return nil, fmt.Errorf("issuer %q: unknown algorithm %q", issuer.Issuer, alg)
+			}
+		}
+		keysURL := issuer.JWKSURL
+		if keysURL == "" {
+			provider, err := discoverOIDC(opts.client, outbound, issuer.Issuer)
+			if err != nil {
+				return nil, fmt.Errorf("issuer %q: %w", issuer.Issuer, err)
+			}
+			keysURL = provider.JWKSURI
+		}
+		if err := outbound.checkURL(keysURL); err != nil {
+			return nil, fmt.Errorf("issuer %q: %w", issuer.Issuer, err)
+		}
+		kf, err := loadKeySource(opts, keysURL)
+		if err != nil {
+			return nil, fmt.Errorf("issuer %q: %w", issuer.Issuer, err)
+		}
+		keys.issuers[issuer.Issuer] = issuerKey{keyfunc: kf, algs: issuer.Algorithms}
+	}
+	return keys, nil
+}
+
+func (k *issuerKeys) Keyfunc(token *jwt.Token) (interface{}, error) {
+	iss, _ := token.Claims.GetIssuer()
+	issuer, ok := k.issuers[iss]
+	if !ok {
+		if k.fallback != nil {
+			return k.fallback(token)
+		}
+		return nil, fmt.Errorf("%w %q", errUnknownIssuer, iss)
+	}
+	if alg := token.Method.Alg(); len(issuer.algs) > 0 && !slices.Contains(issuer.algs, alg) {
+		return nil, fmt.Errorf("algorithm %s is not allowed for issuer %q", alg, iss)
+	}
+	return issuer.keyfunc(token)
+}
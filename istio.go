@@ -0,0 +1,386 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/url"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/robbilie/nginx-jwt-auth/policy"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest types, limited to the fields generated here
+type (
+	k8sObject struct {
+		APIVersion string      `yaml:"apiVersion"`
+		Kind       string      `yaml:"kind"`
+		Metadata   k8sMetadata `yaml:"metadata"`
+		Spec       interface{} `yaml:"spec"`
+	}
+	k8sMetadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace,omitempty"`
+	}
+	istioSelector struct {
+		MatchLabels map[string]string `yaml:"matchLabels"`
+	}
+	istioRequestAuthentication struct {
+		Selector *istioSelector `yaml:"selector,omitempty"`
+		JWTRules []istioJWTRule `yaml:"jwtRules"`
+	}
+	istioJWTRule struct {
+		Issuer               string               `yaml:"issuer"`
+		Audiences            []string             `yaml:"audiences,omitempty"`
+		JWKSURI              string               `yaml:"jwksUri,omitempty"`
+		JWKS                 string               `yaml:"jwks,omitempty"`
+		FromHeaders          []istioHeader        `yaml:"fromHeaders,omitempty"`
+		FromCookies          []string             `yaml:"fromCookies,omitempty"`
+		FromParams           []string             `yaml:"fromParams,omitempty"`
+		OutputClaimToHeaders []istioClaimToHeader `yaml:"outputClaimToHeaders,omitempty"`
+	}
+	istioHeader struct {
+		Name   string `yaml:"name"`
+		Prefix string `yaml:"prefix,omitempty"`
+	}
+	istioClaimToHeader struct {
+		Header string `yaml:"header"`
+		Claim  string `yaml:"claim"`
+	}
+	istioAuthorizationPolicy struct {
+		Selector *istioSelector `yaml:"selector,omitempty"`
+		Action   string         `yaml:"action"`
+		Rules    []istioRule    `yaml:"rules"`
+	}
+	istioRule struct {
+		From []istioFrom      `yaml:"from"`
+		When []istioCondition `yaml:"when,omitempty"`
+	}
+	istioFrom struct {
+		Source istioSource `yaml:"source"`
+	}
+	istioSource struct {
+		RequestPrincipals []string `yaml:"requestPrincipals"`
+	}
+	istioCondition struct {
+		Key       string   `yaml:"key"`
+		Values    []string `yaml:"values,omitempty"`
+		NotValues []string `yaml:"notValues,omitempty"`
+	}
+)
+
+// runIstio implements the istio subcommand. It translates the key source,
+// validation parameters and response headers configured through the
+// environment into a RequestAuthentication and an AuthorizationPolicy.
+func runIstio(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("istio", flag.ContinueOnError)
+	name := flags.String("name", "jwt-auth", "name of the generated resources")
+	namespace := flags.String("namespace", "", "namespace of the generated resources")
+	selector := flags.String("selector", "", "comma separated label=value pairs selecting the workloads")
+	issuer := flags.String("issuer", getenv("OIDC_ISSUER", ""), "issuer of the tokens")
+	jwksURI := flags.String("jwks-uri", getenv("JWKS_URL", ""), "URL of the JWKS")
+	audiences := flags.String("audiences", "", "comma separated accepted audiences")
+	params := flags.String("params", getenv("DEFAULT_PARAMS", ""), "validation parameters in query string form")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *issuer == "" {
+		return errors.New("istio requires an issuer, set -issuer or OIDC_ISSUER")
+	}
+	values, err := url.ParseQuery(*params)
+	if err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	// A policy param gets the params of the policy in CONFIG_PATH, as
+	// /validate does
+	set, err := newPolicySet(getenv("CONFIG_PATH", ""), "")
+	if err != nil {
+		return err
+	}
+	if values, _, err = set.resolve(values); err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	if named := set.named[values.Get("policy")]; len(set.templates) > 0 || named != nil && len(named.templates) > 0 {
+		return errors.New("Istio can't render the header templates of CONFIG_PATH")
+	}
+
+	rule := istioJWTRule{Issuer: *issuer, Audiences: splitList(*audiences), JWKSURI: *jwksURI}
+	if jwksPath := getenv("JWKS_PATH", ""); jwksPath != "" && rule.JWKSURI == "" {
+		if rule.JWKS, err = staticJWKS(jwksPath, getenv("JWKS_PATH_FORMAT", keyFormatPEM)); err != nil {
+			return err
+		}
+	}
+	// Without either, Istio discovers the JWKS from the issuer
+	sources, err := parseTokenSources(getenv("TOKEN_SOURCES", ""))
+	if err != nil {
+		return err
+	}
+	tokens := &server{
+		TokenHeader:  getenv("TOKEN_HEADER", ""),
+		TokenPrefix:  getenv("TOKEN_HEADER_PREFIX", ""),
+		TokenQuery:   getenv("TOKEN_QUERY_PARAM", ""),
+		TokenSources: sources,
+	}
+	sources = tokens.tokenSources(values)
+	// Istio's default is the Authorization header, or the access_token
+	// param, so that is left out
+	if len(sources) != 1 || sources[0] != (tokenSource{kind: tokenSourceHeader, name: "Authorization"}) {
+		for _, src := range sources {
+			switch {
+			case src.kind == tokenSourceCookie:
+				rule.FromCookies = append(rule.FromCookies, src.name)
+			case src.kind == tokenSourceQuery:
+				rule.FromParams = append(rule.FromParams, src.name)
+			case src.prefix == "" && strings.EqualFold(src.name, "Authorization"):
+				rule.FromHeaders = append(rule.FromHeaders, istioHeader{Name: src.name, Prefix: "Bearer "})
+			default:
+				rule.FromHeaders = append(rule.FromHeaders, istioHeader{Name: src.name, Prefix: src.prefix})
+			}
+		}
+	}
+
+	headers, err := parseHeaderMapping(getenv("RESPONSE_HEADERS", ""))
+	if err != nil {
+		return err
+	}
+	if encoding := getenv("HEADER_ENCODING", policy.EncodingNone); encoding != policy.EncodingNone {
+		return fmt.Errorf("Istio can't encode header values, HEADER_ENCODING=%s", encoding)
+	}
+	for key, value := range values {
+		header, encoding, ok := policy.HeaderParam(key)
+		if ok && encoding != policy.EncodingNone {
+			return fmt.Errorf("Istio can't encode header values, %s", key)
+		}
+		if ok {
+			headers[header] = value[0]
+		}
+	}
+	for _, header := range sortedKeys(headers) {
+		rule.OutputClaimToHeaders = append(rule.OutputClaimToHeaders, istioClaimToHeader{Header: header, Claim: headers[header]})
+	}
+
+	var conditions []istioCondition
+	var unsupported, unknown []string
+	patternValues := func(key string) []string {
+		var converted []string
+		for _, pattern := range values[key] {
+			value, ok := istioValue(pattern)
+			if !ok {
+				unsupported = append(unsupported, key+"="+pattern)
+				continue
+			}
+			converted = append(converted, value)
+		}
+		return converted
+	}
+	for _, key := range sortedKeys(values) {
+		claimName, ok := strings.CutPrefix(key, "claims_")
+		if key == "scopes" {
+			// Scopes are granted by scope, or else by scp, which can't be
+			// told apart in conditions
+			for _, scopes := range values[key] {
+				unsupported = append(unsupported, key+"="+scopes)
+			}
+			continue
+		}
+		if !ok {
+			// Headers and token sources are translated above, the policy
+			// is resolved
+			if _, _, header := policy.HeaderParam(key); !header && !slices.Contains(istioParams, key) {
+				unknown = append(unknown, key)
+			}
+			continue
+		}
+		if name, ok := strings.CutPrefix(claimName, "not_regexp_"); ok {
+			conditions = append(conditions, istioCondition{Key: istioClaimKey(name), NotValues: patternValues(key)})
+			continue
+		}
+		if name, ok := strings.CutPrefix(claimName, "not_"); ok {
+			conditions = append(conditions, istioCondition{Key: istioClaimKey(name), NotValues: values[key]})
+			continue
+		}
+		if name, ok := strings.CutPrefix(claimName, "all_"); ok {
+			// Conditions are ANDed, one per value requires them all
+			for _, value := range values[key] {
+				conditions = append(conditions, istioCondition{Key: istioClaimKey(name), Values: []string{value}})
+			}
+			continue
+		}
+		if name, ok := strings.CutPrefix(claimName, "regexp_"); ok {
+			conditions = append(conditions, istioCondition{Key: istioClaimKey(name), Values: patternValues(key)})
+			continue
+		}
+		if before, _, found := strings.Cut(claimName, "_"); found && slices.Contains([]string{"gt", "gte", "lt", "lte", "bool"}, before) {
+			// Istio only matches strings
+			unsupported = append(unsupported, key)
+			continue
+		}
+		conditions = append(conditions, istioCondition{Key: istioClaimKey(claimName), Values: values[key]})
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("params have no Istio equivalent: %s", strings.Join(unknown, ", "))
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("params can't be expressed as Istio exact, prefix, suffix or presence matches: %s", strings.Join(unsupported, ", "))
+	}
+
+	var sel *istioSelector
+	if *selector != "" {
+		labels, err := parseHeaderMapping(*selector)
+		if err != nil {
+			return fmt.Errorf("invalid selector: %w", err)
+		}
+		sel = &istioSelector{MatchLabels: labels}
+	}
+	meta := k8sMetadata{Name: *name, Namespace: *namespace}
+	manifests := []k8sObject{
+		{
+			APIVersion: "security.istio.io/v1",
+			Kind:       "RequestAuthentication",
+			Metadata:   meta,
+			Spec:       istioRequestAuthentication{Selector: sel, JWTRules: []istioJWTRule{rule}},
+		},
+		{
+			APIVersion: "security.istio.io/v1",
+			Kind:       "AuthorizationPolicy",
+			Metadata:   meta,
+			Spec: istioAuthorizationPolicy{
+				Selector: sel,
+				Action:   "ALLOW",
+				Rules: []istioRule{{
+					From: []istioFrom{{Source: istioSource{RequestPrincipals: []string{*issuer + "/*"}}}},
+					When: conditions,
+				}},
+			},
+		},
+	}
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	for _, manifest := range manifests {
+		if err := encoder.Encode(manifest); err != nil {
+			return err
+		}
+	}
+	return encoder.Close()
+}
+
+// istioParams are the params besides claims_* and headers_* that are
+// translated.
+var istioParams = []string{"policy", "cookie", "header", "header_prefix", "query"}
+
+// istioClaimKey is the condition key of a claim. Paths into nested claims
+// like realm_access.roles get a bracket per element, as Istio reads
+// request.auth.claims[realm_access.roles] as a claim of that name.
+func istioClaimKey(claim string) string {
+	return "request.auth.claims[" + strings.ReplaceAll(claim, ".", "][") + "]"
+}
+
+var regexpLiteral = regexp.MustCompile(`^[\w\-:/@ ]*$`)
+
+// istioValue converts the regular expressions that have an equivalent
+// Istio string match: anchored literals, prefixes, suffixes and presence.
+func istioValue(pattern string) (string, bool) {
+	if pattern == ".*" || pattern == ".+" || pattern == "^.*$" || pattern == "^.+$" {
+		return "*", true
+	}
+	anchoredStart := strings.HasPrefix(pattern, "^")
+	anchoredEnd := strings.HasSuffix(pattern, "$")
+	literal := strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	wildcardEnd := strings.HasSuffix(literal, ".*")
+	literal = strings.TrimSuffix(literal, ".*")
+	// Escaped dots are the only metacharacters allowed in the literal part
+	if literal == "" || !regexpLiteral.MatchString(strings.ReplaceAll(literal, `\.`, "")) {
+		return "", false
+	}
+	literal = strings.ReplaceAll(literal, `\.`, ".")
+	switch {
+	case anchoredStart && anchoredEnd && !wildcardEnd:
+		return literal, true
+	case anchoredStart:
+		return literal + "*", true
+	case anchoredEnd && !wildcardEnd:
+		return "*" + literal, true
+	default:
+		// Unanchored patterns match substrings
+		return "", false
+	}
+}
+
+// ecJWK is the JWK of an EC public key, without any optional members.
+func ecJWK(key *ecdsa.PublicKey) map[string]string {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	return map[string]string{
+		"kty": "EC",
+		"crv": key.Curve.Params().Name,
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, size))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, size))),
+	}
+}
+
+// publicJWK is the JWK of an EC, RSA or Ed25519 public key, without any
+// optional members.
+func publicJWK(key interface{}) (map[string]string, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecJWK(key), nil
+	case *rsa.PublicKey:
+		return map[string]string{"kty": "RSA", "n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes())}, nil
+	case ed25519.PublicKey:
+		return map[string]string{"kty": "OKP", "crv": "Ed25519", "x": encode(key)}, nil
+	default:
+		return nil, fmt.Errorf("Istio can't verify with a %s key", describeKey(key)["type"])
+	}
+}
+
+// staticJWKS converts the keys at path, loaded like JWKS_PATH, to an inline
+// JWKS. Keys get their kid, but for a single one, which the service uses
+// whatever the kid of a token, as does Istio for a key without one.
+func staticJWKS(path, format string) (string, error) {
+	if format == keyFormatHMAC {
+		return "", errors.New("Istio can't verify HMAC secrets, JWKS_PATH_FORMAT=hmac")
+	}
+	if format != keyFormatPEM {
+		return "", fmt.Errorf("unknown JWKS_PATH_FORMAT %q", format)
+	}
+	static := &staticKey{path: path, format: format}
+	if err := static.reload(); err != nil {
+		return "", err
+	}
+	keys := *static.keys.Load()
+	var jwks []map[string]string
+	for _, kid := range sortedKeys(keys) {
+		jwk, err := publicJWK(keys[kid])
+		if err != nil {
+			return "", err
+		}
+		if len(keys) > 1 {
+			jwk["kid"] = kid
+		}
+		jwks = append(jwks, jwk)
+	}
+	encoded, err := json.Marshal(map[string]interface{}{"keys": jwks})
+	return string(encoded), err
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
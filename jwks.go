@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwkKey is a public key of a JWKS with the parameters restricting its use.
+type jwkKey struct {
+	public interface{}
+	alg    string
+	use    string
+}
+
+// jwkKeys are the keys of a JWKS by key id. They are never modified once
+// parsed, a refresh parses a new set and swaps it in, so lookups need no
+// locking.
+type jwkKeys map[string]jwkKey
+
+// parseJWKS parses the keys of a JWKS. Keys of unsupported types are left
+// out.
+func parseJWKS(raw []byte) (jwkKeys, error) {
+	jwks, err := keyfunc.NewJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	var params struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return nil, err
+	}
+	public := jwks.ReadOnlyKeys()
+	keys := make(jwkKeys, len(public))
+	for _, key := range params.Keys {
+		if pub, ok := public[key.Kid]; ok {
+			keys[key.Kid] = jwkKey{public: pub, alg: key.Alg, use: key.Use}
+		}
+	}
+	return keys, nil
+}
+
+// Keyfunc looks up the key named by the token's kid. Keys meant for
+// anything but signatures, or for another algorithm, are refused.
+func (k jwkKeys) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no kid in token header", keyfunc.ErrKID)
+	}
+	key, ok := k[kid]
+	if !ok {
+		return nil, keyfunc.ErrKIDNotFound
+	}
+	if key.use != "" && key.use != string(keyfunc.UseSignature) {
+		return nil, fmt.Errorf("%w: JWK use %q", keyfunc.ErrJWKUseWhitelist, key.use)
+	}
+	if alg, _ := token.Header["alg"].(string); key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf("%w: JWK alg %q, token alg %q", keyfunc.ErrJWKAlgMismatch, key.alg, alg)
+	}
+	return key.public, nil
+}
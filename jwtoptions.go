@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// jwtOptions returns the golang-jwt parser options configured in the
+// environment, and checks for the requirements it has no option for.
+func jwtOptions() ([]jwt.ParserOption, []validator.Check, error) {
+	// iat was always checked with golang-jwt v4, keep it that way
+	options := []jwt.ParserOption{jwt.WithIssuedAt()}
+	var checks []validator.Check
+
+	if value := getenv("CLOCK_SKEW_LEEWAY", ""); value != "" {
+		leeway, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CLOCK_SKEW_LEEWAY: %w", err)
+		}
+		if leeway < 0 {
+			return nil, nil, fmt.Errorf("invalid CLOCK_SKEW_LEEWAY: %s is negative", value)
+		}
+		options = append(options, jwt.WithLeeway(leeway))
+	}
+	if audience := getenv("JWT_AUDIENCE", ""); audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	if issuer := getenv("JWT_ISSUER", ""); issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if issuers := splitList(getenv("ALLOWED_ISSUERS", "")); len(issuers) > 0 {
+		checks = append(checks, issuerCheck(issuers...))
+	}
+	if required := splitList(getenv("JWT_REQUIRED_CLAIMS", "")); len(required) > 0 {
+		if slices.Contains(required, "exp") {
+			options = append(options, jwt.WithExpirationRequired())
+		}
+		checks = append(checks, requiredClaimsCheck(required))
+	}
+	return options, checks, nil
+}
+
+// allowedAlgorithms returns the JWT_ALLOWED_ALGS, nil if any algorithm is
+// allowed.
+func allowedAlgorithms() ([]string, error) {
+	algs := splitList(getenv("JWT_ALLOWED_ALGS", ""))
+	for _, alg := range algs {
+		if jwt.GetSigningMethod(alg) == nil {
+			return nil, fmt.Errorf("unknown algorithm %q in JWT_ALLOWED_ALGS", alg)
+		}
+	}
+	return algs, nil
+}
+
+// requiredClaimsCheck requires the token to have all of the claims names.
+func requiredClaimsCheck(names []string) validator.Check {
+	return func(claims jwt.MapClaims) error {
+		for _, name := range names {
+			if _, ok := claims[name]; !ok {
+				return fmt.Errorf("required claim %q is missing", name)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/MicahParks/keyfunc/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+var (
+	staleKeySetValidations = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "nginx_subrequest_auth_jwt_stale_key_set_total",
+		Help: "Number of token validations that used a key set whose refreshes have been failing",
+	})
+	keySetRefreshTime = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nginx_subrequest_auth_jwt_key_set_last_refresh_timestamp_seconds",
+		Help: "Unix time the key set was last fetched successfully, by URL",
+	}, []string{"url"})
+	keySetRefreshErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nginx_subrequest_auth_jwt_key_set_refresh_errors_total",
+		Help: "Number of failed fetches of the key set, by URL",
+	}, []string{"url"})
+	keySetKeys = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "nginx_subrequest_auth_jwt_key_set_keys",
+		Help: "Number of usable keys in the key set, by URL",
+	}, []string{"url"})
+	keySetAges = &keySetAgeCollector{desc: prometheus.NewDesc(
+		"nginx_subrequest_auth_jwt_key_set_age_seconds",
+		"Seconds since the key set was last fetched successfully, by URL",
+		[]string{"url"}, nil,
+	)}
+)
+
+func init() {
+	prometheus.MustRegister(staleKeySetValidations, keySetRefreshTime, keySetRefreshErrors, keySetKeys, keySetAges)
+}
+
+// keySetAgeCollector reports the age of the key sets when scraped, so it
+// can be alerted on without knowing the refresh intervals.
+type keySetAgeCollector struct {
+	desc *prometheus.Desc
+	// sets maps URLs to the key sets loaded from them, the last one wins
+	sets sync.Map
+}
+
+func (c *keySetAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *keySetAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.sets.Range(func(url, set any) bool {
+		refreshed := set.(*keySet).refreshed.Load()
+		if refreshed != 0 {
+			age := time.Since(time.Unix(0, refreshed)).Seconds()
+			ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, age, url.(string))
+		}
+		return true
+	})
+}
+
+// keySet is a remote key set that is refreshed in the background. Refreshes
+// never hold up validations: they fetch with a timeout, parse the response
+// into a new set of keys and swap that in with a single atomic store.
+// Validations keep using the previous keys meanwhile, without taking any
+// lock, and are counted as stale once a refresh is overdue.
+type keySet struct {
+	url     string
+	keyfunc atomic.Pointer[jwt.Keyfunc]
+	// refreshed is the time of the last successful refresh in unix nanos,
+	// the keys are stale staleAfter nanoseconds later.
+	refreshed  atomic.Int64
+	staleAfter atomic.Int64
+	// raw is the last response, kept for the warm cache
+	raw atomic.Pointer[warmKeySet]
+}
+
+// refreshedAt records a successful refresh that fetched raw, with the given
+// number of usable keys, at the given time, the next one being due after
+// interval.
+func (k *keySet) refreshedAt(fetched time.Time, raw []byte, keys int, interval time.Duration) {
+	k.staleAfter.Store(int64(2 * interval))
+	k.refreshed.Store(fetched.UnixNano())
+	k.raw.Store(&warmKeySet{Raw: raw, Fetched: fetched, Interval: interval})
+	keySetRefreshTime.WithLabelValues(k.url).Set(float64(fetched.UnixNano()) / 1e9)
+	keySetKeys.WithLabelValues(k.url).Set(float64(keys))
+}
+
+func (k *keySet) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if time.Now().UnixNano()-k.refreshed.Load() > k.staleAfter.Load() {
+		staleKeySetValidations.Inc()
+	}
+	return (*k.keyfunc.Load())(token)
+}
+
+// keySourceOptions configure how remote key sets are loaded.
+type keySourceOptions struct {
+	client *http.Client
+	logger logger.Logger
+	format string
+	// refreshTimeout bounds each refresh of a key set
+	refreshTimeout time.Duration
+	// warm, if not nil, has the key sets of the previous run
+	warm *warmCache
+	// shared, if not nil, has the key sets other replicas fetched
+	shared *redisKeySets
+}
+
+// newKeySourceOptions returns the options for key sets in the given format,
+// refreshed with JWKS_REFRESH_TIMEOUT and shared as JWKS_CACHE says.
+func newKeySourceOptions(client *http.Client, logger logger.Logger, format string, warm *warmCache) (keySourceOptions, error) {
+	refreshTimeout, err := time.ParseDuration(getenv("JWKS_REFRESH_TIMEOUT", "30s"))
+	if err != nil {
+		return keySourceOptions{}, fmt.Errorf("invalid JWKS_REFRESH_TIMEOUT: %w", err)
+	}
+	opts := keySourceOptions{client: client, logger: logger, format: format, refreshTimeout: refreshTimeout, warm: warm}
+	switch backend := getenv("JWKS_CACHE", ""); backend {
+	case "":
+	case "redis":
+		redisClient, err := sharedRedisClient()
+		if err != nil {
+			return keySourceOptions{}, err
+		}
+		opts.shared = &redisKeySets{client: redisClient, logger: logger, timeout: time.Second}
+	default:
+		return keySourceOptions{}, fmt.Errorf("unknown JWKS_CACHE %q", backend)
+	}
+	return opts, nil
+}
+
+// sharedRedisClient is the client all key sets are shared through.
+var sharedRedisClient = sync.OnceValues(newRedisClient)
+
+// loadKeySource loads the key set at url in the given format. It is
+// refreshed in the background from then on. A key set the warm cache has
+// kept from the previous run is used without fetching it until its refresh
+// is due.
+func loadKeySource(opts keySourceOptions, url string) (jwt.Keyfunc, error) {
+	set := &keySet{url: url}
+	keySetAges.sets.Store(url, set)
+	keySetRefreshErrors.WithLabelValues(url)
+	if restored, ok := opts.warm.keySet(url); ok && set.restore(opts, url, restored) {
+		return set.Keyfunc, nil
+	}
+	shared, sharedOK := opts.shared.get(url)
+	if sharedOK && time.Since(shared.Fetched) < shared.Interval && set.restore(opts, url, shared) {
+		return set.Keyfunc, nil
+	}
+	if err := set.fetch(opts, url); err != nil {
+		// Should the IdP be down, the last key set any replica fetched has
+		// to do until it is back
+		if sharedOK && set.restore(opts, url, shared) {
+			opts.logger.Warnw("Failed to fetch key set, using the one shared in Redis", "url", url, "fetched", shared.Fetched, "err", err)
+			return set.Keyfunc, nil
+		}
+		return nil, err
+	}
+	opts.warm.addKeySet(url, set)
+	return set.Keyfunc, nil
+}
+
+// restore uses a key set response fetched before, by the previous run or
+// another replica, until its refresh is due. It reports whether the
+// response could be parsed.
+func (k *keySet) restore(opts keySourceOptions, url string, restored warmKeySet) bool {
+	kf, keys, err := parseKeySet(opts.format, restored.Raw)
+	if err != nil {
+		opts.logger.Warnw("Ignoring key set fetched before", "url", url, "err", err)
+		return false
+	}
+	k.keyfunc.Store(&kf)
+	k.refreshedAt(restored.Fetched, restored.Raw, keys, restored.Interval)
+	opts.warm.addKeySet(url, k)
+	go func() {
+		time.Sleep(time.Until(restored.Fetched.Add(restored.Interval)))
+		for k.fetch(opts, url) != nil {
+			time.Sleep(time.Minute)
+		}
+	}()
+	return true
+}
+
+// fetch loads the key set at url and starts refreshing it.
+func (k *keySet) fetch(opts keySourceOptions, url string) error {
+	var kf jwt.Keyfunc
+	if opts.format == keysFormatX509 {
+		certs, err := newCertMap(opts.client, opts.logger, url, opts.refreshTimeout, func(raw []byte, keys int, maxAge time.Duration) {
+			k.refreshedAt(time.Now(), raw, keys, maxAge)
+			opts.shared.set(url, *k.raw.Load())
+		})
+		if err != nil {
+			keySetRefreshErrors.WithLabelValues(url).Inc()
+			return fmt.Errorf("failed to load certificates from resource at the given URL.\nError: %s", err.Error())
+		}
+		kf = certs.Keyfunc
+	} else {
+		// keyfunc only does the refreshing, the keys are parsed and looked
+		// up by jwkKeys, which need no lock
+		const refreshInterval = time.Hour
+		_, err := keyfunc.Get(url, keyfunc.Options{
+			Client:          opts.client,
+			RefreshInterval: refreshInterval,
+			RefreshTimeout:  opts.refreshTimeout,
+			RefreshErrorHandler: func(err error) {
+				keySetRefreshErrors.WithLabelValues(url).Inc()
+				opts.logger.Errorw("Failed to refresh JWKS", "url", url, "err", err)
+			},
+			ResponseExtractor: func(ctx context.Context, resp *http.Response) (json.RawMessage, error) {
+				raw, err := keyfunc.ResponseExtractorStatusOK(ctx, resp)
+				if err != nil {
+					return nil, err
+				}
+				keys, err := parseJWKS(raw)
+				if err != nil {
+					return nil, err
+				}
+				kf := jwt.Keyfunc(keys.Keyfunc)
+				k.keyfunc.Store(&kf)
+				k.refreshedAt(time.Now(), raw, len(keys), refreshInterval)
+				opts.shared.set(url, *k.raw.Load())
+				return raw, nil
+			},
+		})
+		if err != nil {
+			keySetRefreshErrors.WithLabelValues(url).Inc()
+			return fmt.Errorf("failed to create JWKS from resource at the given URL.\nError: %s", err.Error())
+		}
+		return nil
+	}
+	k.keyfunc.Store(&kf)
+	return nil
+}
+
+// parseKeySet parses a key set response in the given format, without
+// refreshing it. It returns the number of usable keys too.
+func parseKeySet(format string, raw []byte) (jwt.Keyfunc, int, error) {
+	if format == keysFormatX509 {
+		keys, err := parseCerts(raw)
+		if err != nil {
+			return nil, 0, err
+		}
+		return func(token *jwt.Token) (interface{}, error) {
+			return keyByID(keys, token)
+		}, len(keys), nil
+	}
+	keys, err := parseJWKS(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+	return keys.Keyfunc, len(keys), nil
+}
+
+// keySources combines the key sets of several issuers. A token's key is
+// looked up in each set that has been loaded so far.
+type keySources struct {
+	// mu only serializes adding sets, lookups load keyfuncs atomically
+	mu       sync.Mutex
+	keyfuncs atomic.Pointer[[]jwt.Keyfunc]
+}
+
+func (k *keySources) add(kf jwt.Keyfunc) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	var keyfuncs []jwt.Keyfunc
+	if current := k.keyfuncs.Load(); current != nil {
+		keyfuncs = append(keyfuncs, *current...)
+	}
+	keyfuncs = append(keyfuncs, kf)
+	k.keyfuncs.Store(&keyfuncs)
+}
+
+func (k *keySources) Keyfunc(token *jwt.Token) (interface{}, error) {
+	keyfuncs := k.keyfuncs.Load()
+	if keyfuncs == nil {
+		return nil, errors.New("no key set loaded")
+	}
+	var err error
+	for _, kf := range *keyfuncs {
+		var key interface{}
+		if key, err = kf(token); err == nil {
+			return key, nil
+		}
+	}
+	return nil, err
+}
+
+// loadKeySources fetches the key sets at urls concurrently. It returns once
+// every set has loaded or failed, or once timeout passed and at least one
+// set has loaded, so a slow or failing issuer doesn't hold up the others.
+// Sets that aren't loaded by then keep being retried in the background and
+// are used as soon as they load. It fails if no set could be loaded at all.
+func loadKeySources(opts keySourceOptions, urls []string, timeout time.Duration) (*keySources, error) {
+	logger := opts.logger
+	sources := &keySources{}
+	type loadResult struct {
+		url string
+		err error
+	}
+	results := make(chan loadResult, len(urls))
+	for _, url := range urls {
+		go func() {
+			reported := false
+			for delay := time.Second; ; delay = min(2*delay, 5*time.Minute) {
+				kf, err := loadKeySource(opts, url)
+				if err == nil {
+					sources.add(kf)
+					if reported {
+						logger.Infow("Loaded key set", "url", url)
+					} else {
+						results <- loadResult{url: url}
+					}
+					return
+				}
+				if reported {
+					logger.Warnw("Failed to load key set, retrying", "url", url, "err", err, "delay", delay)
+				} else {
+					results <- loadResult{url: url, err: err}
+					reported = true
+				}
+				time.Sleep(delay)
+			}
+		}()
+	}
+
+	deadline := time.After(timeout)
+	var loaded, failed int
+	var firstErr error
+	for loaded+failed < len(urls) {
+		select {
+		case result := <-results:
+			if result.err == nil {
+				loaded++
+				continue
+			}
+			failed++
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			logger.Errorw("Failed to load key set, retrying in the background", "url", result.url, "err", result.err)
+		case <-deadline:
+			if loaded > 0 {
+				logger.Warnw("Key sets still loading, starting without them", "pending", len(urls)-loaded-failed)
+				return sources, nil
+			}
+			// Nothing to validate with yet, keep waiting for the first one
+			deadline = nil
+		}
+	}
+	if loaded == 0 {
+		return nil, firstErr
+	}
+	return sources, nil
+}
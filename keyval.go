@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+// keyvalSync mirrors the revocation list into an NGINX Plus keyval zone
+// through the NGINX Plus API, e.g.
+// http://nginx:8080/api/9/http/keyvals/revoked. Keys are the revoked jti or
+// sub values prefixed with their claim, e.g. jti:<id>, values the claim, so
+// nginx can deny known-bad tokens without a subrequest.
+type keyvalSync struct {
+	url    string
+	client *http.Client
+	logger logger.Logger
+}
+
+// sync brings the zone in line with entries. The zone is read first, so
+// keys that were removed from the list are removed from the zone too.
+func (k *keyvalSync) sync(entries map[string]string) error {
+	current := map[string]string{}
+	if err := k.do(http.MethodGet, nil, &current); err != nil {
+		return err
+	}
+
+	added := map[string]interface{}{}
+	changed := map[string]interface{}{}
+	for key, value := range entries {
+		if existing, ok := current[key]; !ok {
+			added[key] = value
+		} else if existing != value {
+			changed[key] = value
+		}
+	}
+	for key := range current {
+		if _, ok := entries[key]; !ok {
+			// null deletes the key
+			changed[key] = nil
+		}
+	}
+
+	// POST only accepts a single new key per request
+	for key, value := range added {
+		if err := k.do(http.MethodPost, map[string]interface{}{key: value}, nil); err != nil {
+			return err
+		}
+	}
+	if len(changed) > 0 {
+		if err := k.do(http.MethodPatch, changed, nil); err != nil {
+			return err
+		}
+	}
+	k.logger.Debugw("Synchronized revocations to keyval zone", "url", k.url, "added", len(added), "changed", len(changed))
+	return nil
+}
+
+// loop resyncs every interval, restoring the zone after nginx restarts.
+func (k *keyvalSync) loop(r *revocations, interval time.Duration) {
+	for {
+		if err := k.sync(r.snapshot()); err != nil {
+			k.logger.Errorw("Failed to synchronize revocations to keyval zone", "url", k.url, "err", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (k *keyvalSync) do(method string, body interface{}, result interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, k.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: status %d", method, k.url, resp.StatusCode)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
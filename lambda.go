@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// inLambda reports whether the service runs as an AWS Lambda function.
+func inLambda() bool {
+	return os.Getenv("AWS_LAMBDA_RUNTIME_API") != ""
+}
+
+// loadEnvFile sets the KEY=VALUE lines of path as environment variables,
+// unless they are set already. Lambda@Edge functions have no environment
+// variables, so they are deployed with such a file instead. A missing file
+// is ignored.
+func loadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(entry, "=")
+		if !found || key == "" {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", path, line)
+		}
+		if _, set := os.LookupEnv(key); !set {
+			os.Setenv(key, value)
+		}
+	}
+	return scanner.Err()
+}
+
+// serveLambda answers Lambda invocations until the runtime stops the
+// function. The event decides the answer: API Gateway REST API authorizers
+// (TOKEN and REQUEST), HTTP API authorizers (payload 1.0 like REST, 2.0
+// with simple responses) and Lambda@Edge viewer requests are supported.
+func (s *server) serveLambda() {
+	// Params only ever come from DEFAULT_PARAMS, never from the client
+	s.ProxyMode = proxyModeNginx
+	lambda.Start(s.handleLambda)
+}
+
+func (s *server) handleLambda(ctx context.Context, event json.RawMessage) (interface{}, error) {
+	var probe struct {
+		Type    string            `json:"type"`
+		Version string            `json:"version"`
+		Records []json.RawMessage `json:"Records"`
+	}
+	if err := json.Unmarshal(event, &probe); err != nil {
+		return nil, err
+	}
+	switch {
+	case len(probe.Records) > 0:
+		var edge cloudFrontEvent
+		if err := json.Unmarshal(event, &edge); err != nil {
+			return nil, err
+		}
+		return s.handleViewerRequest(edge)
+	case probe.Type == "TOKEN":
+		var req events.APIGatewayCustomAuthorizerRequest
+		if err := json.Unmarshal(event, &req); err != nil {
+			return nil, err
+		}
+		token := req.AuthorizationToken
+		if !strings.HasPrefix(token, "Bearer ") {
+			token = "Bearer " + token
+		}
+		header := http.Header{"Authorization": {token}}
+		claims, _, headers, err := s.decideLambda(originalRequest{}, header)
+		return restAuthorizerResponse(req.MethodArn, claims, headers, err)
+	case probe.Type == "REQUEST" && probe.Version == "2.0":
+		var req events.APIGatewayV2CustomAuthorizerV2Request
+		if err := json.Unmarshal(event, &req); err != nil {
+			return nil, err
+		}
+		header := lambdaHeader(req.Headers)
+		if len(req.Cookies) > 0 {
+			header.Set("Cookie", strings.Join(req.Cookies, "; "))
+		}
+		uri := req.RawPath
+		if req.RawQueryString != "" {
+			uri += "?" + req.RawQueryString
+		}
+		orig := originalRequest{Method: req.RequestContext.HTTP.Method, Scheme: "https", Host: req.RequestContext.DomainName, URI: uri}
+		_, _, headers, err := s.decideLambda(orig, header)
+		if err != nil && denialOf(err).internal {
+			return nil, err
+		}
+		return events.APIGatewayV2CustomAuthorizerSimpleResponse{IsAuthorized: err == nil, Context: lambdaContext(headers)}, nil
+	case probe.Type == "REQUEST":
+		var req events.APIGatewayCustomAuthorizerRequestTypeRequest
+		if err := json.Unmarshal(event, &req); err != nil {
+			return nil, err
+		}
+		header := lambdaHeader(req.Headers)
+		orig := originalRequest{Method: req.HTTPMethod, Scheme: "https", Host: header.Get("Host"), URI: req.Path}
+		claims, _, headers, err := s.decideLambda(orig, header)
+		return restAuthorizerResponse(req.MethodArn, claims, headers, err)
+	default:
+		return nil, fmt.Errorf("unsupported event of type %q", probe.Type)
+	}
+}
+
+// decideLambda validates the token of a request that reached an AWS
+// authorizer like /validate would, with header being its headers. It
+// returns the params it was validated with and the response headers for an
+// allowed request.
+func (s *server) decideLambda(orig originalRequest, header http.Header) (jwt.MapClaims, url.Values, map[string]string, error) {
+	header.Set("X-Original-Method", orig.Method)
+	header.Set("X-Original-URI", orig.URI)
+	header.Set("X-Forwarded-Proto", orig.Scheme)
+	header.Set("X-Forwarded-Host", orig.Host)
+	r := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: "/validate"}, Header: header, Host: orig.Host}
+
+	params, policy := s.requestParams(r)
+	token, claims, err := s.validateRequest(r, params, policy)
+	if err != nil {
+		d := denialOf(err)
+		s.logDenial(err, d, token)
+		requestsTotal.WithLabelValues(strconv.Itoa(d.status)).Inc()
+		return nil, params, nil, err
+	}
+	requestsTotal.WithLabelValues("200").Inc()
+	headers := s.responseHeaderValues(params, claims)
+	s.forwardToken(headers, params, token)
+	return claims, params, headers, nil
+}
+
+// lambdaHeader converts the single valued headers of an event.
+func lambdaHeader(headers map[string]string) http.Header {
+	header := make(http.Header, len(headers))
+	for name, value := range headers {
+		header.Set(name, value)
+	}
+	return header
+}
+
+func lambdaContext(headers map[string]string) map[string]interface{} {
+	if len(headers) == 0 {
+		return nil
+	}
+	values := make(map[string]interface{}, len(headers))
+	for name, value := range headers {
+		values[name] = value
+	}
+	return values
+}
+
+// restAuthorizerResponse answers a REST API authorizer. API Gateway turns
+// an "Unauthorized" error into a 401 and a Deny policy into a 403, so
+// requests with a valid token the policy or an authorizer refuses get a
+// Deny, the others the error.
+func restAuthorizerResponse(methodArn string, claims jwt.MapClaims, headers map[string]string, err error) (interface{}, error) {
+	effect := "Allow"
+	if err != nil {
+		switch d := denialOf(err); {
+		case d.internal:
+			return nil, err
+		case d.stage == "policy" || d.stage == "authorization":
+			effect = "Deny"
+		default:
+			return nil, errors.New("Unauthorized")
+		}
+	}
+	principal, _ := claims["sub"].(string)
+	if principal == "" {
+		// API Gateway requires one
+		principal = "anonymous"
+	}
+	return events.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: principal,
+		PolicyDocument: events.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []events.IAMPolicyStatement{{
+				Action:   []string{"execute-api:Invoke"},
+				Effect:   effect,
+				Resource: []string{methodArn},
+			}},
+		},
+		Context: lambdaContext(headers),
+	}, nil
+}
+
+// cloudFrontEvent is the Lambda@Edge viewer request event, as far as it is
+// used here.
+type cloudFrontEvent struct {
+	Records []struct {
+		CF struct {
+			Request cloudFrontRequest `json:"request"`
+		} `json:"cf"`
+	} `json:"Records"`
+}
+
+// cloudFrontRequest is passed on to the origin as is, but for its headers,
+// so it keeps all fields.
+type cloudFrontRequest map[string]json.RawMessage
+
+// cloudFrontHeaders are keyed by lower case name.
+type cloudFrontHeaders map[string][]cloudFrontHeader
+
+type cloudFrontHeader struct {
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value"`
+}
+
+type cloudFrontResponse struct {
+	Status            string `json:"status"`
+	StatusDescription string `json:"statusDescription"`
+}
+
+// handleViewerRequest forwards allowed viewer requests to the origin with
+// the response headers added, and answers the others itself.
+func (s *server) handleViewerRequest(event cloudFrontEvent) (interface{}, error) {
+	request := event.Records[0].CF.Request
+	var cfHeaders cloudFrontHeaders
+	if err := json.Unmarshal(request["headers"], &cfHeaders); err != nil {
+		return nil, fmt.Errorf("invalid request headers: %w", err)
+	}
+	var method, uri, querystring string
+	json.Unmarshal(request["method"], &method)
+	json.Unmarshal(request["uri"], &uri)
+	json.Unmarshal(request["querystring"], &querystring)
+	if querystring != "" {
+		uri += "?" + querystring
+	}
+
+	header := http.Header{}
+	for name, values := range cfHeaders {
+		for _, value := range values {
+			header.Add(name, value.Value)
+		}
+	}
+	orig := originalRequest{Method: method, Scheme: "https", Host: header.Get("Host"), URI: uri}
+	_, params, headers, err := s.decideLambda(orig, header)
+	if err != nil {
+		d := denialOf(err)
+		if d.internal {
+			return nil, err
+		}
+		return cloudFrontResponse{Status: strconv.Itoa(d.status), StatusDescription: http.StatusText(d.status)}, nil
+	}
+
+	// Never let viewers set the headers that carry claims, even those the
+	// token has no claim for
+	for _, name := range s.responseHeaderNames(params) {
+		delete(cfHeaders, strings.ToLower(name))
+	}
+	for name, value := range headers {
+		cfHeaders[strings.ToLower(name)] = []cloudFrontHeader{{Key: name, Value: value}}
+	}
+	encoded, err := json.Marshal(cfHeaders)
+	if err != nil {
+		return nil, err
+	}
+	request["headers"] = encoded
+	return request, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ldapGroups looks up the group memberships of a token's subject in LDAP or
+// Active Directory, for identity providers that don't put groups in tokens.
+type ldapGroups struct {
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the subject's entry, %s is replaced by the escaped
+	// subject.
+	UserFilter     string
+	GroupAttribute string
+	// GroupsAsCN reduces group DNs to their first RDN value, usually the cn.
+	GroupsAsCN   bool
+	SubjectClaim string
+	GroupsClaim  string
+	TLSConfig    *tls.Config
+	CacheTTL     time.Duration
+
+	cache *ttlCache[[]string]
+}
+
+func newLDAPGroups() (*ldapGroups, error) {
+	ttl, err := time.ParseDuration(getenv("LDAP_CACHE_TTL", "5m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP_CACHE_TTL: %w", err)
+	}
+	return &ldapGroups{
+		URL:            getenv("LDAP_URL", ""),
+		BindDN:         getenv("LDAP_BIND_DN", ""),
+		BindPassword:   getenv("LDAP_BIND_PASSWORD", ""),
+		BaseDN:         getenv("LDAP_BASE_DN", ""),
+		UserFilter:     getenv("LDAP_USER_FILTER", "(&(objectClass=person)(uid=%s))"),
+		GroupAttribute: getenv("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		GroupsAsCN:     getenv("LDAP_GROUP_FORMAT", "cn") == "cn",
+		SubjectClaim:   getenv("LDAP_SUBJECT_CLAIM", "sub"),
+		GroupsClaim:    getenv("LDAP_GROUPS_CLAIM", "groups"),
+		TLSConfig:      &tls.Config{InsecureSkipVerify: getenv("INSECURE_SKIP_VERIFY", "false") == "true"},
+		CacheTTL:       ttl,
+		cache:          newTTLCache[[]string](10000),
+	}, nil
+}
+
+// enrich merges the subject's LDAP groups into the groups claim.
+func (l *ldapGroups) enrich(raw string, claims jwt.MapClaims) error {
+	subject, _ := claims[l.SubjectClaim].(string)
+	if subject == "" {
+		return fmt.Errorf("token has no %s claim to look up in LDAP", l.SubjectClaim)
+	}
+	groups, ok := l.cache.get(subject)
+	if !ok {
+		var err error
+		if groups, err = l.lookup(subject); err != nil {
+			return fmt.Errorf("LDAP lookup of %q failed: %w", subject, err)
+		}
+		l.cache.set(subject, groups, l.CacheTTL)
+	}
+	mergeClaimValues(claims, l.GroupsClaim, groups)
+	return nil
+}
+
+func (l *ldapGroups) lookup(subject string) ([]string, error) {
+	conn, err := ldap.DialURL(l.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}),
+		ldap.DialWithTLSConfig(l.TLSConfig),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetTimeout(5 * time.Second)
+
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	result, err := conn.Search(ldap.NewSearchRequest(
+		l.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 5, false,
+		fmt.Sprintf(l.UserFilter, ldap.EscapeFilter(subject)),
+		[]string{l.GroupAttribute}, nil,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("expected one entry, found %d", len(result.Entries))
+	}
+
+	var groups []string
+	for _, group := range result.Entries[0].GetAttributeValues(l.GroupAttribute) {
+		if l.GroupsAsCN {
+			dn, err := ldap.ParseDN(group)
+			if err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+				group = dn.RDNs[0].Attributes[0].Value
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// mergeClaimValues adds values to the list claim name, keeping the values
+// the token already has.
+func mergeClaimValues(claims jwt.MapClaims, name string, values []string) {
+	merged := []interface{}{}
+	seen := map[string]bool{}
+	switch existing := claims[name].(type) {
+	case string:
+		merged = append(merged, existing)
+		seen[existing] = true
+	case []interface{}:
+		for _, v := range existing {
+			merged = append(merged, v)
+			if s, ok := v.(string); ok {
+				seen[s] = true
+			}
+		}
+	}
+	for _, v := range values {
+		if !seen[v] {
+			merged = append(merged, v)
+			seen[v] = true
+		}
+	}
+	claims[name] = merged
+}
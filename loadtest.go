@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/time/rate"
+)
+
+// runLoadtest implements the loadtest subcommand. It signs a set of test
+// tokens and sends them to a /validate endpoint at a fixed rate, then
+// reports the status codes and latency percentiles.
+func runLoadtest(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("loadtest", flag.ContinueOnError)
+	target := flags.String("url", "http://localhost:8080/validate", "validation URL, including any params")
+	keyFile := flags.String("key", "loadtest.pem", "PEM encoded EC private key to sign tokens with, created along with <key>.pub for JWKS_PATH if missing")
+	claimsJSON := flags.String("claims", `{"sub":"loadtest"}`, "claims of the tokens as a JSON object")
+	tokenCount := flags.Int("tokens", 100, "number of distinct tokens to cycle through")
+	rps := flags.Float64("rps", 100, "target requests per second")
+	duration := flags.Duration("duration", 10*time.Second, "test duration")
+	concurrency := flags.Int("concurrency", 64, "maximum concurrent requests")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *tokenCount <= 0 || *rps <= 0 || *concurrency <= 0 {
+		return errors.New("tokens, rps and concurrency must be positive")
+	}
+
+	key, err := signingKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	var claims jwt.MapClaims
+	if err := json.Unmarshal([]byte(*claimsJSON), &claims); err != nil {
+		return fmt.Errorf("invalid claims: %w", err)
+	}
+	tokens := make([]string, *tokenCount)
+	for i := range tokens {
+		tokenClaims := jwt.MapClaims{}
+		for name, value := range claims {
+			tokenClaims[name] = value
+		}
+		tokenClaims["jti"] = fmt.Sprintf("loadtest-%d", i)
+		tokenClaims["exp"] = time.Now().Add(*duration + time.Hour).Unix()
+		if tokens[i], err = jwt.NewWithClaims(jwt.SigningMethodES256, tokenClaims).SignedString(key); err != nil {
+			return err
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+	}
+	limiter := rate.NewLimiter(rate.Limit(*rps), 1)
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		statuses  = map[string]int{}
+		latencies []time.Duration
+		wg        sync.WaitGroup
+		next      int
+	)
+	start := time.Now()
+	for w := 0; w < *concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for limiter.Wait(ctx) == nil {
+				mu.Lock()
+				token := tokens[next%len(tokens)]
+				next++
+				mu.Unlock()
+
+				status, latency := loadtestRequest(client, *target, token)
+				mu.Lock()
+				statuses[status]++
+				latencies = append(latencies, latency)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Fprintf(out, "requests: %d in %s (%.1f/s)\n", len(latencies), elapsed.Round(time.Millisecond), float64(len(latencies))/elapsed.Seconds())
+	for _, status := range sortedKeys(statuses) {
+		fmt.Fprintf(out, "status %s: %d\n", status, statuses[status])
+	}
+	if len(latencies) > 0 {
+		for _, p := range []float64{50, 90, 99, 99.9} {
+			fmt.Fprintf(out, "p%v: %s\n", p, latencies[int(float64(len(latencies)-1)*p/100)])
+		}
+		fmt.Fprintf(out, "max: %s\n", latencies[len(latencies)-1])
+	}
+	return nil
+}
+
+func loadtestRequest(client *http.Client, target, token string) (string, time.Duration) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return "error", 0
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	start := time.Now()
+	resp, err := client.Do(req)
+	latency := time.Since(start)
+	if err != nil {
+		return "error", latency
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return fmt.Sprint(resp.StatusCode), latency
+}
+
+// signingKey reads the signing key from path. If there is none, a key is
+// generated and saved to path, and its public key to path.pub.
+func signingKey(path string) (*ecdsa.PrivateKey, error) {
+	keyBytes, err := os.ReadFile(path)
+	if err == nil {
+		return jwt.ParseECPrivateKeyFromPEM(keyBytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		return nil, err
+	}
+	if der, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+		return nil, err
+	}
+	return key, os.WriteFile(path+".pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644)
+}
@@ -1,6 +1,7 @@
 package logger
 
 import (
+	"fmt"
 	"os"
 	"strings"
 
@@ -14,10 +15,17 @@ type Logger interface {
 	Fatalw(msg string, keysAndValues ...interface{})
 	Infow(msg string, keysAndValues ...interface{})
 	Warnw(msg string, keysAndValues ...interface{})
+	// DebugEnabled reports whether debug messages are logged, so callers on
+	// hot paths can skip building them.
+	DebugEnabled() bool
+	// Level returns the current log level, SetLevel changes it at runtime.
+	Level() string
+	SetLevel(lvl string) error
 }
 
 type loggerImpl struct {
-	z *zap.SugaredLogger
+	z     *zap.SugaredLogger
+	level zap.AtomicLevel
 }
 
 func (dl *loggerImpl) Debugw(msg string, keysAndValues ...interface{}) {
@@ -40,26 +48,44 @@ func (dl *loggerImpl) Warnw(msg string, keysAndValues ...interface{}) {
 	dl.z.Warnw(msg, keysAndValues...)
 }
 
-func NewLogger(lvl string) Logger {
-	var level zapcore.Level
-	unrecognizedLevel := false
+func (dl *loggerImpl) DebugEnabled() bool {
+	return dl.level.Enabled(zapcore.DebugLevel)
+}
+
+func (dl *loggerImpl) Level() string {
+	return dl.level.String()
+}
+
+func (dl *loggerImpl) SetLevel(lvl string) error {
+	level, ok := parseLevel(lvl)
+	if !ok {
+		return fmt.Errorf("unknown log level %q", lvl)
+	}
+	dl.level.SetLevel(level)
+	return nil
+}
+
+// parseLevel parses a log level name, an empty one is info.
+func parseLevel(lvl string) (zapcore.Level, bool) {
 	switch strings.ToLower(lvl) {
 	case "debug":
-		level = zapcore.DebugLevel
-	case "info":
-		level = zapcore.InfoLevel
+		return zapcore.DebugLevel, true
+	case "info", "":
+		return zapcore.InfoLevel, true
 	case "warn":
-		level = zapcore.WarnLevel
+		return zapcore.WarnLevel, true
 	case "error":
-		level = zapcore.ErrorLevel
+		return zapcore.ErrorLevel, true
 	case "fatal":
-		level = zapcore.FatalLevel
-	case "": // If not set, use info
-		level = zapcore.InfoLevel
-	default: // If set to something we don't recognize, set to info and warn
-		level = zapcore.InfoLevel
-		unrecognizedLevel = true
+		return zapcore.FatalLevel, true
 	}
+	return zapcore.InfoLevel, false
+}
+
+func NewLogger(lvl string) Logger {
+	// If set to something we don't recognize, use info and warn
+	parsed, recognized := parseLevel(lvl)
+	level := zap.NewAtomicLevelAt(parsed)
 
 	consoleDebugging := zapcore.Lock(os.Stdout)
 	consoleErrors := zapcore.Lock(os.Stderr)
@@ -68,7 +94,7 @@ func NewLogger(lvl string) Logger {
 		return lvl >= zapcore.ErrorLevel
 	})
 	lowPriority := zap.LevelEnablerFunc(func(lvl zapcore.Level) bool {
-		return lvl < zapcore.ErrorLevel && lvl >= level
+		return lvl < zapcore.ErrorLevel && level.Enabled(lvl)
 	})
 
 	encoderConfig := zap.NewProductionEncoderConfig()
@@ -82,9 +108,10 @@ func NewLogger(lvl string) Logger {
 	defer logger.Sync()
 
 	l := &loggerImpl{
-		z: logger.Sugar(),
+		z:     logger.Sugar(),
+		level: level,
 	}
-	if unrecognizedLevel {
+	if !recognized {
 		l.Warnw("Unrecognized value of log level, defaulting to info", "level", lvl)
 	}
 
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// lruCache is a size bounded cache evicting the least recently used entry,
+// where each entry also expires on its own.
+type lruCache[V any] struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // front is most recently used
+	maxEntries int
+}
+
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+func newLRUCache[V any](maxEntries int) *lruCache[V] {
+	return &lruCache[V]{entries: make(map[string]*list.Element), order: list.New(), maxEntries: maxEntries}
+}
+
+func (c *lruCache[V]) get(key string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var zero V
+	element, ok := c.entries[key]
+	if !ok {
+		return zero, false
+	}
+	entry := element.Value.(*lruEntry[V])
+	if time.Now().After(entry.expires) {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return zero, false
+	}
+	c.order.MoveToFront(element)
+	return entry.value, true
+}
+
+func (c *lruCache[V]) set(key string, value V, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = &lruEntry[V]{key: key, value: value, expires: time.Now().Add(ttl)}
+		c.order.MoveToFront(element)
+		return
+	}
+	if c.order.Len() >= c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry[V]).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry[V]{key: key, value: value, expires: time.Now().Add(ttl)})
+}
+
+// purge removes all entries, returning how many there were.
+func (c *lruCache[V]) purge() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.order.Len()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	return n
+}
+
+// snapshot returns the entries that haven't expired, most recently used
+// first.
+func (c *lruCache[V]) snapshot() []lruEntry[V] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	entries := make([]lruEntry[V], 0, c.order.Len())
+	for element := c.order.Front(); element != nil; element = element.Next() {
+		if entry := element.Value.(*lruEntry[V]); now.Before(entry.expires) {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries
+}
+
+// memoryCache keeps results in-process.
+type memoryCache struct {
+	lru *lruCache[jwt.MapClaims]
+}
+
+func (c *memoryCache) get(key string) (jwt.MapClaims, bool) {
+	return c.lru.get(key)
+}
+
+func (c *memoryCache) set(key string, claims jwt.MapClaims, ttl time.Duration) {
+	c.lru.set(key, claims, ttl)
+}
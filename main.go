@@ -1,28 +1,33 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
-	"crypto/ecdsa"
-	"crypto/x509"
-	"encoding/pem"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
-	"io/ioutil"
 
+	"github.com/robbilie/nginx-jwt-auth/extension"
 	"github.com/robbilie/nginx-jwt-auth/logger"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+	"github.com/robbilie/nginx-jwt-auth/spoe"
+	"github.com/robbilie/nginx-jwt-auth/validator"
 
-	"github.com/MicahParks/keyfunc"
-	"github.com/golang-jwt/jwt/v4"
-	"github.com/golang-jwt/jwt/v4/request"
+	"github.com/golang-jwt/jwt/v5"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/umisama/go-regexpcache"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
 )
 
 var (
@@ -33,111 +38,820 @@ var (
 	validationTime = prometheus.NewHistogram(prometheus.HistogramOpts{
 		Name:    "nginx_subrequest_auth_jwt_token_validation_time_seconds",
 		Help:    "Number of seconds spent validating token",
-		Buckets: prometheus.ExponentialBuckets(100*time.Nanosecond.Seconds(), 3, 6),
+		Buckets: validationTimeBuckets,
 	})
+	validationTimeBuckets = prometheus.ExponentialBuckets(100*time.Nanosecond.Seconds(), 3, 6)
+	denialsTotal          = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nginx_subrequest_auth_jwt_denials_total",
+		Help: "Number of denials, by reason and issuer",
+	}, []string{"reason", "issuer"})
+	outcomesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "nginx_subrequest_auth_jwt_denial_outcomes_total",
+		Help: "Number of denials, by whether the token was refused or its claims",
+	}, []string{"outcome"})
 )
 
 func init() {
 	requestsTotal.WithLabelValues("200")
 	requestsTotal.WithLabelValues("401")
+	requestsTotal.WithLabelValues("403")
 	requestsTotal.WithLabelValues("405")
+	requestsTotal.WithLabelValues("429")
 	requestsTotal.WithLabelValues("500")
+	for _, d := range denials {
+		denialsTotal.WithLabelValues(d.code, "none")
+	}
+	outcomesTotal.WithLabelValues("unauthenticated")
+	outcomesTotal.WithLabelValues("forbidden")
 
 	prometheus.MustRegister(
 		requestsTotal,
 		validationTime,
+		denialsTotal,
+		outcomesTotal,
 	)
 }
 
+// subcommands are run instead of the server when named as first argument.
+var subcommands = map[string]func(args []string, out io.Writer) error{
+	"istio":    runIstio,
+	"loadtest": runLoadtest,
+	"token":    runToken,
+	"verify":   runVerify,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:], os.Stdout); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	if inLambda() {
+		if err := loadEnvFile(getenv("LAMBDA_ENV_FILE", "jwt-auth.env")); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	devMode := flag.Bool("dev", false, "run a mock IdP serving /dev/jwks.json and /dev/token, never use in production")
+	flag.Parse()
+
 	logger := logger.NewLogger(getenv("LOG_LEVEL", "info")) // "debug", "info", "warn", "error", "fatal"
 
+	if err := configureGC(logger); err != nil {
+		logger.Fatalw("Invalid GC settings", "err", err)
+	}
+
+	var dev *devIdP
+	if *devMode {
+		var err error
+		dev, err = newDevIdP(getenv("DEV_KEY_FILE", ""))
+		if err != nil {
+			logger.Fatalw("Couldn't create the development IdP", "err", err)
+		}
+		logger.Warnw("Development mode, accepting tokens issued at /dev/token")
+	}
+
+	server, warm := configure(logger, dev)
+	if inLambda() {
+		server.serveLambda()
+		return
+	}
+	drain, err := newDrainer()
+	if err != nil {
+		logger.Fatalw("Invalid shutdown settings", "err", err)
+	}
+	var cert *servingCert
+	if certFile := getenv("TLS_CERT_FILE", ""); certFile != "" {
+		if cert, err = loadServingCert(certFile, getenv("TLS_KEY_FILE", ""), getenv("TLS_CLIENT_CA_FILE", "")); err != nil {
+			logger.Fatalw("Couldn't load the TLS certificate", "err", err)
+		}
+		server.Reloaders = append(server.Reloaders, reloader{name: "tls", reload: cert.reload})
+	} else if getenv("TLS_CLIENT_CA_FILE", "") != "" {
+		logger.Fatalw("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE")
+	}
+	// Not DefaultServeMux, which net/http/pprof registers its handlers on
+	mux := http.NewServeMux()
+	if server.Login != nil {
+		mux.HandleFunc("/login", server.login)
+		mux.HandleFunc("/callback", server.callback)
+		mux.HandleFunc("POST /logout", server.logout)
+	}
+	if server.ProxyMode == proxyModeEnvoy {
+		// Envoy's path_prefix puts the original path after /validate
+		mux.HandleFunc("/validate/", cert.requireClientCert(server.validate))
+	}
+
+	if spoeAddr := getenv("SPOE_ADDR", ""); spoeAddr != "" {
+		listener, err := net.Listen("tcp", spoeAddr)
+		if err != nil {
+			logger.Fatalw("Couldn't listen for SPOE", "addr", spoeAddr, "err", err)
+		}
+		logger.Infow("Starting SPOE agent", "addr", spoeAddr)
+		go func() {
+			err := spoe.Serve(listener, server.handleSPOE, func(err error) {
+				logger.Warnw("SPOE connection failed", "err", err)
+			})
+			logger.Fatalw("Error running SPOE agent", "err", err)
+		}()
+	}
+
+	if grpcAddr := getenv("GRPC_ADDR", ""); grpcAddr != "" {
+		if server.ParamsHeader == "" {
+			server.ParamsHeader = getenv("PARAMS_HEADER", "X-Jwt-Auth-Params")
+		}
+		listener, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			logger.Fatalw("Couldn't listen for gRPC", "addr", grpcAddr, "err", err)
+		}
+		grpcServer, grpcHealth := newGRPCServer(server)
+		drain.GRPC, drain.GRPCHealth = grpcServer, grpcHealth
+		logger.Infow("Starting gRPC server", "addr", grpcAddr)
+		go func() {
+			// Serve returns nil once drained
+			if err := grpcServer.Serve(listener); err != nil {
+				logger.Fatalw("Error running gRPC server", "err", err)
+			}
+		}()
+	}
+
+	// Metrics, health and the admin API are served on ADMIN_PORT if set,
+	// so exposing /validate to the proxies doesn't expose them as well
+	adminMux := mux
+	adminPort := getenv("ADMIN_PORT", "")
+	if adminPort != "" {
+		adminMux = http.NewServeMux()
+	}
+	adminMux.Handle("/metrics", promhttp.Handler())
+	if dev != nil {
+		adminMux.HandleFunc("/dev/jwks.json", dev.serveJWKS)
+		adminMux.HandleFunc("/dev/token", dev.issue)
+	}
+	mux.HandleFunc("/validate", cert.requireClientCert(server.validate))
+	if getenv("BATCH_VALIDATION", "false") == "true" {
+		if server.ProxyMode == proxyModeEnvoy {
+			// Envoy's original paths are served below /validate/, a request
+			// to /batch would get a batch answer
+			logger.Fatalw("BATCH_VALIDATION can't be used with PROXY_MODE=envoy")
+		}
+		server.BatchMaxTokens, err = strconv.Atoi(getenv("BATCH_MAX_TOKENS", "1000"))
+		if err != nil || server.BatchMaxTokens < 1 {
+			logger.Fatalw("Invalid BATCH_MAX_TOKENS", "value", getenv("BATCH_MAX_TOKENS", "1000"))
+		}
+		// Room for the largest tokens, including their params
+		server.BatchMaxBytes = int64(server.BatchMaxTokens) * 16 << 10
+		mux.HandleFunc("/validate/batch", cert.requireClientCert(server.validateBatch))
+	}
+	if adminToken := getenv("ADMIN_TOKEN", ""); adminToken != "" {
+		adminMux.Handle("/admin/", server.adminHandler(adminToken))
+	}
+	adminMux.HandleFunc("/healthz", drain.healthz)
+	if getenv("PPROF", "false") == "true" {
+		// Profiles expose internals, never serve them to the proxies
+		if adminPort == "" {
+			logger.Fatalw("PPROF requires ADMIN_PORT")
+		}
+		handlePprof(adminMux)
+	}
+
+	var watched []string
+	for _, name := range []string{"JWKS_PATH", "CONFIG_PATH", "REVOCATION_FILE", "TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_CLIENT_CA_FILE"} {
+		if path := getenv(name, ""); path != "" {
+			watched = append(watched, path)
+		}
+	}
+	if err := server.watchReloads(watched, getenv("CONFIG_WATCH", "true") == "true"); err != nil {
+		logger.Fatalw("Couldn't watch configuration files", "err", err)
+	}
+
+	bindAddr := ":" + getenv("PORT", "8080")
+
+	engine := getenv("SERVER_ENGINE", engineNetHTTP)
+	srv, err := newHTTPServer(engine, mux)
+	if err != nil {
+		logger.Fatalw("Couldn't create the server", "err", err)
+	}
+	listener, err := net.Listen("tcp", bindAddr)
+	if err != nil {
+		logger.Fatalw("Couldn't listen", "addr", bindAddr, "err", err)
+	}
+	if cert != nil {
+		listener = tls.NewListener(listener, cert.tlsConfig())
+	}
+	if adminPort != "" {
+		adminAddr := ":" + adminPort
+		drain.Admin, err = newHTTPServer(engineNetHTTP, adminMux)
+		if err != nil {
+			logger.Fatalw("Couldn't create the admin server", "err", err)
+		}
+		adminListener, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			logger.Fatalw("Couldn't listen", "addr", adminAddr, "err", err)
+		}
+		logger.Infow("Starting admin server", "addr", adminAddr)
+		go func() {
+			if err := drain.Admin.Serve(adminListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.Fatalw("Error running admin server", "err", err)
+			}
+		}()
+	}
+	tracerProvider, err := newTracerProvider(context.Background())
+	if err != nil {
+		logger.Fatalw("Couldn't set up tracing", "err", err)
+	}
+	if tracerProvider != nil {
+		server.Tracer = tracerProvider.Tracer("github.com/robbilie/nginx-jwt-auth")
+	}
+	stopped := make(chan struct{})
+	go drain.drainOnSignal(server, srv, func() {
+		if tracerProvider != nil {
+			// Export the spans still buffered
+			if err := tracerProvider.Shutdown(context.Background()); err != nil {
+				logger.Warnw("Couldn't export the last spans", "err", err)
+			}
+		}
+		if warm != nil {
+			if err := warm.save(server.Results); err != nil {
+				logger.Errorw("Couldn't write WARM_CACHE_FILE", "err", err)
+			}
+		}
+		close(stopped)
+	})
+
+	logger.Infow("Starting server", "addr", bindAddr, "engine", engine, "tls", cert != nil)
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Fatalw("Error running server", "err", err)
+	}
+	<-stopped
+}
+
+// configure sets up the server from the environment. It fails fatally on
+// invalid settings. The warm cache is nil unless WARM_CACHE_FILE is set.
+// Tokens of dev are accepted too, if not nil.
+func configure(logger logger.Logger, dev *devIdP) (*server, *warmCache) {
 	insecureSkipVerify := getenv("INSECURE_SKIP_VERIFY", "false")
 	if insecureSkipVerify == "true" {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
+	outbound := newOutboundPolicy()
+	client, err := newOutboundClient(outbound)
+	if err != nil {
+		logger.Fatalw("Failed to create outbound client", "err", err)
+	}
+
+	var provider *oidcProvider
+	if issuer := getenv("OIDC_ISSUER", ""); issuer != "" {
+		var err error
+		provider, err = discoverOIDC(client, outbound, issuer)
+		if err != nil {
+			logger.Fatalw("OIDC discovery failed", "issuer", issuer, "err", err)
+		}
+	}
+
+	preset, err := newPreset(getenv("PRESET", ""))
+	if err != nil {
+		logger.Fatalw("Couldn't configure PRESET", "err", err)
+	}
+	if preset != nil && preset.DiscoveryIssuer != "" {
+		discovered, err := discoverOIDC(client, outbound, preset.DiscoveryIssuer)
+		if err != nil {
+			logger.Fatalw("OIDC discovery failed", "issuer", preset.DiscoveryIssuer, "err", err)
+		}
+		preset.KeysURL = discovered.JWKSURI
+	}
+
 	jwksPath := getenv("JWKS_PATH", "")
 	jwksUrl := getenv("JWKS_URL", "")
-	if jwksUrl == "" && jwksPath == "" {
+	jwksFormat := getenv("JWKS_FORMAT", keysFormatJWKS)
+	presetKeyfunc := preset != nil && preset.NewKeyfunc != nil && jwksUrl == "" && jwksPath == ""
+	if presetKeyfunc {
+		if err := outbound.checkURL(preset.KeysURL); err != nil {
+			logger.Fatalw("Preset key URL rejected by outbound policy", "err", err)
+		}
+	} else if jwksUrl == "" && jwksPath == "" && preset != nil {
+		jwksUrl, jwksFormat = preset.KeysURL, preset.KeysFormat
+	}
+	// The key set of OIDC_ISSUER, if it is the only one
+	discovered := jwksUrl == "" && jwksPath == "" && !presetKeyfunc && provider != nil
+	if discovered {
+		jwksUrl = provider.JWKSURI
+	}
+	spiffeAudiences := splitList(getenv("SPIFFE_AUDIENCES", ""))
+	keyProviders, err := extension.KeyProviders(splitList(getenv("KEY_PROVIDERS", "")))
+	if err != nil {
+		logger.Fatalw("Couldn't configure KEY_PROVIDERS", "err", err)
+	}
+	var issuers []issuerConfig
+	if configPath := getenv("CONFIG_PATH", ""); configPath != "" {
+		file, err := loadConfigFile(configPath)
+		if err != nil {
+			logger.Fatalw("Couldn't read CONFIG_PATH", "err", err)
+		}
+		issuers = file.Issuers
+	}
+	if jwksUrl == "" && jwksPath == "" && len(spiffeAudiences) == 0 && !presetKeyfunc && dev == nil && len(keyProviders) == 0 && len(issuers) == 0 {
 		logger.Fatalw("no JWKS_URL or JWKS_PATH")
-		return
 	}
 
-	server, err := newServer(logger, jwksPath, jwksUrl)
+	if jwksUrl != "" && jwksPath == "" {
+		for _, keysURL := range splitList(jwksUrl) {
+			if err := outbound.checkURL(keysURL); err != nil {
+				logger.Fatalw("JWKS_URL rejected by outbound policy", "err", err)
+			}
+		}
+	}
+
+	var warm *warmCache
+	if warmCacheFile := getenv("WARM_CACHE_FILE", ""); warmCacheFile != "" {
+		warm, err = newWarmCache(warmCacheFile)
+		if err != nil {
+			// Starting cold is better than not starting
+			logger.Warnw("Couldn't read WARM_CACHE_FILE", "err", err)
+		}
+		warm.devKeys = dev != nil
+	}
+
+	server, err := newServer(logger, client, jwksPath, jwksUrl, jwksFormat, warm)
 	if err != nil {
 		logger.Fatalw("Couldn't initialize server", "err", err)
 	}
+	server.ParserOptions, server.Checks, err = jwtOptions()
+	if err != nil {
+		logger.Fatalw("Invalid token validation options", "err", err)
+	}
+	server.Algorithms, err = allowedAlgorithms()
+	if err != nil {
+		logger.Fatalw("Invalid token validation options", "err", err)
+	}
+	server.ClaimNamespaces = splitList(getenv("CLAIMS_NAMESPACES", ""))
+	if discovered {
+		interval, err := time.ParseDuration(getenv("OIDC_DISCOVERY_INTERVAL", "1h"))
+		if err != nil {
+			logger.Fatalw("Couldn't parse OIDC_DISCOVERY_INTERVAL", "err", err)
+		}
+		opts, err := newKeySourceOptions(client, logger, keysFormatJWKS, warm)
+		if err != nil {
+			logger.Fatalw("Couldn't initialize server", "err", err)
+		}
+		keys := newDiscoveredKeys(provider, server.Keyfunc)
+		server.Keyfunc = keys.Keyfunc
+		go keys.rediscover(opts, outbound, interval)
+	}
+	if preset != nil {
+		server.ParserOptions = append(server.ParserOptions, preset.ParserOptions...)
+		server.Checks = append(server.Checks, preset.Checks...)
+		server.ClaimAliases = preset.ClaimAliases
+		server.ClaimTransforms = preset.ClaimTransforms
+		server.TokenHeader = preset.TokenHeader
+		if presetKeyfunc {
+			server.Keyfunc = preset.NewKeyfunc(client)
+		}
+	}
+	server.TokenHeader = getenv("TOKEN_HEADER", server.TokenHeader)
+	server.TokenPrefix = getenv("TOKEN_HEADER_PREFIX", "")
+	server.TokenQuery = getenv("TOKEN_QUERY_PARAM", "")
+	server.TokenSources, err = parseTokenSources(getenv("TOKEN_SOURCES", ""))
+	if err != nil {
+		logger.Fatalw("Invalid TOKEN_SOURCES", "err", err)
+	}
+	server.CookieChunks = getenv("COOKIE_CHUNKS", "false") == "true"
 
-	http.Handle("/metrics", promhttp.Handler())
-	http.HandleFunc("/validate", server.validate)
-	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "OK") })
+	if len(spiffeAudiences) > 0 {
+		server.Keyfunc, err = newSPIFFEKeyfunc(context.Background())
+		if err != nil {
+			logger.Fatalw("Couldn't initialize SPIFFE trust bundles", "err", err)
+		}
+		server.Checks = append(server.Checks, spiffeCheck(spiffeAudiences, splitList(getenv("SPIFFE_ALLOWED_IDS", ""))))
+	}
+	if len(issuers) > 0 {
+		opts, err := newKeySourceOptions(client, logger, keysFormatJWKS, warm)
+		if err != nil {
+			logger.Fatalw("Couldn't load the issuers of CONFIG_PATH", "err", err)
+		}
+		keys, err := loadIssuers(opts, outbound, issuers, server.Keyfunc)
+		if err != nil {
+			logger.Fatalw("Couldn't load the issuers of CONFIG_PATH", "err", err)
+		}
+		server.Keyfunc = keys.Keyfunc
+	}
+	if len(keyProviders) > 0 {
+		sources := &keySources{}
+		if server.Keyfunc != nil {
+			sources.add(server.Keyfunc)
+		}
+		for _, provide := range keyProviders {
+			kf, err := provide()
+			if err != nil {
+				logger.Fatalw("Couldn't initialize key provider", "err", err)
+			}
+			sources.add(kf)
+		}
+		server.Keyfunc = sources.Keyfunc
+	}
+	checkProviders, err := extension.Checks(splitList(getenv("CHECKS", "")))
+	if err != nil {
+		logger.Fatalw("Couldn't configure CHECKS", "err", err)
+	}
+	for _, provide := range checkProviders {
+		check, err := provide()
+		if err != nil {
+			logger.Fatalw("Couldn't initialize check", "err", err)
+		}
+		server.Checks = append(server.Checks, check)
+	}
+	server.Extractors, err = extension.Extractors(splitList(getenv("EXTRACTORS", "")))
+	if err != nil {
+		logger.Fatalw("Couldn't configure EXTRACTORS", "err", err)
+	}
+	if dev != nil {
+		server.Keyfunc = dev.keyfunc(server.Keyfunc)
+	}
 
-	bindAddr := ":" + getenv("PORT", "8080")
+	revocationFile := getenv("REVOCATION_FILE", "")
+	revocationRedis := getenv("REVOCATION_REDIS", "false") == "true"
+	// Admins can always revoke tokens
+	if revocationFile != "" || revocationRedis || getenv("ADMIN_TOKEN", "") != "" {
+		server.Revocations, err = newRevocations(logger, revocationFile)
+		if err != nil {
+			logger.Fatalw("Couldn't read REVOCATION_FILE", "err", err)
+		}
+		if revocationRedis {
+			if server.Revocations.redis, err = newRedisClient(); err != nil {
+				logger.Fatalw("Couldn't connect to Redis for revocations", "err", err)
+			}
+		}
+	}
+	if revocationFile != "" {
+		revoked := server.Revocations
+		server.Reloaders = append(server.Reloaders, reloader{name: "revocations", reload: revoked.refresh})
+		interval, err := time.ParseDuration(getenv("REVOCATION_RELOAD_INTERVAL", "1m"))
+		if err != nil {
+			logger.Fatalw("Couldn't parse REVOCATION_RELOAD_INTERVAL", "err", err)
+		}
+		if keyvalURL := getenv("NGINX_KEYVAL_URL", ""); keyvalURL != "" {
+			// The NGINX Plus API is usually internal, so it isn't subject to the outbound policy
+			keyval := &keyvalSync{url: keyvalURL, client: &http.Client{Timeout: 10 * time.Second}, logger: logger}
+			revoked.OnChange = func(entries map[string]string) {
+				if err := keyval.sync(entries); err != nil {
+					logger.Errorw("Failed to synchronize revocations to keyval zone", "url", keyvalURL, "err", err)
+				}
+			}
+			go keyval.loop(revoked, 5*interval)
+		}
+		go revoked.watch(interval)
+	}
+
+	if getenv("USERINFO_ENRICH", "false") == "true" {
+		endpoint := getenv("USERINFO_URL", "")
+		if endpoint == "" && provider != nil {
+			endpoint = provider.UserinfoEndpoint
+		}
+		if endpoint == "" {
+			logger.Fatalw("USERINFO_ENRICH requires USERINFO_URL or an OIDC_ISSUER with a userinfo_endpoint")
+		}
+		if err := outbound.checkURL(endpoint); err != nil {
+			logger.Fatalw("USERINFO_URL rejected by outbound policy", "err", err)
+		}
+		server.Enrichers = append(server.Enrichers, newUserInfo(client, endpoint).enrich)
+	}
+	if endpoint := getenv("INTROSPECTION_URL", ""); endpoint != "" {
+		if err := outbound.checkURL(endpoint); err != nil {
+			logger.Fatalw("INTROSPECTION_URL rejected by outbound policy", "err", err)
+		}
+		if server.Introspection, err = newIntrospector(client, endpoint); err != nil {
+			logger.Fatalw("Couldn't initialize introspection", "err", err)
+		}
+	}
+	if opaURL := getenv("OPA_URL", ""); opaURL != "" {
+		if err := outbound.checkURL(opaURL); err != nil {
+			logger.Fatalw("OPA_URL rejected by outbound policy", "err", err)
+		}
+		opa := &remoteOPA{url: opaURL, client: client, server: server}
+		server.Authorizers = append(server.Authorizers, opa.authorize)
+	}
+	if opaConfig := getenv("OPA_CONFIG_FILE", ""); opaConfig != "" {
+		opa, err := newLocalOPA(server, opaConfig, getenv("OPA_DECISION", "httpapi/authz"))
+		if err != nil {
+			logger.Fatalw("Couldn't initialize OPA", "err", err)
+		}
+		server.Authorizers = append(server.Authorizers, opa.authorize)
+	}
+	if entitlementsURL := getenv("ENTITLEMENTS_URL", ""); entitlementsURL != "" {
+		if err := outbound.checkURL(strings.ReplaceAll(entitlementsURL, "{sub}", "sub")); err != nil {
+			logger.Fatalw("ENTITLEMENTS_URL rejected by outbound policy", "err", err)
+		}
+		server.Enrichers = append(server.Enrichers, newEntitlements(client).enrich)
+	}
+	if getenv("AZURE_GRAPH_CLIENT_ID", "") != "" {
+		server.Enrichers = append(server.Enrichers, newGraphGroups(client).enrich)
+	}
+	if getenv("LDAP_URL", "") != "" {
+		ldap, err := newLDAPGroups()
+		if err != nil {
+			logger.Fatalw("Couldn't initialize LDAP groups", "err", err)
+		}
+		server.Enrichers = append(server.Enrichers, ldap.enrich)
+	}
+
+	if clientID := getenv("OIDC_CLIENT_ID", ""); clientID != "" {
+		if provider == nil {
+			logger.Fatalw("OIDC_CLIENT_ID requires OIDC_ISSUER")
+		}
+		secret := []byte(getenv("COOKIE_SECRET", ""))
+		if len(secret) == 0 {
+			logger.Warnw("No COOKIE_SECRET set, using a random one. Logins will fail across restarts and replicas")
+			secret = []byte(randomString())
+		}
+		server.Login = &oidcLogin{
+			Provider:     provider,
+			ClientID:     clientID,
+			ClientSecret: getenv("OIDC_CLIENT_SECRET", ""),
+			RedirectURL:  getenv("OIDC_REDIRECT_URL", ""),
+			Scopes:       getenv("OIDC_SCOPES", "openid profile email"),
+			CookieName:   getenv("SESSION_COOKIE", "jwt_session"),
+			CookieDomain: getenv("COOKIE_DOMAIN", ""),
+			CookieSecure: getenv("COOKIE_SECURE", "true") == "true",
+			Secret:       secret,
+
+			PostLogoutRedirectURL: getenv("OIDC_POST_LOGOUT_REDIRECT_URL", ""),
+			IdPLogout:             getenv("OIDC_IDP_LOGOUT", "true") == "true",
+		}
+		if server.Login.RedirectURL == "" {
+			logger.Fatalw("OIDC_CLIENT_ID requires OIDC_REDIRECT_URL")
+		}
+	}
+
+	if getenv("RESULT_CACHE", "") != "" {
+		server.Results, err = newCachedResults(logger)
+		if err != nil {
+			logger.Fatalw("Couldn't initialize RESULT_CACHE", "err", err)
+		}
+		if warm != nil {
+			if count, err := warm.restoreResults(server.Results); err != nil {
+				logger.Warnw("Not restoring cached results", "err", err)
+			} else {
+				logger.Infow("Restored cached results", "count", count)
+			}
+		}
+	}
+
+	if negativeTTL := getenv("NEGATIVE_CACHE_TTL", ""); negativeTTL != "" {
+		server.RejectedTTL, err = time.ParseDuration(negativeTTL)
+		if err != nil {
+			logger.Fatalw("Couldn't parse NEGATIVE_CACHE_TTL", "err", err)
+		}
+		size, err := strconv.Atoi(getenv("NEGATIVE_CACHE_SIZE", "10000"))
+		if err != nil || size <= 0 {
+			logger.Fatalw("Couldn't parse NEGATIVE_CACHE_SIZE", "err", err)
+		}
+		server.Rejected = newLRUCache[struct{}](size)
+	}
+	if server.RateLimit, err = newRateLimiter(); err != nil {
+		logger.Fatalw("Couldn't initialize rate limiting", "err", err)
+	}
+	server.BearerRealm = getenv("WWW_AUTHENTICATE_REALM", "")
+	server.BearerDescriptions = getenv("WWW_AUTHENTICATE_DESCRIPTION", "true") == "true"
+	server.LoginURL = getenv("LOGIN_URL", "")
+	server.LoginRedirectParam = getenv("LOGIN_REDIRECT_PARAM", "rd")
+	if getenv("FORBID_INSUFFICIENT_CLAIMS", "false") == "true" {
+		forbidInsufficientClaims()
+	}
 
-	logger.Infow("Starting server", "addr", bindAddr)
-	err = http.ListenAndServe(bindAddr, nil)
+	server.ProxyMode = getenv("PROXY_MODE", proxyModeNginx)
+	switch server.ProxyMode {
+	case proxyModeNginx, proxyModeTraefik, proxyModeCaddy:
+	case proxyModeEnvoy:
+		server.ParamsHeader = getenv("PARAMS_HEADER", "X-Jwt-Auth-Params")
+	default:
+		logger.Fatalw("Unknown PROXY_MODE", "mode", server.ProxyMode)
+	}
 
+	policies, err := newPolicySet(getenv("CONFIG_PATH", ""), getenv("DEFAULT_PARAMS", ""))
 	if err != nil {
-		logger.Fatalw("Error running server", "err", err)
+		logger.Fatalw("Couldn't load policies", "err", err)
+	}
+	server.policies.Store(policies)
+	if getenv("CONFIG_PATH", "") != "" {
+		server.Reloaders = append(server.Reloaders, reloader{name: "policies", reload: server.reloadPolicies})
+	}
+
+	if secret := getenv("EXPLAIN_SECRET", ""); secret != "" {
+		server.ExplainSecret = []byte(secret)
+		server.ExplainHeader = getenv("EXPLAIN_HEADER", "X-Jwt-Auth-Debug")
+	}
+
+	if getenv("ADMIN_TOKEN", "") != "" {
+		size, err := strconv.Atoi(getenv("ADMIN_DECISIONS", "100"))
+		if err != nil || size < 0 {
+			logger.Fatalw("Invalid ADMIN_DECISIONS", "value", getenv("ADMIN_DECISIONS", ""))
+		}
+		if size > 0 {
+			server.Decisions = newDecisionLog(size)
+		}
+	}
+
+	server.ResponseHeaders, err = parseHeaderMapping(getenv("RESPONSE_HEADERS", ""))
+	if err != nil {
+		logger.Fatalw("Couldn't parse RESPONSE_HEADERS", "err", err)
+	}
+	if preset != nil {
+		for header, claimName := range preset.ResponseHeaders {
+			if _, ok := server.ResponseHeaders[header]; !ok {
+				server.ResponseHeaders[header] = claimName
+			}
+		}
+	}
+	server.HeaderFormat = policy.HeaderFormat{
+		Encoding:  getenv("HEADER_ENCODING", policy.EncodingNone),
+		Separator: getenv("HEADER_LIST_SEPARATOR", ""),
+	}
+	switch server.HeaderFormat.Encoding {
+	case policy.EncodingNone, policy.EncodingBase64, policy.EncodingPercent:
+	default:
+		logger.Fatalw("Invalid HEADER_ENCODING, expected base64 or percent", "value", server.HeaderFormat.Encoding)
+	}
+	server.ForwardTokenHeader = getenv("FORWARD_TOKEN_HEADER", "")
+	server.ForwardAuthorization = getenv("FORWARD_AUTHORIZATION", "false") == "true"
+	if server.ClaimsHeader, err = newClaimsHeader(); err != nil {
+		logger.Fatalw("Couldn't configure the claims header", "err", err)
+	}
+	server.MetricIssuers = make(map[string]bool)
+	known := append([]string{getenv("JWT_ISSUER", ""), getenv("OIDC_ISSUER", "")}, splitList(getenv("ALLOWED_ISSUERS", ""))...)
+	known = append(known, splitList(getenv("METRICS_ISSUERS", ""))...)
+	for _, issuer := range issuers {
+		known = append(known, issuer.Issuer)
+	}
+	for _, issuer := range known {
+		if issuer != "" {
+			server.MetricIssuers[issuer] = true
+		}
 	}
+	return server, warm
 }
 
 type server struct {
-	Keyfunc jwt.Keyfunc
-	Logger  logger.Logger
+	validator.Validator
+	Logger          logger.Logger
+	Client          *http.Client
+	ProxyMode       string
+	ParamsHeader    string
+	ResponseHeaders map[string]string
+	Login           *oidcLogin
+	// HeaderFormat is how claims are turned into header values.
+	HeaderFormat policy.HeaderFormat
+	// ClaimsHeader carries the claims as a whole, nil if disabled.
+	ClaimsHeader *claimsHeader
+	// ForwardTokenHeader carries the token to the upstream, if set, and
+	// with ForwardAuthorization the Authorization header does as a bearer
+	// token. The forward_token and forward_authorization params replace
+	// them for a request.
+	ForwardTokenHeader   string
+	ForwardAuthorization bool
+	// TokenHeader is read instead of the Authorization header when set,
+	// after stripping TokenPrefix off its value. The header and
+	// header_prefix params replace them for a request.
+	TokenHeader string
+	TokenPrefix string
+	// TokenQuery names a query param of the original request to take the
+	// token from, before any other, if the request has it. The query param
+	// replaces it for a request.
+	TokenQuery string
+	// TokenSources, if set, are tried in order instead, unless params
+	// name where the token is.
+	TokenSources []tokenSource
+	// CookieChunks reassembles tokens split across numbered cookies.
+	CookieChunks bool
+	// Introspection verifies tokens that aren't JWTs, nil if disabled.
+	Introspection *introspector
+	// Extractors are asked for the token first, the first one found is used.
+	Extractors []extension.Extractor
+	// Results caches verified claims, nil disables caching.
+	Results *cachedResults
+	// Rejected holds the hashes of tokens that failed verification within
+	// RejectedTTL, so retries are refused without verifying them again.
+	Rejected    *lruCache[struct{}]
+	RejectedTTL time.Duration
+	// RateLimit limits how often each client has a token validated, nil
+	// if unlimited.
+	RateLimit *rateLimiter
+	// MetricIssuers are the issuers denials are counted by, those of other
+	// tokens are counted as other.
+	MetricIssuers map[string]bool
+	// Tracer starts the spans of /validate requests, a noop one unless
+	// tracing is enabled.
+	Tracer trace.Tracer
+
+	// policies are the named policies and DEFAULT_PARAMS, swapped as a
+	// whole on reload.
+	policies atomic.Pointer[policySet]
+	// BatchMaxTokens and BatchMaxBytes bound the size of batch requests.
+	BatchMaxTokens int
+	BatchMaxBytes  int64
+	params         *lruCache[*parsedParams]
+
+	verifications singleflight.Group
+	// Decisions records recent decisions for the admin API, nil disables
+	// recording. Reloaders are run on an admin's request.
+	Decisions *decisionLog
+	Reloaders []reloader
+	// Revocations deny tokens by jti or sub, nil if none can be revoked.
+	Revocations *revocations
+	// Denials are explained to requests carrying ExplainHeader, signed with
+	// ExplainSecret, as well as to those with explain=true params.
+	ExplainSecret []byte
+	ExplainHeader string
+	// BearerRealm is the realm of the WWW-Authenticate header of denials,
+	// which describe the reason if BearerDescriptions is set.
+	BearerRealm        string
+	BearerDescriptions bool
+	// LoginURL is where browsers without a valid token are redirected to,
+	// with the URL they requested in the LoginRedirectParam. Empty
+	// disables redirects.
+	LoginURL           string
+	LoginRedirectParam string
+	// Authorizers decide on the original request once the claims satisfy
+	// all requirements. Every one of them has to allow it.
+	Authorizers []authorizer
 }
 
-func newServer(logger logger.Logger, jwksPath string, jwksUrl string) (*server, error) {
+// Formats of the key set at JWKS_URL
+const (
+	keysFormatJWKS = "jwks"
+	// Google's map of key ids to PEM encoded certificates
+	keysFormatX509 = "x509"
+)
+
+func newServer(logger logger.Logger, client *http.Client, jwksPath string, jwksUrl string, jwksFormat string, warm *warmCache) (*server, error) {
 	var kf jwt.Keyfunc
 
+	var reloaders []reloader
 	if jwksPath != "" {
-		// Read the EC public key from the file
-		keyBytes, err := ioutil.ReadFile(jwksPath)
-		if err != nil {
-			return nil, fmt.Errorf("Couldn't read EC public key from file: %s. Error: %s", jwksPath, err.Error())
+		// The key in the file, reread on reload
+		key := &staticKey{path: jwksPath, format: getenv("JWKS_PATH_FORMAT", keyFormatPEM)}
+		if key.format != keyFormatPEM && key.format != keyFormatHMAC {
+			return nil, fmt.Errorf("unknown JWKS_PATH_FORMAT %q", key.format)
 		}
-
-		// Parse the EC public key
-		block, _ := pem.Decode(keyBytes)
-		if block == nil {
-			return nil, fmt.Errorf("Failed to parse PEM block containing the EC public key")
+		if err := key.reload(); err != nil {
+			return nil, err
 		}
-
-		pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+		kf = key.Keyfunc
+		reloaders = append(reloaders, reloader{name: "key", reload: key.reload})
+	} else if urls := splitList(jwksUrl); len(urls) > 1 {
+		timeout, err := time.ParseDuration(getenv("JWKS_INIT_TIMEOUT", "10s"))
 		if err != nil {
-			return nil, fmt.Errorf("Failed to parse EC public key: %s", err.Error())
+			return nil, fmt.Errorf("invalid JWKS_INIT_TIMEOUT: %w", err)
 		}
-
-		ecPubKey, ok := pubKey.(*ecdsa.PublicKey)
-		if !ok {
-			return nil, fmt.Errorf("Given key is not an EC public key")
+		opts, err := newKeySourceOptions(client, logger, jwksFormat, warm)
+		if err != nil {
+			return nil, err
 		}
-
-		// Set the Keyfunc to use the EC public key
-		kf = func(token *jwt.Token) (interface{}, error) {
-			return ecPubKey, nil
+		sources, err := loadKeySources(opts, urls, timeout)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		jwks, err := keyfunc.Get(jwksUrl, keyfunc.Options{
-			RefreshInterval: time.Hour,
-			RefreshErrorHandler: func(err error) {
-				log.Printf("There was an error with the jwt.KeyFunc\nError: %s", err.Error())
-			},
-		})
+		kf = sources.Keyfunc
+	} else if jwksUrl != "" {
+		opts, err := newKeySourceOptions(client, logger, jwksFormat, warm)
+		if err != nil {
+			return nil, err
+		}
+		kf, err = loadKeySource(opts, jwksUrl)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create JWKS from resource at the given URL.\nError: %s", err.Error())
+			return nil, err
 		}
-		kf = jwks.Keyfunc
 	}
 
 	return &server{
-		Keyfunc: kf,
-		Logger:  logger,
+		Validator: validator.Validator{Keyfunc: kf},
+		Logger:    logger,
+		Client:    client,
+		params:    newLRUCache[*parsedParams](maxCachedParams),
+		Reloaders: reloaders,
+		Tracer:    noopTracer,
 	}, nil
 }
 
+// parseHeaderMapping parses a comma separated list of header=claim pairs.
+func parseHeaderMapping(value string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	for _, pair := range splitList(value) {
+		header, claimName, found := strings.Cut(pair, "=")
+		if !found || header == "" || claimName == "" {
+			return nil, fmt.Errorf("invalid header mapping %q, expected header=claim", pair)
+		}
+		mapping[strings.TrimSpace(header)] = strings.TrimSpace(claimName)
+	}
+	return mapping, nil
+}
+
 func getenv(key, fallback string) string {
+	loadedConfig.useEnv(key)
 	value := os.Getenv(key)
 	if len(value) == 0 {
 		return fallback
@@ -164,198 +878,235 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 
 func (s *server) validate(rw http.ResponseWriter, r *http.Request) {
 	w := &statusWriter{ResponseWriter: rw}
-	defer func() {
-		if r := recover(); r != nil {
-			s.Logger.Errorw("Recovered panic", "err", r)
-			requestsTotal.WithLabelValues("500").Inc()
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		s.Logger.Debugw("Handled validation request", "url", r.URL, "status", w.status, "method", r.Method, "userAgent", r.UserAgent())
-	}()
-
-	if r.Method != http.MethodGet && r.Method != http.MethodHead {
-		s.Logger.Infow("Invalid method", "method", r.Method)
-		requestsTotal.WithLabelValues("405").Inc()
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
+	if s.Logger.DebugEnabled() {
+		defer func() {
+			s.Logger.Debugw("Handled validation request", "url", r.URL, "status", w.status, "method", r.Method, "userAgent", r.UserAgent(), "original", s.originalRequest(r))
+		}()
 	}
 
-	claims, ok := s.validateDeviceToken(r)
-	if !ok {
-		requestsTotal.WithLabelValues("401").Inc()
-		w.WriteHeader(http.StatusUnauthorized)
+	r, span := s.startSpan(r)
+	params, policy := s.requestParams(r)
+	token, claims, err := s.validateRequest(r, params, policy)
+	defer endSpan(span, w, err)
+	if s.Decisions != nil {
+		s.Decisions.record(s, r, params, claims, err)
+	}
+	if err != nil {
+		d := denialOf(err)
+		s.logDenial(err, d, token)
+		if s.explains(r, params) {
+			s.writeExplanation(w, r, err, d)
+		}
+		requestsTotal.WithLabelValues(strconv.Itoa(d.status)).Inc()
+		if location := s.loginLocation(r, params, d); location != "" {
+			s.writeLoginRedirect(w, r, location)
+			return
+		}
+		s.setBearerChallenge(w, d)
+		s.writeDenied(w, d.status)
 		return
 	}
 
 	requestsTotal.WithLabelValues("200").Inc()
-	s.writeResponseHeaders(w, r, claims)
+	s.writeResponseHeaders(w, params, token, claims)
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *server) validateDeviceToken(r *http.Request) (claims jwt.MapClaims, ok bool) {
-	t := time.Now()
-	defer validationTime.Observe(time.Since(t).Seconds())
-	
-	var jwtB64 string
-	var err error
-	
-	cookieName := r.URL.Query().Get("cookie")
-	if cookieName != "" {
-		cookie, err := r.Cookie(cookieName)
-		if err != nil {
-			s.Logger.Errorw("Failed to extract token from cookie", "err", err)
-			return nil, false
-		}
-		jwtB64 = cookie.Value
-	} else {
-		jwtB64, err = request.AuthorizationHeaderExtractor.ExtractToken(r)
-		if err != nil {
-			s.Logger.Errorw("Failed to extract token from Autorization header", "err", err)
-			return nil, false		
-		}
+// validateRequest returns the token of r and its claims if the request is
+// allowed, and otherwise why not. The token is returned then too, if r has
+// one.
+func (s *server) validateRequest(r *http.Request, params url.Values, policy *policy.Policy) (string, jwt.MapClaims, error) {
+	if !s.methodAllowed(r) {
+		return "", nil, fmt.Errorf("%w: %s", ErrMethod, r.Method)
 	}
-	token, err := jwt.Parse(jwtB64, s.Keyfunc)
-
+	token, claims, err := s.validateDeviceToken(r, params, policy)
 	if err != nil {
-		s.Logger.Debugw("Failed to parse token", "err", err)
-		return nil, false
+		return token, nil, err
 	}
-	if !token.Valid {
-		s.Logger.Debugw("Invalid token", "token", token.Raw)
-		return nil, false
+	if err := s.authorize(claims, s.originalRequest(r)); err != nil {
+		return token, nil, err
 	}
-	if err := token.Claims.Valid(); err != nil {
-		s.Logger.Debugw("Got invalid claims", "err", err)
-		return nil, false
+	return token, claims, nil
+}
+
+// validateDeviceToken returns the token of r along with its claims.
+func (s *server) validateDeviceToken(r *http.Request, params url.Values, policy *policy.Policy) (string, jwt.MapClaims, error) {
+	for _, extract := range s.Extractors {
+		if token := extract(r); token != "" {
+			claims, err := s.validateLimited(r, token, policy)
+			return token, claims, err
+		}
 	}
 
-	ok = s.queryStringClaimValidator(token.Claims.(jwt.MapClaims), r)
+	jwtB64, err := s.extractToken(r, s.tokenSources(params))
+	if err != nil {
+		return "", nil, err
+	}
+	claims, err := s.validateLimited(r, jwtB64, policy)
+	return jwtB64, claims, err
+}
 
-	if !ok {
-		return nil, false
+// validateLimited is validateToken for a token of r, as far as the
+// RateLimit lets the client have it verified.
+func (s *server) validateLimited(r *http.Request, jwtB64 string, policy *policy.Policy) (jwt.MapClaims, error) {
+	if s.RateLimit == nil {
+		return s.validateToken(r.Context(), jwtB64, policy)
+	}
+	if err := s.RateLimit.allow(r); err != nil {
+		return nil, err
+	}
+	claims, err := s.validateToken(r.Context(), jwtB64, policy)
+	if err = s.RateLimit.verified(r, claims, err); err != nil {
+		return nil, err
 	}
-	return token.Claims.(jwt.MapClaims), true
+	return claims, nil
 }
 
-func (s *server) queryStringClaimValidator(claims jwt.MapClaims, r *http.Request) bool {
-	validClaims := r.URL.Query()
-	hasClaimsPrefixedKey := false
-	for key := range validClaims {
-		if strings.HasPrefix(key, "claims_") {
-			hasClaimsPrefixedKey = true
-		}
-	}
-	if len(validClaims) == 0 || !hasClaimsPrefixedKey {
-		s.Logger.Warnw("No claims requirements set, skiping", "queryParams", validClaims)
-		return true
-	}
-	s.Logger.Debugw("Validating claims from query string", "validClaims", validClaims)
-
-	for claimNameQ, validPatterns := range validClaims {
-		if strings.HasPrefix(claimNameQ, "claims_") {
-			claimName := strings.TrimPrefix(claimNameQ, "claims_")
-			s.Logger.Debugw("CLAIM", "claim", claimName, "vv", validPatterns,
-				"qd", validClaims)
-			isRegExp := false
-			if strings.HasPrefix(claimName, "regexp_") {
-				claimName = strings.TrimPrefix(claimName, "regexp_")
-				isRegExp = true
-			}
-			if !s.checkClaim(claimName, validPatterns, claims, isRegExp) {
-				s.Logger.Debugw("Token claims did not match required values", "validClaims", validClaims, "actualClaims", claims)
-				return false
-			}
+// authorize runs the Authorizers, every one of them has to allow req.
+func (s *server) authorize(claims jwt.MapClaims, req originalRequest) error {
+	for _, authorize := range s.Authorizers {
+		allowed, err := authorize(claims, req)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrAuthorization, err)
+		}
+		if !allowed {
+			return ErrNotAuthorized
 		}
 	}
-	return true
+	return nil
 }
 
-func (s *server) checkClaim(
-	claimName string, validPatterns []string, claims jwt.MapClaims, isRegExp bool,
-) bool {
-	claimObj := claims[claimName]
-
-	switch claimVal := claimObj.(type) {
-	case string:
-		if contains(validPatterns, claimVal, isRegExp) {
-			return true
-		}
-	case []interface{}:
-		//short exit if there are restrictions on claim but no claims exist
-		if len(claimVal) == 0 && len(validPatterns) > 0 {
-			return false
-		}
-		// fill an actualClaims[] from  interface[]
-		actualClaims := make([]string, len(claimVal))
-		for i, e := range claimVal {
-			claim := e.(string)
-			actualClaims[i] = claim
-		}
-		for _, actualClaim := range actualClaims {
-			for _, validPattern := range validPatterns {
-				if contains([]string{validPattern}, actualClaim, isRegExp) {
-					return true
+// validateToken verifies jwtB64 and checks its claims against policy. What
+// it finds is recorded on the span of ctx, if any.
+func (s *server) validateToken(ctx context.Context, jwtB64 string, policy *policy.Policy) (jwt.MapClaims, error) {
+	t, cycles := time.Now(), gcCycles()
+	defer func() {
+		elapsed := time.Since(t).Seconds()
+		validationTime.Observe(elapsed)
+		if gcCycles() != cycles {
+			validationTimeDuringGC.Observe(elapsed)
+		}
+	}()
+	traceToken(ctx, jwtB64)
+
+	var hash string
+	if s.Rejected != nil {
+		hash = tokenHash(jwtB64)
+		if _, rejected := s.Rejected.get(hash); rejected {
+			traceCache(ctx, "negative_hit")
+			return nil, ErrCachedRejection
+		}
+	}
+
+	var claims jwt.MapClaims
+	var found bool
+	if s.Results != nil {
+		claims, found = s.Results.get(jwtB64)
+		traceCache(ctx, cacheResult(claims, found))
+	}
+	if !found {
+		// Concurrent requests with the same token share one verification
+		result, err, _ := s.verifications.Do(jwtB64, func() (interface{}, error) {
+			return s.verify(jwtB64)
+		})
+		// Valid, but an enricher failed open: the claims lacking its
+		// enrichment are used for this request without being cached
+		incomplete := errors.Is(err, validator.ErrIncomplete)
+		if incomplete {
+			s.Logger.Warnw("Accepting token with incomplete claims", "err", err)
+		} else if err != nil {
+			// Enrichment and introspection failures are usually transient
+			// and not worth caching, as are key lookups failing while the
+			// key set lags behind a rotation
+			noKey := errors.Is(err, jwt.ErrTokenUnverifiable) && !errors.Is(err, validator.ErrAlgorithm)
+			if !errors.Is(err, validator.ErrEnrichment) && !errors.Is(err, ErrIntrospection) && !noKey {
+				if s.Results != nil {
+					s.Results.set(jwtB64, nil)
+				}
+				if s.Rejected != nil {
+					s.Rejected.set(hash, struct{}{}, s.RejectedTTL)
 				}
 			}
+			return nil, err
 		}
-	default:
-		fmt.Errorf("I don't know how to handle claim object %T\n", claimObj)
-		return false
+		claims = result.(jwt.MapClaims)
+		if s.Results != nil && !incomplete {
+			s.Results.set(jwtB64, claims)
+		}
+	}
+	if claims == nil {
+		return nil, ErrCachedRejection
+	}
+	if err := s.checkRevoked(claims); err != nil {
+		return nil, err
 	}
 
-	return false
+	if err := s.queryStringClaimValidator(claims, policy); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (s *server) queryStringClaimValidator(claims jwt.MapClaims, policy *policy.Policy) error {
+	if policy.Empty() {
+		s.Logger.Warnw("No claims requirements set, skiping")
+		return nil
+	}
+	if !policy.Allows(claims) {
+		return fmt.Errorf("%w: %w", validator.ErrPolicy, policy.Check(claims))
+	}
+	return nil
 }
 
 func (s *server) writeResponseHeaders(
-	w *statusWriter, r *http.Request, claims jwt.MapClaims,
+	w *statusWriter, parameters url.Values, token string, claims jwt.MapClaims,
 ) {
+	values := s.responseHeaderValues(parameters, claims)
+	s.forwardToken(values, parameters, token)
+	for header, value := range values {
+		w.Header().Add(header, value)
+	}
+}
 
-	var responseHeaders = make(map[string]string)
-	parameters := r.URL.Query()
-	for key, value := range parameters {
-		if strings.HasPrefix(key, "headers_") {
-			header := strings.TrimPrefix(key, "headers_")
-			responseHeaders[header] = value[0]
+// responseHeaderValues maps the configured response headers to their
+// encoded claim values. headers_* params take precedence over
+// ResponseHeaders, and header templates take precedence over both. The
+// ClaimsHeader is added to them.
+func (s *server) responseHeaderValues(parameters url.Values, claims jwt.MapClaims) map[string]string {
+	values := policy.FormatHeaders(s.ResponseHeaders, parameters, claims, s.HeaderFormat)
+	s.renderHeaderTemplates(values, parameters, claims)
+	if s.ClaimsHeader != nil {
+		if value, ok := s.ClaimsHeader.value(claims); ok {
+			values[s.ClaimsHeader.Name] = value
 		}
 	}
-	s.Logger.Debugw("responseHeaders", "rh", responseHeaders)
-	if responseHeaders == nil {
-		return
+	return values
+}
+
+// responseHeaderNames lists the headers responseHeaderValues may set for
+// parameters, whether or not the claims they carry are there.
+func (s *server) responseHeaderNames(parameters url.Values) []string {
+	var names []string
+	for header := range s.ResponseHeaders {
+		names = append(names, header)
 	}
-	for header, claimName := range responseHeaders {
-		claim, ok := claims[claimName]
-		if !ok {
-			continue
-		}
-		var toClaim []byte
-		if sClaim, ok := claim.(string); ok {
-			toClaim = ([]byte)(sClaim)
-		} else {
-			var err error
-			toClaim, err = json.Marshal(claim)
-			if err != nil {
-				continue
-			}
+	for key := range parameters {
+		if header, _, ok := policy.HeaderParam(key); ok {
+			names = append(names, header)
 		}
-		encClaim := string(toClaim)
-		s.Logger.Debugw("add response header", "header", header, "claim", claim, "encClaim", encClaim)
-		w.Header().Add(header, encClaim)
 	}
-}
-
-func contains(haystack []string, needle string, isRegExp bool) bool {
-	for _, validPattern := range haystack {
-		if isRegExp == true {
-			matched, err := regexpcache.MatchString(validPattern, needle)
-			if err != nil {
-				fmt.Errorf("unable to compile pattern %v to match claim %v , error %v\n", validPattern, needle, err)
-			}
-			if matched {
-				return true
+	if set := s.policies.Load(); set != nil {
+		for header := range set.templates {
+			names = append(names, header)
+		}
+		if named, ok := set.named[parameters.Get("policy")]; ok {
+			for header := range named.templates {
+				names = append(names, header)
 			}
-		} else if validPattern == needle {
-			return true
 		}
 	}
-	return false
+	if s.ClaimsHeader != nil {
+		names = append(names, s.ClaimsHeader.Name)
+	}
+	return names
 }
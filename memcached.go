@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+// memcachedCache is the memcached counterpart of redisCache, with the same
+// keys, encoding and error handling.
+type memcachedCache struct {
+	client *memcache.Client
+	logger logger.Logger
+}
+
+func newMemcachedCache(logger logger.Logger) (*memcachedCache, error) {
+	addrs := splitList(getenv("MEMCACHED_ADDRS", "localhost:11211"))
+	if len(addrs) == 0 {
+		return nil, errors.New("no MEMCACHED_ADDRS")
+	}
+	client := memcache.New(addrs...)
+	client.Timeout = 100 * time.Millisecond
+	return &memcachedCache{client: client, logger: logger}, nil
+}
+
+func (c *memcachedCache) get(key string) (jwt.MapClaims, bool) {
+	item, err := c.client.Get(redisKeyPrefix + key)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil, false
+	}
+	if err != nil {
+		c.logger.Warnw("Failed to read from memcached", "err", err)
+		return nil, false
+	}
+	claims, err := decodeResult(item.Value)
+	if err != nil {
+		c.logger.Warnw("Failed to decode cached result", "err", err)
+		return nil, false
+	}
+	return claims, true
+}
+
+func (c *memcachedCache) set(key string, claims jwt.MapClaims, ttl time.Duration) {
+	// memcached expirations have a resolution of seconds, and 0 never expires
+	if ttl < time.Second {
+		return
+	}
+	value, err := encodeResult(claims)
+	if err != nil {
+		c.logger.Warnw("Failed to encode result", "err", err)
+		return
+	}
+	item := &memcache.Item{Key: redisKeyPrefix + key, Value: value, Expiration: memcachedExpiration(ttl)}
+	if err := c.client.Set(item); err != nil {
+		c.logger.Warnw("Failed to write to memcached", "err", err)
+	}
+}
+
+// memcachedMaxRelative is the longest expiration memcached takes as
+// relative; longer ones are read as absolute Unix times.
+const memcachedMaxRelative = 30 * 24 * time.Hour
+
+// memcachedExpiration is the item expiration for ttl, as seconds from now up
+// to 30 days and as the Unix time of expiry beyond.
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl > memcachedMaxRelative {
+		return int32(min(time.Now().Add(ttl).Unix(), math.MaxInt32))
+	}
+	return int32(ttl / time.Second)
+}
@@ -0,0 +1,101 @@
+// Package middleware enforces nginx-jwt-auth validation parameters in a Go
+// service, for the requests that no longer pass through nginx.
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/golang-jwt/jwt/v5/request"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+type contextKey struct{}
+
+// New returns middleware that passes requests on to the next handler only
+// if they carry a token v accepts, whose claims satisfy the claims_* params.
+// The token is read from the first cookie present of those the cookie param
+// lists, comma separated, or else from the Authorization header, like the
+// service does.
+//
+// The headers_* params are set as request headers for the next handler,
+// replacing any the client sent, just like nginx would forward them after
+// auth_request. The claims are also available through Claims.
+//
+// Requests without a valid token are answered with 401, those whose claims
+// don't satisfy the params with 403.
+func New(v *validator.Validator, params url.Values) (func(http.Handler) http.Handler, error) {
+	p, err := policy.Compile(params)
+	if err != nil {
+		return nil, err
+	}
+	var cookies []string
+	for _, value := range params["cookie"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				cookies = append(cookies, name)
+			}
+		}
+	}
+	var forwarded []string
+	for key := range params {
+		if header, _, ok := policy.HeaderParam(key); ok {
+			forwarded = append(forwarded, header)
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, err := extractToken(r, cookies)
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+			claims, err := v.Validate(token, p)
+			if errors.Is(err, validator.ErrPolicy) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+
+			r = r.Clone(context.WithValue(r.Context(), contextKey{}, claims))
+			// Never let clients set the headers that carry claims
+			for _, header := range forwarded {
+				r.Header.Del(header)
+			}
+			for header, value := range policy.Headers(nil, params, claims) {
+				r.Header.Set(header, value)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}, nil
+}
+
+// Claims returns the claims of the token the middleware accepted for the
+// request of ctx.
+func Claims(ctx context.Context) (jwt.MapClaims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(jwt.MapClaims)
+	return claims, ok
+}
+
+// extractToken returns the value of the first of cookies that r has, or
+// without cookies the Authorization header's token.
+func extractToken(r *http.Request, cookies []string) (string, error) {
+	if len(cookies) == 0 {
+		return request.AuthorizationHeaderExtractor.ExtractToken(r)
+	}
+	for _, cookie := range cookies {
+		if c, err := r.Cookie(cookie); err == nil && c.Value != "" {
+			return c.Value, nil
+		}
+	}
+	return "", http.ErrNoCookie
+}
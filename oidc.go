@@ -0,0 +1,397 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const loginCookieName = "jwt_auth_login"
+
+// oidcProvider holds the parts of an OpenID Provider's discovery document
+// that are used here.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	EndSessionEndpoint    string `json:"end_session_endpoint"`
+}
+
+// discoverOIDC fetches the discovery document of issuer. All endpoints it
+// names are checked against the outbound policy, since a compromised or
+// misconfigured discovery document could otherwise point us anywhere.
+func discoverOIDC(client *http.Client, outbound *outboundPolicy, issuer string) (*oidcProvider, error) {
+	wellKnown := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	if err := outbound.checkURL(wellKnown); err != nil {
+		return nil, err
+	}
+	resp, err := client.Get(wellKnown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch %s: %w", wellKnown, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch %s: status %d", wellKnown, resp.StatusCode)
+	}
+
+	var provider oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&provider); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", wellKnown, err)
+	}
+	if provider.Issuer != issuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", provider.Issuer, issuer)
+	}
+	for _, endpoint := range []string{provider.JWKSURI, provider.TokenEndpoint, provider.UserinfoEndpoint, provider.EndSessionEndpoint} {
+		if endpoint == "" {
+			continue
+		}
+		if err := outbound.checkURL(endpoint); err != nil {
+			return nil, fmt.Errorf("discovered endpoint rejected: %w", err)
+		}
+	}
+	return &provider, nil
+}
+
+// discoveredKeys is the key set the discovery document of an issuer names.
+// Only tokens of that issuer are verified with it. The document is fetched
+// again periodically, so the provider may move its key set.
+type discoveredKeys struct {
+	issuer  string
+	keyfunc atomic.Pointer[jwt.Keyfunc]
+	// url is the location of the key set in use
+	url string
+}
+
+func newDiscoveredKeys(provider *oidcProvider, kf jwt.Keyfunc) *discoveredKeys {
+	keys := &discoveredKeys{issuer: provider.Issuer, url: provider.JWKSURI}
+	keys.keyfunc.Store(&kf)
+	return keys
+}
+
+func (k *discoveredKeys) Keyfunc(token *jwt.Token) (interface{}, error) {
+	if iss, _ := token.Claims.GetIssuer(); iss != k.issuer {
+		return nil, fmt.Errorf("%w %q, expected %q", errUnknownIssuer, iss, k.issuer)
+	}
+	return (*k.keyfunc.Load())(token)
+}
+
+// rediscover fetches the discovery document every interval and switches to
+// the key set it names if that moved. The previous key set keeps being
+// refreshed, as providers rarely move theirs.
+func (k *discoveredKeys) rediscover(opts keySourceOptions, outbound *outboundPolicy, interval time.Duration) {
+	for range time.Tick(interval) {
+		provider, err := discoverOIDC(opts.client, outbound, k.issuer)
+		if err != nil {
+			opts.logger.Warnw("OIDC discovery failed, keeping the key set", "issuer", k.issuer, "err", err)
+			continue
+		}
+		if provider.JWKSURI == k.url {
+			continue
+		}
+		kf, err := loadKeySource(opts, provider.JWKSURI)
+		if err != nil {
+			opts.logger.Errorw("Failed to load the key set of the discovery document", "url", provider.JWKSURI, "err", err)
+			continue
+		}
+		k.keyfunc.Store(&kf)
+		opts.logger.Infow("Key set moved", "issuer", k.issuer, "from", k.url, "to", provider.JWKSURI)
+		k.url = provider.JWKSURI
+	}
+}
+
+// oidcLogin implements the authorization code flow with PKCE. The session
+// cookie it sets holds the ID token, which /validate then accepts.
+type oidcLogin struct {
+	Provider     *oidcProvider
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       string
+	CookieName   string
+	CookieDomain string
+	CookieSecure bool
+	// PostLogoutRedirectURL is sent to the provider's end_session_endpoint
+	// and has to be registered there.
+	PostLogoutRedirectURL string
+	// IdPLogout ends the session at the provider as well on /logout.
+	IdPLogout bool
+	// Secret signs the short-lived cookie carrying state between /login
+	// and /callback.
+	Secret []byte
+}
+
+type loginState struct {
+	State    string `json:"s"`
+	Verifier string `json:"v"`
+	Nonce    string `json:"n"`
+	Redirect string `json:"rd"`
+}
+
+func (s *server) login(w http.ResponseWriter, r *http.Request) {
+	l := s.Login
+	state := loginState{
+		State:    randomString(),
+		Verifier: randomString(),
+		Nonce:    randomString(),
+		Redirect: l.safeRedirect(r.URL.Query().Get("rd")),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    l.sign(state),
+		Path:     "/",
+		Domain:   l.CookieDomain,
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		Secure:   l.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {l.ClientID},
+		"redirect_uri":          {l.RedirectURL},
+		"scope":                 {l.Scopes},
+		"state":                 {state.State},
+		"nonce":                 {state.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, appendQuery(l.Provider.AuthorizationEndpoint, query), http.StatusFound)
+}
+
+func (s *server) callback(w http.ResponseWriter, r *http.Request) {
+	l := s.Login
+	query := r.URL.Query()
+	if errCode := query.Get("error"); errCode != "" {
+		s.Logger.Infow("Authorization failed", "error", errCode, "description", query.Get("error_description"))
+		http.Error(w, "authorization failed", http.StatusForbidden)
+		return
+	}
+
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil {
+		http.Error(w, "missing login state", http.StatusBadRequest)
+		return
+	}
+	state, err := l.verify(cookie.Value)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.State), []byte(query.Get("state"))) != 1 {
+		s.Logger.Infow("Invalid login state", "err", err)
+		http.Error(w, "invalid login state", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Path: "/", Domain: l.CookieDomain, MaxAge: -1})
+
+	idToken, err := s.exchangeCode(query.Get("code"), state.Verifier)
+	if err != nil {
+		s.Logger.Errorw("Failed to exchange authorization code", "err", err)
+		http.Error(w, "failed to exchange authorization code", http.StatusBadGateway)
+		return
+	}
+	claims, err := s.verifyIDToken(idToken, state.Nonce)
+	if err != nil {
+		s.Logger.Infow("Invalid ID token", "err", err)
+		http.Error(w, "invalid ID token", http.StatusForbidden)
+		return
+	}
+
+	maxAge := 0
+	if exp, ok := claims["exp"].(float64); ok {
+		maxAge = int(time.Until(time.Unix(int64(exp), 0)).Seconds())
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     l.CookieName,
+		Value:    idToken,
+		Path:     "/",
+		Domain:   l.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   l.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	s.Logger.Debugw("Login completed", "sub", claims["sub"])
+	http.Redirect(w, r, state.Redirect, http.StatusFound)
+}
+
+// logout clears the session cookie and, if the provider supports
+// RP-initiated logout, ends the session there too. It only accepts POST, so
+// other sites can't log users out with a link or image.
+func (s *server) logout(w http.ResponseWriter, r *http.Request) {
+	l := s.Login
+	var idToken string
+	if cookie, err := r.Cookie(l.CookieName); err == nil {
+		idToken = cookie.Value
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     l.CookieName,
+		Path:     "/",
+		Domain:   l.CookieDomain,
+		MaxAge:   -1,
+		Secure:   l.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	redirect := l.safeRedirect(r.FormValue("rd"))
+	if l.IdPLogout && l.Provider.EndSessionEndpoint != "" {
+		query := url.Values{"client_id": {l.ClientID}}
+		if idToken != "" {
+			query.Set("id_token_hint", idToken)
+		}
+		if l.PostLogoutRedirectURL != "" {
+			query.Set("post_logout_redirect_uri", l.PostLogoutRedirectURL)
+		}
+		redirect = appendQuery(l.Provider.EndSessionEndpoint, query)
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (s *server) exchangeCode(code, verifier string) (string, error) {
+	l := s.Login
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {l.RedirectURL},
+		"client_id":     {l.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, l.Provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if l.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(l.ClientID), url.QueryEscape(l.ClientSecret))
+	}
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("failed to decode token response (status %d): %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint returned status %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return tokens.IDToken, nil
+}
+
+func (s *server) verifyIDToken(idToken, nonce string) (jwt.MapClaims, error) {
+	// The configured options, e.g. CLOCK_SKEW_LEEWAY, with the issuer and
+	// audience of ID tokens taking precedence
+	options := append(slices.Clip(s.ParserOptions), jwt.WithIssuer(s.Login.Provider.Issuer), jwt.WithAudience(s.Login.ClientID), jwt.WithIssuedAt())
+	token, err := jwt.Parse(idToken, s.Keyfunc, options...)
+	if err != nil {
+		return nil, err
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	if claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	return claims, nil
+}
+
+// safeRedirect only allows local paths and URLs on the cookie domain as
+// post-login destinations, so /login can't be used as an open redirect.
+func (l *oidcLogin) safeRedirect(rd string) string {
+	u, err := url.Parse(rd)
+	if err != nil || rd == "" || ambiguousRedirect(rd) {
+		return "/"
+	}
+	if decoded, err := url.PathUnescape(rd); err != nil || ambiguousRedirect(decoded) {
+		return "/"
+	}
+	if u.Host == "" && u.Scheme == "" && strings.HasPrefix(rd, "/") {
+		return rd
+	}
+	domain := strings.TrimPrefix(l.CookieDomain, ".")
+	if domain != "" && (u.Scheme == "https" || u.Scheme == "http") &&
+		(u.Hostname() == domain || strings.HasSuffix(u.Hostname(), "."+domain)) {
+		return rd
+	}
+	return "/"
+}
+
+// ambiguousRedirect reports whether browsers may read rd as another host
+// than url.Parse does: they treat /\ like //, backslashes like slashes and
+// drop tabs and newlines.
+func ambiguousRedirect(rd string) bool {
+	if len(rd) > 1 && rd[0] == '/' && (rd[1] == '/' || rd[1] == '\\') {
+		return true
+	}
+	return strings.ContainsFunc(rd, func(r rune) bool {
+		return r == '\\' || unicode.IsControl(r)
+	})
+}
+
+func (l *oidcLogin) sign(state loginState) string {
+	payload, _ := json.Marshal(state)
+	mac := hmac.New(sha256.New, l.Secret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (l *oidcLogin) verify(value string) (loginState, error) {
+	var state loginState
+	encPayload, encMAC, found := strings.Cut(value, ".")
+	if !found {
+		return state, errors.New("malformed login cookie")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return state, err
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil {
+		return state, err
+	}
+	mac := hmac.New(sha256.New, l.Secret)
+	mac.Write(payload)
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return state, errors.New("login cookie signature mismatch")
+	}
+	err = json.Unmarshal(payload, &state)
+	return state, err
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func appendQuery(endpoint string, query url.Values) string {
+	if strings.Contains(endpoint, "?") {
+		return endpoint + "&" + query.Encode()
+	}
+	return endpoint + "?" + query.Encode()
+}
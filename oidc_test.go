@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestSafeRedirect(t *testing.T) {
+	l := &oidcLogin{CookieDomain: ".example.com"}
+	for _, test := range []struct {
+		rd, want string
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"/orders?id=1#top", "/orders?id=1#top"},
+		{"https://example.com/orders", "https://example.com/orders"},
+		{"https://app.example.com/", "https://app.example.com/"},
+		{"http://app.example.com/", "http://app.example.com/"},
+		{"https://evil.com/", "/"},
+		{"https://example.com.evil.com/", "/"},
+		{"https://evilexample.com/", "/"},
+		{"javascript://example.com/%0aalert(1)", "/"},
+		{"ftp://app.example.com/", "/"},
+		{"//evil.com/", "/"},
+		{`/\evil.com/`, "/"},
+		{`\\evil.com`, "/"},
+		{"/%2Fevil.com", "/"},
+		{"/%5Cevil.com", "/"},
+		{"/\t/evil.com", "/"},
+		{"/%09/evil.com", "/"},
+		{"https://app.example.com\n.evil.com/", "/"},
+		{"orders", "/"},
+		{"%zz", "/"},
+	} {
+		if got := l.safeRedirect(test.rd); got != test.want {
+			t.Errorf("safeRedirect(%q) = %q, want %q", test.rd, got, test.want)
+		}
+	}
+
+	// Without a cookie domain only local paths are allowed
+	l.CookieDomain = ""
+	if got := l.safeRedirect("https://example.com/"); got != "/" {
+		t.Errorf("safeRedirect without a cookie domain = %q, want /", got)
+	}
+}
+
+func TestAmbiguousRedirect(t *testing.T) {
+	for _, test := range []struct {
+		rd        string
+		ambiguous bool
+	}{
+		{"/orders", false},
+		{"/orders/../x", false},
+		{"https://example.com/a", false},
+		{"//evil.com", true},
+		{`/\evil.com`, true},
+		{`https:\\evil.com`, true},
+		{"/\t/evil.com", true},
+		{"/\r\n/evil.com", true},
+		{"/\x00", true},
+		{"/\u0085", true},
+	} {
+		if got := ambiguousRedirect(test.rd); got != test.ambiguous {
+			t.Errorf("ambiguousRedirect(%q) = %v, want %v", test.rd, got, test.ambiguous)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authorizer decides whether the holder of a valid token may make req.
+type authorizer func(claims jwt.MapClaims, req originalRequest) (bool, error)
+
+// opaInput is the input document sent to OPA.
+type opaInput struct {
+	Claims  jwt.MapClaims   `json:"claims"`
+	Request originalRequest `json:"request"`
+}
+
+// remoteOPA asks an OPA server's Data API for a decision, e.g.
+// http://opa:8181/v1/data/httpapi/authz. The result is either a boolean or
+// an object with an "allow" boolean.
+type remoteOPA struct {
+	url    string
+	client *http.Client
+	server *server
+}
+
+func (o *remoteOPA) authorize(claims jwt.MapClaims, req originalRequest) (bool, error) {
+	payload, err := json.Marshal(map[string]interface{}{"input": opaInput{Claims: claims, Request: req}})
+	if err != nil {
+		return false, err
+	}
+	resp, err := o.client.Post(o.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("OPA returned status %d", resp.StatusCode)
+	}
+	var decision struct {
+		Result     interface{} `json:"result"`
+		DecisionID string      `json:"decision_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decision); err != nil {
+		return false, fmt.Errorf("failed to decode OPA response: %w", err)
+	}
+
+	allowed, err := opaAllowed(decision.Result)
+	if err != nil {
+		return false, err
+	}
+	o.server.Logger.Debugw("OPA decision", "decision_id", decision.DecisionID, "allow", allowed, "sub", claims["sub"])
+	return allowed, nil
+}
+
+// opaAllowed interprets a decision, which is either a boolean or an object
+// with an "allow" boolean. An undefined decision is a deny.
+func opaAllowed(result interface{}) (bool, error) {
+	switch result := result.(type) {
+	case bool:
+		return result, nil
+	case map[string]interface{}:
+		allowed, _ := result["allow"].(bool)
+		return allowed, nil
+	case nil:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected OPA result of type %T", result)
+	}
+}
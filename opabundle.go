@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/open-policy-agent/opa/v1/sdk"
+)
+
+// localOPA evaluates policies in-process. Bundles are downloaded, verified
+// and activated by the OPA SDK as configured in a regular OPA configuration
+// file, so the same bundle server, signing keys and decision log settings
+// as for standalone OPA instances apply.
+type localOPA struct {
+	opa      *sdk.OPA
+	decision string
+	server   *server
+}
+
+// newLocalOPA starts the SDK and waits for the configured bundles to be
+// activated, so no request is evaluated without policy.
+func newLocalOPA(s *server, configFile string, decision string) (*localOPA, error) {
+	config, err := readConfigFile(configFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	opa, err := sdk.New(ctx, sdk.Options{ID: "nginx-jwt-auth", Config: bytes.NewReader(config)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start OPA: %w", err)
+	}
+	return &localOPA{opa: opa, decision: decision, server: s}, nil
+}
+
+func (o *localOPA) authorize(claims jwt.MapClaims, req originalRequest) (bool, error) {
+	result, err := o.opa.Decision(context.Background(), sdk.DecisionOptions{
+		Now:   time.Now(),
+		Path:  o.decision,
+		Input: map[string]interface{}{"claims": map[string]interface{}(claims), "request": req},
+	})
+	if sdk.IsUndefinedErr(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	allowed, err := opaAllowed(result.Result)
+	if err != nil {
+		return false, err
+	}
+	o.server.Logger.Debugw("OPA decision", "decision_id", result.ID, "allow", allowed, "sub", claims["sub"])
+	return allowed, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// introspector asks an OAuth 2.0 introspection endpoint (RFC 7662) about
+// opaque access tokens, which can't be verified locally.
+type introspector struct {
+	Client       *http.Client
+	Endpoint     string
+	ClientID     string
+	ClientSecret string
+	// MaxTTL caps how long active tokens are cached; their exp caps it
+	// further.
+	MaxTTL time.Duration
+
+	cache *ttlCache[jwt.MapClaims]
+}
+
+func newIntrospector(client *http.Client, endpoint string) (*introspector, error) {
+	ttl, err := time.ParseDuration(getenv("INTROSPECTION_CACHE_TTL", "1m"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse INTROSPECTION_CACHE_TTL: %w", err)
+	}
+	return &introspector{
+		Client:       client,
+		Endpoint:     endpoint,
+		ClientID:     getenv("INTROSPECTION_CLIENT_ID", ""),
+		ClientSecret: getenv("INTROSPECTION_CLIENT_SECRET", ""),
+		MaxTTL:       ttl,
+		cache:        newTTLCache[jwt.MapClaims](10000),
+	}, nil
+}
+
+// introspect returns the claims of an active token. The response members
+// of RFC 7662 are named like the claims of a JWT, so they are checked and
+// matched alike.
+func (i *introspector) introspect(raw string) (jwt.MapClaims, error) {
+	key := tokenHash(raw)
+	if claims, ok := i.cache.get(key); ok {
+		// Normalization and enrichment change them in place
+		return maps.Clone(claims), nil
+	}
+	claims, err := i.fetch(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrIntrospection, err)
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, ErrInactive
+	}
+	delete(claims, "active")
+	if ttl := ttlUntilExpiry(claims, i.MaxTTL); ttl > 0 {
+		i.cache.set(key, claims, ttl)
+	}
+	return maps.Clone(claims), nil
+}
+
+func (i *introspector) fetch(raw string) (jwt.MapClaims, error) {
+	form := url.Values{"token": {raw}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+	}
+	resp, err := i.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var claims jwt.MapClaims
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verify verifies raw as a JWT or, if it isn't one and INTROSPECTION_URL is
+// set, by introspection. Introspected claims are checked like those of a
+// JWT.
+func (s *server) verify(raw string) (jwt.MapClaims, error) {
+	return s.verifyWith(&s.Validator, raw)
+}
+
+// verifyWith is verify with the JWTs verified by v.
+func (s *server) verifyWith(v *validator.Validator, raw string) (jwt.MapClaims, error) {
+	claims, err := v.Verify(raw)
+	if s.Introspection == nil || !errors.Is(err, validator.ErrMalformed) {
+		return claims, err
+	}
+	if claims, err = s.Introspection.introspect(raw); err != nil {
+		return nil, err
+	}
+	return v.VerifyClaims(raw, claims)
+}
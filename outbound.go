@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Addresses that are never fetched from, regardless of configuration. These
+// are the cloud instance metadata services, which hand out credentials to
+// anything on the host that can reach them.
+var (
+	blockedHosts = map[string]bool{
+		"metadata":                 true,
+		"metadata.google.internal": true,
+		"metadata.goog":            true,
+	}
+	blockedIPs = []net.IP{
+		net.ParseIP("100.100.100.200"), // Alibaba Cloud
+		net.ParseIP("fd00:ec2::254"),   // AWS IPv6 IMDS
+	}
+)
+
+// outboundPolicy restricts which URLs the server is willing to fetch keys,
+// discovery documents and other remote resources from. URLs are checked when
+// configured or discovered, and every dialed address is checked again so DNS
+// answers and redirects can't be used to reach blocked addresses.
+type outboundPolicy struct {
+	schemes      map[string]bool
+	hosts        []string // exact hosts or "*.example.com" suffixes, empty allows any
+	blockPrivate bool
+}
+
+func newOutboundPolicy() *outboundPolicy {
+	p := &outboundPolicy{
+		schemes:      map[string]bool{},
+		hosts:        splitList(getenv("OUTBOUND_ALLOWED_HOSTS", "")),
+		blockPrivate: getenv("OUTBOUND_BLOCK_PRIVATE", "false") == "true",
+	}
+	for _, scheme := range splitList(getenv("OUTBOUND_ALLOWED_SCHEMES", "https,http")) {
+		p.schemes[strings.ToLower(scheme)] = true
+	}
+	return p
+}
+
+func (p *outboundPolicy) checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid url %q: %w", raw, err)
+	}
+	if !p.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("url %q: scheme %q is not allowed", raw, u.Scheme)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "" {
+		return fmt.Errorf("url %q has no host", raw)
+	}
+	if blockedHosts[host] {
+		return fmt.Errorf("url %q: host %q is blocked", raw, host)
+	}
+	if !p.hostAllowed(host) {
+		return fmt.Errorf("url %q: host %q is not in OUTBOUND_ALLOWED_HOSTS", raw, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := p.checkIP(ip); err != nil {
+			return fmt.Errorf("url %q: %w", raw, err)
+		}
+	}
+	return nil
+}
+
+func (p *outboundPolicy) hostAllowed(host string) bool {
+	if len(p.hosts) == 0 {
+		return true
+	}
+	for _, allowed := range p.hosts {
+		allowed = strings.ToLower(allowed)
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *outboundPolicy) checkIP(ip net.IP) error {
+	if ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("address %s is link-local or unspecified", ip)
+	}
+	for _, blocked := range blockedIPs {
+		if ip.Equal(blocked) {
+			return fmt.Errorf("address %s is a metadata service", ip)
+		}
+	}
+	if p.blockPrivate && (ip.IsLoopback() || ip.IsPrivate()) {
+		return fmt.Errorf("address %s is private", ip)
+	}
+	return nil
+}
+
+// control is used as the dialer's Control hook, so it sees the resolved
+// address of every outbound connection.
+func (p *outboundPolicy) control(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("refusing to dial unresolved address %s", address)
+	}
+	return p.checkIP(ip)
+}
+
+// newOutboundClient returns the HTTP client shared by all outbound calls:
+// key sets, discovery, introspection and the various webhooks. It inherits
+// the TLS settings of http.DefaultTransport, the pool sizes and timeouts can
+// be tuned with OUTBOUND_* variables.
+func newOutboundClient(p *outboundPolicy) (*http.Client, error) {
+	var settings struct {
+		maxIdleConns, maxIdleConnsPerHost, maxConnsPerHost                        int
+		timeout, dialTimeout, idleConnTimeout, tlsHandshakeTimeout, headerTimeout time.Duration
+	}
+	for _, setting := range []struct {
+		name, fallback string
+		value          *int
+	}{
+		{"OUTBOUND_MAX_IDLE_CONNS", "100", &settings.maxIdleConns},
+		{"OUTBOUND_MAX_IDLE_CONNS_PER_HOST", "10", &settings.maxIdleConnsPerHost},
+		{"OUTBOUND_MAX_CONNS_PER_HOST", "0", &settings.maxConnsPerHost},
+	} {
+		value, err := strconv.Atoi(getenv(setting.name, setting.fallback))
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", setting.name, getenv(setting.name, setting.fallback))
+		}
+		*setting.value = value
+	}
+	for _, setting := range []struct {
+		name, fallback string
+		value          *time.Duration
+	}{
+		{"OUTBOUND_TIMEOUT", "1m", &settings.timeout},
+		{"OUTBOUND_DIAL_TIMEOUT", "30s", &settings.dialTimeout},
+		{"OUTBOUND_IDLE_CONN_TIMEOUT", "90s", &settings.idleConnTimeout},
+		{"OUTBOUND_TLS_HANDSHAKE_TIMEOUT", "10s", &settings.tlsHandshakeTimeout},
+		{"OUTBOUND_RESPONSE_HEADER_TIMEOUT", "0s", &settings.headerTimeout},
+	} {
+		value, err := time.ParseDuration(getenv(setting.name, setting.fallback))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", setting.name, err)
+		}
+		*setting.value = value
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   settings.dialTimeout,
+		KeepAlive: 30 * time.Second,
+		Control:   p.control,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.MaxIdleConns = settings.maxIdleConns
+	transport.MaxIdleConnsPerHost = settings.maxIdleConnsPerHost
+	transport.MaxConnsPerHost = settings.maxConnsPerHost
+	transport.IdleConnTimeout = settings.idleConnTimeout
+	transport.TLSHandshakeTimeout = settings.tlsHandshakeTimeout
+	transport.ResponseHeaderTimeout = settings.headerTimeout
+
+	if caFile := getenv("OUTBOUND_CA_FILE", ""); caFile != "" {
+		pem, err := readConfigFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read OUTBOUND_CA_FILE: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in OUTBOUND_CA_FILE %s", caFile)
+		}
+		if transport.TLSClientConfig == nil {
+			transport.TLSClientConfig = &tls.Config{}
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return &http.Client{
+		Transport: &instrumentedTransport{next: transport},
+		Timeout:   settings.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return p.checkURL(req.URL.String())
+		},
+	}, nil
+}
+
+var (
+	outboundRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_requests_total",
+		Help: "Total number of outbound http requests by host and status code, \"error\" if no response was received",
+	}, []string{"host", "code"})
+	outboundDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "outbound_request_duration_seconds",
+		Help:    "Number of seconds until the response headers of outbound http requests arrived",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+	outboundInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "outbound_requests_in_flight",
+		Help: "Number of outbound http requests waiting for a response",
+	})
+	outboundConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "outbound_connections_total",
+		Help: "Total number of connections used for outbound http requests, by whether they were reused from the pool",
+	}, []string{"reused"})
+)
+
+func init() {
+	outboundConnections.WithLabelValues("true")
+	outboundConnections.WithLabelValues("false")
+
+	prometheus.MustRegister(
+		outboundRequests,
+		outboundDuration,
+		outboundInFlight,
+		outboundConnections,
+	)
+}
+
+// instrumentedTransport records metrics about outbound requests and how well
+// the connection pool is being reused.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			outboundConnections.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	outboundInFlight.Inc()
+	defer outboundInFlight.Dec()
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	outboundDuration.WithLabelValues(req.URL.Host).Observe(time.Since(start).Seconds())
+	if err != nil {
+		outboundRequests.WithLabelValues(req.URL.Host, "error").Inc()
+		return nil, err
+	}
+	outboundRequests.WithLabelValues(req.URL.Host, strconv.Itoa(resp.StatusCode)).Inc()
+	return resp, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
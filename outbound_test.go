@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckURL(t *testing.T) {
+	p := &outboundPolicy{schemes: map[string]bool{"https": true, "http": true}, blockPrivate: true}
+	for _, test := range []struct {
+		url     string
+		blocked bool
+	}{
+		{"https://login.example.com/.well-known/jwks.json", false},
+		{"http://10.0.0.1.nip.io/keys", false},
+		{"http://metadata/computeMetadata/v1/", true},
+		{"http://metadata.google.internal/computeMetadata/v1/", true},
+		{"http://METADATA.GOOGLE.INTERNAL./computeMetadata/v1/", true},
+		{"http://metadata.goog/", true},
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://[fe80::1]/", true},
+		{"http://100.100.100.200/latest/meta-data/", true},
+		{"http://[fd00:ec2::254]/latest/meta-data/", true},
+		{"http://0.0.0.0/", true},
+		{"http://127.0.0.1:8080/", true},
+		{"http://[::1]/", true},
+		{"http://192.168.1.1/", true},
+		{"file:///etc/passwd", true},
+		{"gopher://example.com/", true},
+		{"ftp://example.com/keys", true},
+		{"https:///keys", true},
+		{"https://%zz/", true},
+	} {
+		if err := p.checkURL(test.url); (err != nil) != test.blocked {
+			t.Errorf("checkURL(%q) = %v, want blocked %v", test.url, err, test.blocked)
+		}
+	}
+
+	// Loopback and private addresses are only blocked on request, the
+	// metadata services always
+	p.blockPrivate = false
+	for _, test := range []struct {
+		url     string
+		blocked bool
+	}{
+		{"http://127.0.0.1:8080/", false},
+		{"http://10.0.0.1/", false},
+		{"http://169.254.169.254/latest/meta-data/", true},
+		{"http://metadata.google.internal/", true},
+	} {
+		if err := p.checkURL(test.url); (err != nil) != test.blocked {
+			t.Errorf("without OUTBOUND_BLOCK_PRIVATE, checkURL(%q) = %v, want blocked %v", test.url, err, test.blocked)
+		}
+	}
+}
+
+// TestOutboundDial checks that addresses are checked again once resolved,
+// so names can't be used to reach blocked addresses.
+func TestOutboundDial(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	port := backend.URL[strings.LastIndex(backend.URL, ":")+1:]
+
+	for _, test := range []struct {
+		url          string
+		blockPrivate bool
+		blocked      bool
+	}{
+		{"http://localhost:" + port + "/", true, true},
+		{"http://localhost:" + port + "/", false, false},
+		{backend.URL, false, false},
+	} {
+		p := &outboundPolicy{schemes: map[string]bool{"http": true}, blockPrivate: test.blockPrivate}
+		if err := p.checkURL(test.url); err != nil {
+			t.Fatalf("checkURL(%q) = %v, the check must be left to the dialer", test.url, err)
+		}
+		client, err := newOutboundClient(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(test.url)
+		if err == nil {
+			resp.Body.Close()
+		}
+		if blocked := err != nil && strings.Contains(err.Error(), "is private"); blocked != test.blocked {
+			t.Errorf("GET %s with blockPrivate %v = %v, want blocked %v", test.url, test.blockPrivate, err, test.blocked)
+		}
+	}
+}
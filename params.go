@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/url"
+	"time"
+
+	"github.com/robbilie/nginx-jwt-auth/policy"
+)
+
+// parsedParams are validation params along with their compiled claim
+// requirements.
+type parsedParams struct {
+	values url.Values
+	policy *policy.Policy
+	// templates are the header templates of a named policy
+	templates headerTemplates
+}
+
+// maxCachedParams bounds the number of distinct param strings whose parsed
+// form is kept. nginx sends the same few query strings over and over.
+const maxCachedParams = 1000
+
+// parseParams parses and compiles raw params. The result is cached, so each
+// distinct query string is only compiled once; callers must not modify the
+// returned values.
+func (s *server) parseParams(raw string) (url.Values, *policy.Policy) {
+	if cached, ok := s.params.get(raw); ok {
+		return cached.values, cached.policy
+	}
+	values, err := url.ParseQuery(raw)
+	if err != nil {
+		s.Logger.Warnw("Failed to parse params", "params", raw, "err", err)
+	}
+	values, compiled, err := s.resolveParams(values)
+	if err != nil {
+		s.Logger.Warnw("Invalid params", "params", raw, "err", err)
+	}
+	s.params.set(raw, &parsedParams{values: values, policy: compiled}, time.Hour)
+	return values, compiled
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/url"
+	"strings"
+
+	"github.com/robbilie/nginx-jwt-auth/policy"
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is the file at CONFIG_PATH, in YAML or JSON. It defines named
+// policies, which requests refer to with a policy=<name> param, and the
+// issuers tokens are accepted from:
+//
+//	policies:
+//	  admins:
+//	    claims:
+//	      groups: [admin, ops]
+//	    claims_regexp:
+//	      email: '@example\.com$'
+//	    scopes: [read:items, write:items]
+//	    headers:
+//	      X-User: sub
+//	    header_templates:
+//	      X-Account: '{{.sub}}@{{.tenant}}'
+//	    params:
+//	      cookie: session
+//	issuers:
+//	  - issuer: https://keycloak.example.com/realms/main
+//	    jwks_url: https://keycloak.example.com/realms/main/protocol/openid-connect/certs
+//	    algorithms: [RS256]
+//	header_templates:
+//	  X-User: '{{.preferred_username}}@{{.tenant}}'
+//
+// header_templates compose response headers of claims with text/template,
+// those at the top for every request.
+type configFile struct {
+	Policies        map[string]namedPolicy `yaml:"policies"`
+	Issuers         []issuerConfig         `yaml:"issuers"`
+	HeaderTemplates map[string]string      `yaml:"header_templates"`
+}
+
+// loadConfigFile reads the file at path.
+func loadConfigFile(path string) (*configFile, error) {
+	raw, err := readPolicyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file configFile
+	if err := yaml.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return &file, nil
+}
+
+// namedPolicy spells out the params of a policy: claims are the claims_*
+// params, claims_regexp the claims_regexp_* ones, claims_all the
+// claims_all_* ones, claims_not and
+// claims_not_regexp the claims_not_* and claims_not_regexp_* ones, scopes
+// the scopes param and headers the headers_* ones. params holds any others.
+// header_templates are added to those of the config file.
+type namedPolicy struct {
+	Claims          map[string]stringList `yaml:"claims"`
+	ClaimsRegexp    map[string]stringList `yaml:"claims_regexp"`
+	ClaimsAll       map[string]stringList `yaml:"claims_all"`
+	ClaimsNot       map[string]stringList `yaml:"claims_not"`
+	ClaimsNotRegexp map[string]stringList `yaml:"claims_not_regexp"`
+	Scopes          stringList            `yaml:"scopes"`
+	Headers         map[string]string     `yaml:"headers"`
+	HeaderTemplates map[string]string     `yaml:"header_templates"`
+	Params          map[string]stringList `yaml:"params"`
+}
+
+// stringList is a list of strings that may be given as a single one.
+type stringList []string
+
+func (l *stringList) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*l = stringList{value.Value}
+		return nil
+	}
+	return value.Decode((*[]string)(l))
+}
+
+func (p namedPolicy) values() url.Values {
+	values := url.Values{}
+	for name, allowed := range p.Params {
+		values[name] = allowed
+	}
+	for claim, allowed := range p.Claims {
+		values["claims_"+claim] = allowed
+	}
+	for claim, patterns := range p.ClaimsRegexp {
+		values["claims_regexp_"+claim] = patterns
+	}
+	for claim, required := range p.ClaimsAll {
+		values["claims_all_"+claim] = required
+	}
+	for claim, denied := range p.ClaimsNot {
+		values["claims_not_"+claim] = denied
+	}
+	for claim, patterns := range p.ClaimsNotRegexp {
+		values["claims_not_regexp_"+claim] = patterns
+	}
+	if len(p.Scopes) > 0 {
+		values["scopes"] = []string{strings.Join(p.Scopes, " ")}
+	}
+	for header, claim := range p.Headers {
+		values["headers_"+header] = []string{claim}
+	}
+	return values
+}
+
+// compilePolicies compiles the named policies of the config file. It fails
+// on invalid patterns, so a typo is noticed before requests are denied.
+// Their params name them, so their header templates are found.
+func compilePolicies(named map[string]namedPolicy) (map[string]*parsedParams, error) {
+	policies := make(map[string]*parsedParams, len(named))
+	for name, p := range named {
+		values := p.values()
+		if values.Has("policy") {
+			return nil, fmt.Errorf("policy %q: policies can't refer to other policies", name)
+		}
+		compiled, err := policy.Compile(values)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		templates, err := parseHeaderTemplates(p.HeaderTemplates)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		values.Set("policy", name)
+		policies[name] = &parsedParams{values: values, policy: compiled, templates: templates}
+	}
+	return policies, nil
+}
+
+// policySet holds the named policies of CONFIG_PATH and the params of
+// DEFAULT_PARAMS, which may refer to them. Reloading CONFIG_PATH replaces
+// the set as a whole.
+type policySet struct {
+	named map[string]*parsedParams
+	// templates are the header templates for every request
+	templates headerTemplates
+	// defaults is nil without DEFAULT_PARAMS
+	defaults *parsedParams
+}
+
+// newPolicySet loads the policies at configPath, if set, and resolves the
+// defaultParams against them.
+func newPolicySet(configPath, defaultParams string) (*policySet, error) {
+	set := &policySet{}
+	if configPath != "" {
+		file, err := loadConfigFile(configPath)
+		if err != nil {
+			return nil, err
+		}
+		if set.named, err = compilePolicies(file.Policies); err != nil {
+			return nil, err
+		}
+		if set.templates, err = parseHeaderTemplates(file.HeaderTemplates); err != nil {
+			return nil, err
+		}
+	}
+	if defaultParams != "" {
+		values, err := url.ParseQuery(defaultParams)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse DEFAULT_PARAMS: %w", err)
+		}
+		values, compiled, err := set.resolve(values)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't compile DEFAULT_PARAMS: %w", err)
+		}
+		set.defaults = &parsedParams{values: values, policy: compiled}
+	}
+	return set, nil
+}
+
+// resolve compiles params. Params naming a policy get its params, along
+// with their own, which can add requirements but not replace those of the
+// policy. An unknown policy allows nothing.
+func (set *policySet) resolve(values url.Values) (url.Values, *policy.Policy, error) {
+	name := values.Get("policy")
+	if name == "" {
+		compiled, err := policy.Compile(values)
+		return values, compiled, err
+	}
+	named, ok := set.named[name]
+	if !ok {
+		err := fmt.Errorf("unknown policy %q", name)
+		return values, policy.Deny(err), err
+	}
+	if len(values) == 1 {
+		return named.values, named.policy, nil
+	}
+	merged := maps.Clone(named.values)
+	for key, value := range values {
+		if _, given := merged[key]; !given && key != "policy" {
+			merged[key] = value
+		}
+	}
+	compiled, err := policy.Compile(merged)
+	return merged, compiled, err
+}
+
+// resolveParams resolves params against the current policies.
+func (s *server) resolveParams(values url.Values) (url.Values, *policy.Policy, error) {
+	set := s.policies.Load()
+	if set == nil {
+		set = &policySet{}
+	}
+	return set.resolve(values)
+}
+
+// defaults returns the DEFAULT_PARAMS, nil if there are none.
+func (s *server) defaults() (url.Values, *policy.Policy) {
+	if set := s.policies.Load(); set != nil && set.defaults != nil {
+		return set.defaults.values, set.defaults.policy
+	}
+	return nil, nil
+}
+
+// reloadPolicies rereads CONFIG_PATH. The policies in use are kept if it
+// is invalid.
+func (s *server) reloadPolicies() error {
+	set, err := newPolicySet(getenv("CONFIG_PATH", ""), getenv("DEFAULT_PARAMS", ""))
+	if err != nil {
+		return err
+	}
+	s.policies.Store(set)
+	// Cached params may have been resolved against the previous policies
+	s.params.purge()
+	s.Logger.Infow("Reloaded policies", "count", len(set.named))
+	return nil
+}
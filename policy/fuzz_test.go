@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"encoding/json"
+	"net/url"
+	"testing"
+)
+
+var fuzzClaims = []string{
+	`{"sub":"alice","groups":["users","admins"],"email":"alice@example.com"}`,
+	`{"sub":1,"groups":[1,null,{"a":"b"},["admins"]],"email":true}`,
+	`{"groups":"admins","nested":{"groups":["admins"]}}`,
+	`{"realm_access":{"roles":["admin"]},"orgs":[{"roles":["a"]},{"roles":"b"},1],"a.b":"c"}`,
+	`{"acr":"2","level":3,"email_verified":"true","verified":[false,true]}`,
+	`{"scope":"read:items write:items","scp":["admin"]}`,
+	`{}`,
+	`null`,
+}
+
+var fuzzParams = []string{
+	"claims_groups=admins&claims_groups=developers&headers_X-User=sub",
+	`claims_regexp_email=@example\.com$&claims_regexp_email=^admin$&claims_regexp_sub=.*`,
+	`claims_regexp_sub=(&claims_regexp_sub=\Q&claims_sub=alice`,
+	"headers_X-Groups=groups&headers_X-Missing=missing&headers_=sub",
+	"claims_=&headers_X-Nested=nested",
+	"claims_gte_acr=2&claims_lt_level=4&claims_gt_level=x&claims_bool_email_verified=true&claims_bool_verified=yes",
+	"scopes=read:items+write:items&scopes=read:items&claims_scope=x",
+	`claims_all_groups=team-a&claims_all_groups=prod-access&claims_regexp_groups=^team-`,
+	`claims_not_groups=contractors&claims_not_regexp_email=@evil\.com$&claims_not_regexp_sub=(&claims_groups=admins`,
+	"claims_realm_access.roles=admin&claims_regexp_orgs.roles=^b$&claims_orgs.0.roles=a&claims_a.b=c&claims_..=x",
+	"headers_b64_X-Name=name&headers_pct_X-Mapped=sub&headers_b64_=sub&headers_pct_X-Groups=groups",
+	"headers_X-Roles=realm_access.roles&headers_X-Org=orgs.0.id&headers_X-Ids=orgs.id&headers_X-Dots=..",
+}
+
+// FuzzPolicy checks that no combination of params and claims panics, and
+// that Check agrees with Allows.
+func FuzzPolicy(f *testing.F) {
+	for _, params := range fuzzParams {
+		for _, claims := range fuzzClaims {
+			f.Add(params, []byte(claims))
+		}
+	}
+	f.Fuzz(func(t *testing.T, rawParams string, rawClaims []byte) {
+		params, err := url.ParseQuery(rawParams)
+		if err != nil {
+			t.Skip()
+		}
+		var claims map[string]interface{}
+		if err := json.Unmarshal(rawClaims, &claims); err != nil {
+			t.Skip()
+		}
+		p, _ := Compile(params)
+		allowed := p.Allows(claims)
+		if err := p.Check(claims); allowed != (err == nil) {
+			t.Fatalf("Allows = %v, but Check = %v", allowed, err)
+		}
+	})
+}
+
+// FuzzHeaders checks that no combination of params and claims panics, and
+// that every header names a claim the token has.
+func FuzzHeaders(f *testing.F) {
+	for _, params := range fuzzParams {
+		for _, claims := range fuzzClaims {
+			f.Add(params, []byte(claims), "X-Mapped=sub")
+		}
+	}
+	f.Fuzz(func(t *testing.T, rawParams string, rawClaims []byte, rawMapping string) {
+		params, err := url.ParseQuery(rawParams)
+		if err != nil {
+			t.Skip()
+		}
+		var claims map[string]interface{}
+		if err := json.Unmarshal(rawClaims, &claims); err != nil {
+			t.Skip()
+		}
+		mapping, err := url.ParseQuery(rawMapping)
+		if err != nil {
+			t.Skip()
+		}
+		headers := map[string]string{}
+		for header, claimNames := range mapping {
+			headers[header] = claimNames[0]
+		}
+		// Params built in code may hold no values at all
+		params["headers_X-Empty"] = nil
+
+		for header, value := range Headers(headers, params, claims) {
+			claimName, encoding := headers[header], EncodingNone
+			for key, values := range params {
+				if name, paramEncoding, ok := HeaderParam(key); ok && name == header && len(values) > 0 {
+					claimName, encoding = values[0], paramEncoding
+				}
+			}
+			claim, ok := Lookup(claims, claimName)
+			if !ok {
+				t.Fatalf("header %s set to %q without claim %q", header, value, claimName)
+			}
+			if s, ok := claim.(string); ok && encoding == EncodingNone && s != value {
+				t.Fatalf("header %s = %q, want %q", header, value, s)
+			}
+		}
+	})
+}
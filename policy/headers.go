@@ -0,0 +1,158 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// Encodings of header values, for claims that aren't valid in a header as
+// they are, like those with newlines or non-ASCII characters.
+const (
+	EncodingNone = ""
+	// EncodingBase64 is standard base64 with padding
+	EncodingBase64 = "base64"
+	// EncodingPercent percent-encodes like a URL path segment
+	EncodingPercent = "percent"
+)
+
+// encodingPrefixes are the prefixes of headers_* params that select the
+// encoding of their header, e.g. headers_b64_X-Name=name.
+var encodingPrefixes = map[string]string{
+	"b64_": EncodingBase64,
+	"pct_": EncodingPercent,
+}
+
+// HeaderParam returns the header a headers_* param key sets and the
+// encoding it selects, if any.
+func HeaderParam(key string) (header, encoding string, ok bool) {
+	header, ok = strings.CutPrefix(key, "headers_")
+	if !ok {
+		return "", "", false
+	}
+	for prefix, encoding := range encodingPrefixes {
+		if name, ok := strings.CutPrefix(header, prefix); ok && name != "" {
+			return name, encoding, true
+		}
+	}
+	return header, EncodingNone, true
+}
+
+// HeaderFormat is how claims are turned into header values.
+type HeaderFormat struct {
+	// Encoding encodes the values, unless their headers_* param selects an
+	// encoding.
+	Encoding string
+	// Separator joins the elements of lists of strings, numbers and
+	// booleans, which are encoded as JSON without one.
+	Separator string
+}
+
+// Headers maps response headers to the encoded values of the claims they
+// name. mapping (header -> claim) comes first, unless a headers_<header>
+// param overrides a header, then the headers_* params. Claims are looked up
+// like by Lookup, so dot-paths select nested ones. Headers of claims the
+// token doesn't have are left out.
+func Headers(mapping map[string]string, params url.Values, claims map[string]interface{}) map[string]string {
+	return FormatHeaders(mapping, params, claims, HeaderFormat{})
+}
+
+// FormatHeaders is Headers with the values formatted as format says.
+func FormatHeaders(mapping map[string]string, params url.Values, claims map[string]interface{}, format HeaderFormat) map[string]string {
+	values := make(map[string]string, len(mapping))
+	overridden := make(map[string]bool)
+	for key, value := range params {
+		header, encoding, ok := HeaderParam(key)
+		if !ok {
+			continue
+		}
+		overridden[header] = true
+		if len(value) == 0 {
+			continue
+		}
+		paramFormat := format
+		if encoding != EncodingNone {
+			paramFormat.Encoding = encoding
+		}
+		addHeader(values, header, value[0], claims, paramFormat)
+	}
+	for header, claimName := range mapping {
+		if !overridden[header] {
+			addHeader(values, header, claimName, claims, format)
+		}
+	}
+	return values
+}
+
+func addHeader(values map[string]string, header, claimName string, claims map[string]interface{}, format HeaderFormat) {
+	claim, ok := Lookup(claims, claimName)
+	if !ok {
+		return
+	}
+	value, ok := format.value(claim)
+	if !ok {
+		return
+	}
+	values[header] = EncodeHeaderValue(value, format.Encoding)
+}
+
+// value is HeaderValue, except for lists joined with the Separator.
+func (f HeaderFormat) value(claim interface{}) (string, bool) {
+	list, ok := claim.([]interface{})
+	if !ok || f.Separator == "" {
+		return HeaderValue(claim)
+	}
+	elements := make([]string, len(list))
+	for i, element := range list {
+		switch element.(type) {
+		case string, float64, json.Number, bool:
+			elements[i] = fmt.Sprint(element)
+		default:
+			return HeaderValue(claim)
+		}
+	}
+	return strings.Join(elements, f.Separator), true
+}
+
+// EncodeHeaderValue encodes value with encoding.
+func EncodeHeaderValue(value, encoding string) string {
+	switch encoding {
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString([]byte(value))
+	case EncodingPercent:
+		return url.PathEscape(value)
+	}
+	return value
+}
+
+// HeaderValue encodes a claim for a header: strings as they are, anything
+// else as JSON.
+func HeaderValue(claim interface{}) (string, bool) {
+	if s, ok := claim.(string); ok {
+		return s, true
+	}
+	e := jsonEncoders.Get().(*jsonEncoder)
+	defer jsonEncoders.Put(e)
+	e.buf.Reset()
+	if err := e.enc.Encode(claim); err != nil {
+		return "", false
+	}
+	return string(bytes.TrimSuffix(e.buf.Bytes(), []byte("\n"))), true
+}
+
+// jsonEncoder reuses the buffer non-string claims are encoded into. Encode
+// escapes like json.Marshal, but appends a newline.
+type jsonEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonEncoders = sync.Pool{New: func() interface{} {
+	e := &jsonEncoder{}
+	e.enc = json.NewEncoder(&e.buf)
+	return e
+}}
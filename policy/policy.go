@@ -0,0 +1,624 @@
+// Package policy evaluates the query string style validation parameters of
+// nginx-jwt-auth against token claims: claims_<claim>,
+// claims_regexp_<claim>, claims_all_<claim>, claims_<gt|gte|lt|lte>_<claim>,
+// claims_bool_<claim>, claims_not_<claim>, claims_not_regexp_<claim> and scopes requirements, and
+// headers_<header> mappings of claims to response headers.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Policy is the compiled form of the claims_* params. Requirements are
+// grouped by claim, so every claim is looked up once. Allowed values are
+// kept in a set, and so are patterns that just spell out a whole value
+// (^value$). The remaining patterns of a claim are joined into one regexp.
+// A Policy is safe for concurrent use.
+type Policy struct {
+	rules []rule
+	// scopes are required by the scopes param
+	scopes []string
+	// deny, if set, is why the policy allows nothing
+	deny error
+}
+
+// rule holds the requirements on one claim. With both exact values and
+// patterns configured, the claim has to satisfy both.
+type rule struct {
+	claim string
+	// path is the claim split at its dots, nil if it has none
+	path  []string
+	exact map[string]struct{}
+	// values and regexps are the params as given, for Mismatch
+	values   []string
+	regexps  []string
+	hasExact bool
+	hasRegex bool
+	// The claims_regexp_ patterns
+	patternSet
+	// all are the claims_all_ values, every one of which the claim has to
+	// contain
+	all []string
+	// bounds are the claims_gt_, claims_gte_, claims_lt_ and claims_lte_
+	// params, booleans the claims_bool_ values
+	bounds   []bound
+	booleans []string
+	// The claims_not_ values and claims_not_regexp_ patterns, which no
+	// element of the claim may match. Should a pattern be invalid, the rule
+	// allows nothing rather than what it was meant to deny.
+	notExact    map[string]struct{}
+	notValues   []string
+	notRegexps  []string
+	notPatterns patternSet
+	notInvalid  bool
+}
+
+// patternSet holds patterns split by how they are matched.
+type patternSet struct {
+	literals map[string]struct{}
+	substrs  []string
+	matchAll bool
+	patterns []*regexp.Regexp
+}
+
+// bound is a numeric requirement, e.g. claims_gte_acr=2.
+type bound struct {
+	param string
+	op    string
+	given string
+	value float64
+	// invalid bounds, given no number, are never met
+	invalid bool
+}
+
+// comparisons are the claims_<op>_ params comparing numbers.
+var comparisons = []string{"gt", "gte", "lt", "lte"}
+
+// Compile compiles the claims_* params. Invalid patterns are reported in
+// the returned error, but the policy is still usable: they are left out, as
+// they could never match anyway.
+func Compile(params url.Values) (*Policy, error) {
+	rules := map[string]*rule{}
+	ruleFor := func(claim string) *rule {
+		if rules[claim] == nil {
+			rules[claim] = &rule{claim: claim}
+			if strings.Contains(claim, ".") {
+				rules[claim].path = strings.Split(claim, ".")
+			}
+		}
+		return rules[claim]
+	}
+	var errs []error
+	var scopes []string
+	for _, value := range params["scopes"] {
+		for _, scope := range strings.Fields(value) {
+			if !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	for key, values := range params {
+		claim, ok := strings.CutPrefix(key, "claims_")
+		if !ok {
+			continue
+		}
+		if claim, ok := strings.CutPrefix(claim, "not_regexp_"); ok {
+			r := ruleFor(claim)
+			r.notRegexps = append(r.notRegexps, values...)
+			before := len(errs)
+			r.notPatterns.addPatterns(key, values, &errs)
+			r.notInvalid = r.notInvalid || len(errs) > before
+			continue
+		}
+		if claim, ok := strings.CutPrefix(claim, "not_"); ok {
+			r := ruleFor(claim)
+			r.notValues = append(r.notValues, values...)
+			if r.notExact == nil {
+				r.notExact = make(map[string]struct{}, len(values))
+			}
+			for _, value := range values {
+				r.notExact[value] = struct{}{}
+			}
+			continue
+		}
+		if claim, ok := strings.CutPrefix(claim, "all_"); ok {
+			r := ruleFor(claim)
+			for _, value := range values {
+				if !slices.Contains(r.all, value) {
+					r.all = append(r.all, value)
+				}
+			}
+			continue
+		}
+		if claim, ok := strings.CutPrefix(claim, "regexp_"); ok {
+			r := ruleFor(claim)
+			r.hasRegex = true
+			r.regexps = append(r.regexps, values...)
+			r.addPatterns(key, values, &errs)
+			continue
+		}
+		if op, claim, ok := cutComparison(claim); ok {
+			r := ruleFor(claim)
+			for _, value := range values {
+				b := bound{param: key, op: op, given: value}
+				var err error
+				if b.value, err = strconv.ParseFloat(value, 64); err != nil {
+					b.invalid = true
+					errs = append(errs, fmt.Errorf("invalid number for %s: %q", key, value))
+				}
+				r.bounds = append(r.bounds, b)
+			}
+			continue
+		}
+		if claim, ok := strings.CutPrefix(claim, "bool_"); ok {
+			r := ruleFor(claim)
+			for _, value := range values {
+				if value != "true" && value != "false" {
+					errs = append(errs, fmt.Errorf("invalid boolean for %s: %q", key, value))
+				}
+			}
+			// Invalid values can't match, but still make the claim required
+			r.booleans = append(r.booleans, values...)
+			continue
+		}
+		r := ruleFor(claim)
+		r.hasExact = true
+		r.values = append(r.values, values...)
+		if r.exact == nil {
+			r.exact = make(map[string]struct{}, len(values))
+		}
+		for _, value := range values {
+			r.exact[value] = struct{}{}
+		}
+	}
+
+	policy := &Policy{rules: make([]rule, 0, len(rules)), scopes: scopes}
+	for _, claim := range sortedKeys(rules) {
+		policy.rules = append(policy.rules, *rules[claim])
+	}
+	return policy, errors.Join(errs...)
+}
+
+// cutComparison splits the comparison off the claim of a claims_<op>_
+// param.
+func cutComparison(name string) (op, claim string, ok bool) {
+	for _, op := range comparisons {
+		if claim, ok := strings.CutPrefix(name, op+"_"); ok {
+			return op, claim, true
+		}
+	}
+	return "", "", false
+}
+
+// addPatterns sorts out the patterns that can be matched without a regexp
+// and joins the others into a single alternation. Should that not compile,
+// e.g. because of an unterminated \Q, they are kept apart.
+func (r *patternSet) addPatterns(key string, patterns []string, errs *[]error) {
+	var rest []string
+	for _, pattern := range patterns {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			*errs = append(*errs, fmt.Errorf("invalid pattern for %s: %w", key, err))
+			continue
+		}
+		switch re = re.Simplify(); {
+		case re.Op == syntax.OpEmptyMatch || re.Op == syntax.OpStar || re.Op == syntax.OpQuest:
+			// Can match the empty string anywhere, so matches anything
+			r.matchAll = true
+		case re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase == 0:
+			r.substrs = append(r.substrs, string(re.Rune))
+		case re.Op == syntax.OpConcat && len(re.Sub) == 3 &&
+			re.Sub[0].Op == syntax.OpBeginText && re.Sub[2].Op == syntax.OpEndText &&
+			re.Sub[1].Op == syntax.OpLiteral && re.Sub[1].Flags&syntax.FoldCase == 0:
+			if r.literals == nil {
+				r.literals = make(map[string]struct{})
+			}
+			r.literals[string(re.Sub[1].Rune)] = struct{}{}
+		default:
+			rest = append(rest, pattern)
+		}
+	}
+	if len(rest) == 0 {
+		return
+	}
+	if joined, err := regexp.Compile("(?:" + strings.Join(rest, ")|(?:") + ")"); err == nil {
+		r.patterns = append(r.patterns, joined)
+		return
+	}
+	for _, pattern := range rest {
+		r.patterns = append(r.patterns, regexp.MustCompile(pattern))
+	}
+}
+
+// Deny returns a policy that allows no claims at all, for params that
+// can't be made sense of. Its Check returns reason.
+func Deny(reason error) *Policy {
+	return &Policy{deny: reason}
+}
+
+// Empty reports whether the policy has no claim requirements at all. A nil
+// Policy is empty.
+func (p *Policy) Empty() bool {
+	return p == nil || (len(p.rules) == 0 && len(p.scopes) == 0 && p.deny == nil)
+}
+
+// Allows reports whether claims satisfy every rule of the policy.
+func (p *Policy) Allows(claims map[string]interface{}) bool {
+	if p.deny != nil {
+		return false
+	}
+	for i := range p.rules {
+		value, _ := p.rules[i].lookup(claims)
+		if !p.rules[i].allows(value) {
+			return false
+		}
+	}
+	return len(p.scopes) == 0 || len(p.missingScopes(claims)) == 0
+}
+
+// Check is Allows for when the reason matters: it returns a *Mismatch
+// describing the first requirement claims don't satisfy, the reason of a
+// Deny policy or that of an invalid claims_not_regexp_ pattern.
+func (p *Policy) Check(claims map[string]interface{}) error {
+	if p.deny != nil {
+		return p.deny
+	}
+	for i := range p.rules {
+		r := &p.rules[i]
+		value, ok := r.lookup(claims)
+		if !ok && r.required() {
+			m := &Mismatch{Claim: r.claim, Missing: true}
+			switch {
+			case r.hasExact:
+				m.Param, m.Expected = "claims_"+r.claim, r.values
+			case r.hasRegex:
+				m.Param, m.Expected = "claims_regexp_"+r.claim, r.regexps
+			case len(r.all) > 0:
+				m.Param, m.Expected = "claims_all_"+r.claim, r.all
+			case len(r.bounds) > 0:
+				m.Param, m.Expected, m.Bound = r.bounds[0].param, []string{r.bounds[0].given}, true
+			default:
+				m.Param, m.Expected = "claims_bool_"+r.claim, r.booleans
+			}
+			return m
+		}
+		if r.hasExact && !r.allowsExact(value) {
+			return &Mismatch{Claim: r.claim, Value: value, Param: "claims_" + r.claim, Expected: r.values}
+		}
+		if r.hasRegex && !anyElement(value, r.matches) {
+			return &Mismatch{Claim: r.claim, Value: value, Param: "claims_regexp_" + r.claim, Expected: r.regexps, RegExp: true}
+		}
+		if lacking := r.lacking(value); len(lacking) > 0 {
+			return &Mismatch{Claim: r.claim, Value: value, Param: "claims_all_" + r.claim, Expected: lacking}
+		}
+		for _, b := range r.bounds {
+			if !anyValue(value, b.allows) {
+				return &Mismatch{Claim: r.claim, Value: value, Param: b.param, Expected: []string{b.given}, Bound: true}
+			}
+		}
+		if len(r.booleans) > 0 && !anyValue(value, r.allowsBoolean) {
+			return &Mismatch{Claim: r.claim, Value: value, Param: "claims_bool_" + r.claim, Expected: r.booleans}
+		}
+		if r.deniesExact(value) {
+			return &Mismatch{Claim: r.claim, Value: value, Param: "claims_not_" + r.claim, Expected: r.notValues, Negated: true}
+		}
+		if r.notInvalid {
+			return fmt.Errorf("claims_not_regexp_%s has an invalid pattern", r.claim)
+		}
+		if anyElement(value, r.notPatterns.matches) {
+			return &Mismatch{Claim: r.claim, Value: value, Param: "claims_not_regexp_" + r.claim, Expected: r.notRegexps, RegExp: true, Negated: true}
+		}
+	}
+	if len(p.scopes) > 0 {
+		if missing := p.missingScopes(claims); len(missing) > 0 {
+			claim, value := scopeClaim(claims)
+			return &Mismatch{Claim: claim, Value: value, Missing: value == nil, Param: "scopes", Expected: missing}
+		}
+	}
+	return nil
+}
+
+// scopeClaim returns the claim holding the token's scopes: scope, a space
+// delimited string as of RFC 8693, or else scp, which Azure AD and Okta
+// use, possibly as a list.
+func scopeClaim(claims map[string]interface{}) (string, interface{}) {
+	if value, ok := claims["scope"]; ok {
+		return "scope", value
+	}
+	return "scp", claims["scp"]
+}
+
+// missingScopes returns the scopes of the policy the token wasn't granted.
+func (p *Policy) missingScopes(claims map[string]interface{}) []string {
+	_, value := scopeClaim(claims)
+	var granted []string
+	switch value := value.(type) {
+	case string:
+		granted = strings.Fields(value)
+	case []interface{}:
+		for _, e := range value {
+			if s, ok := e.(string); ok {
+				granted = append(granted, s)
+			}
+		}
+	}
+	var missing []string
+	for _, scope := range p.scopes {
+		if !slices.Contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
+
+// Mismatch is a requirement a claim doesn't satisfy.
+type Mismatch struct {
+	Claim string
+	// Value is the claim's value, unless it is Missing.
+	Value   interface{}
+	Missing bool
+	// Param is the param of the requirement, e.g. claims_groups, and
+	// Expected its values or, if RegExp, its patterns. For the scopes
+	// param, Expected are the scopes missing, for claims_all_ params the
+	// values the claim lacks.
+	Param    string
+	Expected []string
+	RegExp   bool
+	// Bound is set for the claims_gt_, claims_gte_, claims_lt_ and
+	// claims_lte_ params.
+	Bound bool
+	// Negated is set for the claims_not_ and claims_not_regexp_ params,
+	// which the claim matches.
+	Negated bool
+}
+
+func (m *Mismatch) Error() string {
+	switch {
+	case m.Param == "scopes":
+		return fmt.Sprintf("scopes %s not granted", strings.Join(m.Expected, " "))
+	case m.Negated:
+		return fmt.Sprintf("claim %q is %v, matching %s", m.Claim, m.Value, m.Param)
+	case m.Missing:
+		return fmt.Sprintf("claim %q is missing", m.Claim)
+	case strings.HasPrefix(m.Param, "claims_all_"):
+		return fmt.Sprintf("claim %q is %v, lacking %s of %s", m.Claim, m.Value, strings.Join(m.Expected, " "), m.Param)
+	case m.RegExp:
+		return fmt.Sprintf("claim %q is %v, matching none of %s", m.Claim, m.Value, m.Param)
+	case m.Bound:
+		return fmt.Sprintf("claim %q is %v, out of %s", m.Claim, m.Value, m.Param)
+	default:
+		return fmt.Sprintf("claim %q is %v, none of %s", m.Claim, m.Value, m.Param)
+	}
+}
+
+func (r *rule) lookup(claims map[string]interface{}) (interface{}, bool) {
+	if value, ok := claims[r.claim]; ok || r.path == nil {
+		return value, ok
+	}
+	return lookupPath(claims, r.path)
+}
+
+// Lookup returns the claim called name. Names with dots that don't name a
+// claim of their own are paths into nested claims, e.g. realm_access.roles.
+// On the way, a list yields the elements at the rest of the path, its
+// lists flattened, unless a number selects one of them.
+func Lookup(claims map[string]interface{}, name string) (interface{}, bool) {
+	if value, ok := claims[name]; ok || !strings.Contains(name, ".") {
+		return value, ok
+	}
+	return lookupPath(claims, strings.Split(name, "."))
+}
+
+func lookupPath(value interface{}, path []string) (interface{}, bool) {
+	for i, key := range path {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			if index, err := strconv.Atoi(key); err == nil {
+				if index < 0 || index >= len(v) {
+					return nil, false
+				}
+				value = v[index]
+				continue
+			}
+			var found []interface{}
+			for _, e := range v {
+				if value, ok := lookupPath(e, path[i:]); ok {
+					if list, ok := value.([]interface{}); ok {
+						found = append(found, list...)
+					} else {
+						found = append(found, value)
+					}
+				}
+			}
+			return found, len(found) > 0
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// allows reports whether the claim value, or for lists one of its elements,
+// is one of the exact values and, separately, whether one matches a pattern.
+func (r *rule) allows(value interface{}) bool {
+	if r.hasExact && !r.allowsExact(value) {
+		return false
+	}
+	if r.hasRegex && !anyElement(value, r.matches) {
+		return false
+	}
+	if len(r.lacking(value)) > 0 {
+		return false
+	}
+	for _, b := range r.bounds {
+		if !anyValue(value, b.allows) {
+			return false
+		}
+	}
+	if len(r.booleans) > 0 && !anyValue(value, r.allowsBoolean) {
+		return false
+	}
+	if r.deniesExact(value) || r.notInvalid || anyElement(value, r.notPatterns.matches) {
+		return false
+	}
+	return true
+}
+
+// required reports whether the rule requires the claim, i.e. has other
+// than claims_not_ requirements.
+func (r *rule) required() bool {
+	return r.hasExact || r.hasRegex || len(r.all) > 0 || len(r.bounds) > 0 || len(r.booleans) > 0
+}
+
+// lacking returns the claims_all_ values that are neither the claim value
+// nor one of its elements.
+func (r *rule) lacking(value interface{}) []string {
+	var lacking []string
+	for _, want := range r.all {
+		if !anyElement(value, func(s string) bool { return s == want }) {
+			lacking = append(lacking, want)
+		}
+	}
+	return lacking
+}
+
+func (r *rule) deniesExact(value interface{}) bool {
+	return anyElement(value, func(s string) bool {
+		_, ok := r.notExact[s]
+		return ok
+	})
+}
+
+// allows reports whether a claim is a number, or a string of one, within
+// the bound.
+func (b bound) allows(value interface{}) bool {
+	var n float64
+	switch value := value.(type) {
+	case float64:
+		n = value
+	case json.Number:
+		var err error
+		if n, err = value.Float64(); err != nil {
+			return false
+		}
+	case string:
+		var err error
+		if n, err = strconv.ParseFloat(value, 64); err != nil {
+			return false
+		}
+	default:
+		return false
+	}
+	if b.invalid {
+		return false
+	}
+	switch b.op {
+	case "gt":
+		return n > b.value
+	case "gte":
+		return n >= b.value
+	case "lt":
+		return n < b.value
+	default:
+		return n <= b.value
+	}
+}
+
+// allowsBoolean reports whether a claim is one of the booleans, as a bool
+// or a string, which some IdPs use for email_verified.
+func (r *rule) allowsBoolean(value interface{}) bool {
+	var s string
+	switch value := value.(type) {
+	case bool:
+		s = strconv.FormatBool(value)
+	case string:
+		s = value
+	default:
+		return false
+	}
+	for _, b := range r.booleans {
+		if s == b {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) allowsExact(value interface{}) bool {
+	return anyElement(value, func(s string) bool {
+		_, ok := r.exact[s]
+		return ok
+	})
+}
+
+func (r *patternSet) matches(value string) bool {
+	if r.matchAll {
+		return true
+	}
+	if _, ok := r.literals[value]; ok {
+		return true
+	}
+	for _, substr := range r.substrs {
+		if strings.Contains(value, substr) {
+			return true
+		}
+	}
+	for _, re := range r.patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// anyElement reports whether a string claim, or one of the strings in a list
+// claim, satisfies match.
+func anyElement(value interface{}, match func(string) bool) bool {
+	switch value := value.(type) {
+	case string:
+		return match(value)
+	case []interface{}:
+		for _, e := range value {
+			if s, ok := e.(string); ok && match(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// anyValue is anyElement for claims of any type.
+func anyValue(value interface{}, match func(interface{}) bool) bool {
+	if list, ok := value.([]interface{}); ok {
+		for _, e := range list {
+			if match(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return match(value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
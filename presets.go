@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// preset bundles the key source and token rules of a well-known identity
+// provider, selected with PRESET.
+type preset struct {
+	KeysURL    string
+	KeysFormat string
+	// DiscoveryIssuer is used to find KeysURL through OIDC discovery.
+	DiscoveryIssuer string
+	Checks          []validator.Check
+	// ParserOptions are added to the server's.
+	ParserOptions []jwt.ParserOption
+	// ClaimAliases and ResponseHeaders are defaults, merged into the
+	// server's configuration.
+	ClaimAliases    map[string]string
+	ClaimTransforms []func(claims jwt.MapClaims)
+	ResponseHeaders map[string]string
+	// TokenHeader is the request header carrying the token, if it isn't
+	// sent as an Authorization bearer token.
+	TokenHeader string
+	// NewKeyfunc replaces the JWKS at KeysURL for key sources of another
+	// format. KeysURL is still checked against the outbound policy.
+	NewKeyfunc func(client *http.Client) jwt.Keyfunc
+}
+
+var presets = map[string]func() (*preset, error){
+	"firebase":   firebasePreset,
+	"google":     googlePreset,
+	"cognito":    cognitoPreset,
+	"azure":      azurePreset,
+	"okta":       oktaPreset,
+	"github":     githubActionsPreset,
+	"gitlab":     gitlabPreset,
+	"cloudflare": cloudflareAccessPreset,
+	"alb":        albPreset,
+	"iap":        iapPreset,
+}
+
+func newPreset(name string) (*preset, error) {
+	if name == "" {
+		return nil, nil
+	}
+	newFunc, ok := presets[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown preset %q", name)
+	}
+	return newFunc()
+}
+
+// firebasePreset validates Firebase Auth ID tokens of FIREBASE_PROJECT_ID.
+func firebasePreset() (*preset, error) {
+	projectID := getenv("FIREBASE_PROJECT_ID", "")
+	if projectID == "" {
+		return nil, errors.New("firebase preset requires FIREBASE_PROJECT_ID")
+	}
+	return &preset{
+		KeysURL:    "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com",
+		KeysFormat: keysFormatX509,
+		Checks: []validator.Check{
+			issuerCheck("https://securetoken.google.com/" + projectID),
+			audienceCheck(projectID),
+			func(claims jwt.MapClaims) error {
+				if sub, _ := claims["sub"].(string); sub == "" {
+					return errors.New("missing sub")
+				}
+				if authTime, ok := claims["auth_time"].(float64); !ok || time.Unix(int64(authTime), 0).After(time.Now()) {
+					return errors.New("auth_time missing or in the future")
+				}
+				return nil
+			},
+		},
+	}, nil
+}
+
+// googlePreset validates Google Sign-In ID tokens issued to one of
+// GOOGLE_CLIENT_IDS, optionally restricted to Workspace GOOGLE_HOSTED_DOMAINS.
+func googlePreset() (*preset, error) {
+	clientIDs := splitList(getenv("GOOGLE_CLIENT_IDS", ""))
+	if len(clientIDs) == 0 {
+		return nil, errors.New("google preset requires GOOGLE_CLIENT_IDS")
+	}
+	p := &preset{
+		KeysURL:    "https://www.googleapis.com/oauth2/v1/certs",
+		KeysFormat: keysFormatX509,
+		Checks: []validator.Check{
+			issuerCheck("accounts.google.com", "https://accounts.google.com"),
+			audienceCheck(clientIDs...),
+		},
+	}
+	if domains := splitList(getenv("GOOGLE_HOSTED_DOMAINS", "")); len(domains) > 0 {
+		p.Checks = append(p.Checks, stringClaimCheck("hd", domains...))
+	}
+	return p, nil
+}
+
+// cognitoPreset validates tokens of the Cognito user pool COGNITO_USER_POOL_ID
+// in COGNITO_REGION. COGNITO_TOKEN_USE selects access (default) or ID tokens,
+// and COGNITO_CLIENT_IDS optionally restricts the app clients, which Cognito
+// puts in client_id for access tokens but in aud for ID tokens.
+func cognitoPreset() (*preset, error) {
+	region := getenv("COGNITO_REGION", "")
+	poolID := getenv("COGNITO_USER_POOL_ID", "")
+	if region == "" || poolID == "" {
+		return nil, errors.New("cognito preset requires COGNITO_REGION and COGNITO_USER_POOL_ID")
+	}
+	tokenUse := getenv("COGNITO_TOKEN_USE", "access")
+	if tokenUse != "access" && tokenUse != "id" {
+		return nil, fmt.Errorf("COGNITO_TOKEN_USE must be access or id, got %q", tokenUse)
+	}
+
+	issuer := fmt.Sprintf("https://cognito-idp.%s.amazonaws.com/%s", region, poolID)
+	p := &preset{
+		KeysURL:    issuer + "/.well-known/jwks.json",
+		KeysFormat: keysFormatJWKS,
+		Checks: []validator.Check{
+			issuerCheck(issuer),
+			stringClaimCheck("token_use", tokenUse),
+		},
+		ClaimAliases:    map[string]string{"groups": "cognito:groups"},
+		ResponseHeaders: map[string]string{"X-Auth-Request-Groups": "groups"},
+	}
+	if clientIDs := splitList(getenv("COGNITO_CLIENT_IDS", "")); len(clientIDs) > 0 {
+		if tokenUse == "id" {
+			p.Checks = append(p.Checks, audienceCheck(clientIDs...))
+		} else {
+			p.Checks = append(p.Checks, stringClaimCheck("client_id", clientIDs...))
+		}
+	}
+	return p, nil
+}
+
+// azurePreset validates Azure AD (Entra ID) v1 and v2 access and ID tokens of
+// the AZURE_TENANTS tenant ids for one of AZURE_AUDIENCES. The issuer must be
+// the v1 or v2 issuer of the token's own tid, so tokens of other tenants
+// signed with the shared keys are refused.
+//
+// When a user is in too many groups Azure AD leaves them out of the token and
+// marks it instead. Such tokens get a groups_overage claim, emitted as
+// X-Auth-Groups-Overage, so the upstream knows to ask Graph.
+func azurePreset() (*preset, error) {
+	tenants := splitList(getenv("AZURE_TENANTS", ""))
+	audiences := splitList(getenv("AZURE_AUDIENCES", ""))
+	if len(tenants) == 0 || len(audiences) == 0 {
+		return nil, errors.New("azure preset requires AZURE_TENANTS and AZURE_AUDIENCES")
+	}
+	return &preset{
+		KeysURL:    "https://login.microsoftonline.com/common/discovery/v2.0/keys",
+		KeysFormat: keysFormatJWKS,
+		Checks: []validator.Check{
+			stringClaimCheck("tid", tenants...),
+			func(claims jwt.MapClaims) error {
+				tid, _ := claims["tid"].(string)
+				return issuerCheck(
+					"https://sts.windows.net/"+tid+"/",
+					"https://login.microsoftonline.com/"+tid+"/v2.0",
+				)(claims)
+			},
+			audienceCheck(audiences...),
+		},
+		ClaimTransforms: []func(claims jwt.MapClaims){
+			func(claims jwt.MapClaims) {
+				if azureGroupsOverage(claims) {
+					claims["groups_overage"] = "true"
+				}
+			},
+		},
+		ResponseHeaders: map[string]string{
+			getenv("AZURE_GROUPS_OVERAGE_HEADER", "X-Auth-Groups-Overage"): "groups_overage",
+		},
+	}, nil
+}
+
+// azureGroupsOverage reports whether claims lack groups because the user is
+// in too many of them.
+func azureGroupsOverage(claims jwt.MapClaims) bool {
+	if claimNames, ok := claims["_claim_names"].(map[string]interface{}); ok {
+		if _, ok := claimNames["groups"]; ok {
+			return true
+		}
+	}
+	hasGroups, _ := claims["hasgroups"].(bool)
+	return hasGroups
+}
+
+// oktaPreset validates tokens of an Okta org (OKTA_DOMAIN). With
+// OKTA_AUTHORIZATION_SERVER set to "default" or a server id the tokens of that
+// custom authorization server are accepted, otherwise those of the org
+// authorization server. Keys are found through discovery, since org and custom
+// servers publish them under different non-standard paths (/oauth2/v1/keys,
+// /oauth2/<id>/v1/keys).
+//
+// Audiences default to api://default for the default authorization server;
+// org authorization server access tokens are only meant for Okta's own APIs,
+// so there OKTA_AUDIENCES has to name the client ids of the ID tokens.
+// OKTA_CLIENT_IDS optionally restricts access tokens by their cid claim.
+func oktaPreset() (*preset, error) {
+	domain := strings.TrimSuffix(strings.TrimPrefix(getenv("OKTA_DOMAIN", ""), "https://"), "/")
+	if domain == "" {
+		return nil, errors.New("okta preset requires OKTA_DOMAIN")
+	}
+	issuer := "https://" + domain
+	defaultAudience := ""
+	if server := getenv("OKTA_AUTHORIZATION_SERVER", ""); server != "" {
+		issuer += "/oauth2/" + server
+		if server == "default" {
+			defaultAudience = "api://default"
+		}
+	}
+	audiences := splitList(getenv("OKTA_AUDIENCES", defaultAudience))
+	if len(audiences) == 0 {
+		return nil, errors.New("okta preset requires OKTA_AUDIENCES")
+	}
+
+	p := &preset{
+		DiscoveryIssuer: issuer,
+		KeysFormat:      keysFormatJWKS,
+		Checks: []validator.Check{
+			issuerCheck(issuer),
+			audienceCheck(audiences...),
+		},
+	}
+	if clientIDs := splitList(getenv("OKTA_CLIENT_IDS", "")); len(clientIDs) > 0 {
+		p.Checks = append(p.Checks, stringClaimCheck("cid", clientIDs...))
+	}
+	return p, nil
+}
+
+// githubActionsPreset validates GitHub Actions OIDC tokens. Since any
+// workflow on GitHub can request such a token, both GITHUB_ACTIONS_AUDIENCES
+// and GITHUB_ACTIONS_REPOSITORIES are required, and tokens of pull request
+// runs are refused unless GITHUB_ACTIONS_ALLOW_PULL_REQUESTS is true.
+// GITHUB_ACTIONS_REFS, GITHUB_ACTIONS_ENVIRONMENTS and
+// GITHUB_ACTIONS_WORKFLOW_REFS narrow it down further. All of them take
+// patterns where * matches any characters, e.g. octo-org/* or refs/tags/v*.
+func githubActionsPreset() (*preset, error) {
+	audiences := splitList(getenv("GITHUB_ACTIONS_AUDIENCES", ""))
+	repositories := splitList(getenv("GITHUB_ACTIONS_REPOSITORIES", ""))
+	if len(audiences) == 0 || len(repositories) == 0 {
+		return nil, errors.New("github preset requires GITHUB_ACTIONS_AUDIENCES and GITHUB_ACTIONS_REPOSITORIES")
+	}
+	const issuer = "https://token.actions.githubusercontent.com"
+	p := &preset{
+		KeysURL:    issuer + "/.well-known/jwks",
+		KeysFormat: keysFormatJWKS,
+		Checks: []validator.Check{
+			issuerCheck(issuer),
+			audienceCheck(audiences...),
+			wildcardClaimCheck("repository", repositories),
+		},
+	}
+	if refs := splitList(getenv("GITHUB_ACTIONS_REFS", "")); len(refs) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("ref", refs))
+	}
+	if environments := splitList(getenv("GITHUB_ACTIONS_ENVIRONMENTS", "")); len(environments) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("environment", environments))
+	}
+	if workflowRefs := splitList(getenv("GITHUB_ACTIONS_WORKFLOW_REFS", "")); len(workflowRefs) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("job_workflow_ref", workflowRefs))
+	}
+	if getenv("GITHUB_ACTIONS_ALLOW_PULL_REQUESTS", "false") != "true" {
+		p.Checks = append(p.Checks, func(claims jwt.MapClaims) error {
+			switch event, _ := claims["event_name"].(string); event {
+			case "pull_request", "pull_request_target":
+				return fmt.Errorf("tokens of %s runs are not accepted", event)
+			}
+			return nil
+		})
+	}
+	return p, nil
+}
+
+// gitlabPreset validates GitLab CI ID tokens of the instance at GITLAB_URL
+// (default https://gitlab.com). GITLAB_AUDIENCES and one of
+// GITLAB_PROJECT_PATHS or GITLAB_NAMESPACE_PATHS are required. Only jobs of
+// protected refs are accepted unless GITLAB_REQUIRE_PROTECTED_REF is false.
+// GITLAB_REFS and GITLAB_ENVIRONMENTS narrow it down further; all paths, refs
+// and environments are patterns where * matches any characters.
+func gitlabPreset() (*preset, error) {
+	issuer := strings.TrimSuffix(getenv("GITLAB_URL", "https://gitlab.com"), "/")
+	audiences := splitList(getenv("GITLAB_AUDIENCES", ""))
+	projects := splitList(getenv("GITLAB_PROJECT_PATHS", ""))
+	namespaces := splitList(getenv("GITLAB_NAMESPACE_PATHS", ""))
+	if len(audiences) == 0 || (len(projects) == 0 && len(namespaces) == 0) {
+		return nil, errors.New("gitlab preset requires GITLAB_AUDIENCES and GITLAB_PROJECT_PATHS or GITLAB_NAMESPACE_PATHS")
+	}
+	p := &preset{
+		KeysURL:    issuer + "/oauth/discovery/keys",
+		KeysFormat: keysFormatJWKS,
+		Checks: []validator.Check{
+			issuerCheck(issuer),
+			audienceCheck(audiences...),
+		},
+	}
+	if len(projects) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("project_path", projects))
+	}
+	if len(namespaces) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("namespace_path", namespaces))
+	}
+	if refs := splitList(getenv("GITLAB_REFS", "")); len(refs) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("ref", refs))
+	}
+	if environments := splitList(getenv("GITLAB_ENVIRONMENTS", "")); len(environments) > 0 {
+		p.Checks = append(p.Checks, wildcardClaimCheck("environment", environments))
+	}
+	if getenv("GITLAB_REQUIRE_PROTECTED_REF", "true") == "true" {
+		p.Checks = append(p.Checks, stringClaimCheck("ref_protected", "true"))
+	}
+	return p, nil
+}
+
+// cloudflareAccessPreset validates the application tokens Cloudflare Access
+// sends to origins in the Cf-Access-Jwt-Assertion header. The keys and issuer
+// belong to the team domain CLOUDFLARE_TEAM_DOMAIN (e.g.
+// example.cloudflareaccess.com), and aud has to be the Application Audience
+// tag of one of CLOUDFLARE_AUDIENCES.
+func cloudflareAccessPreset() (*preset, error) {
+	teamDomain := strings.TrimSuffix(strings.TrimPrefix(getenv("CLOUDFLARE_TEAM_DOMAIN", ""), "https://"), "/")
+	audiences := splitList(getenv("CLOUDFLARE_AUDIENCES", ""))
+	if teamDomain == "" || len(audiences) == 0 {
+		return nil, errors.New("cloudflare preset requires CLOUDFLARE_TEAM_DOMAIN and CLOUDFLARE_AUDIENCES")
+	}
+	if !strings.Contains(teamDomain, ".") {
+		teamDomain += ".cloudflareaccess.com"
+	}
+	issuer := "https://" + teamDomain
+	return &preset{
+		KeysURL:    issuer + "/cdn-cgi/access/certs",
+		KeysFormat: keysFormatJWKS,
+		Checks: []validator.Check{
+			issuerCheck(issuer),
+			audienceCheck(audiences...),
+		},
+		TokenHeader: "Cf-Access-Jwt-Assertion",
+	}, nil
+}
+
+// iapPreset validates the x-goog-iap-jwt-assertion header Identity-Aware
+// Proxy adds to requests. The audience is derived from IAP_PROJECT_NUMBER and
+// either IAP_BACKEND_SERVICE_IDS (load balancer backends) or IAP_PROJECT_ID
+// (App Engine), or given in full with IAP_AUDIENCES.
+func iapPreset() (*preset, error) {
+	audiences := splitList(getenv("IAP_AUDIENCES", ""))
+	if projectNumber := getenv("IAP_PROJECT_NUMBER", ""); projectNumber != "" {
+		for _, serviceID := range splitList(getenv("IAP_BACKEND_SERVICE_IDS", "")) {
+			audiences = append(audiences, fmt.Sprintf("/projects/%s/global/backendServices/%s", projectNumber, serviceID))
+		}
+		if projectID := getenv("IAP_PROJECT_ID", ""); projectID != "" {
+			audiences = append(audiences, fmt.Sprintf("/projects/%s/apps/%s", projectNumber, projectID))
+		}
+	}
+	if len(audiences) == 0 {
+		return nil, errors.New("iap preset requires IAP_AUDIENCES, or IAP_PROJECT_NUMBER with IAP_BACKEND_SERVICE_IDS or IAP_PROJECT_ID")
+	}
+	return &preset{
+		KeysURL:    "https://www.gstatic.com/iap/verify/public_key-jwk",
+		KeysFormat: keysFormatJWKS,
+		Checks: []validator.Check{
+			issuerCheck("https://cloud.google.com/iap"),
+			audienceCheck(audiences...),
+		},
+		TokenHeader: "X-Goog-Iap-Jwt-Assertion",
+	}, nil
+}
+
+// wildcardClaimCheck requires the string claim name to match one of patterns,
+// where * matches any sequence of characters.
+func wildcardClaimCheck(name string, patterns []string) validator.Check {
+	return func(claims jwt.MapClaims) error {
+		actual, _ := claims[name].(string)
+		for _, pattern := range patterns {
+			if wildcardMatch(pattern, actual) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s %q not accepted", name, actual)
+	}
+}
+
+func wildcardMatch(pattern, value string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == value
+	}
+	if !strings.HasPrefix(value, parts[0]) {
+		return false
+	}
+	value = value[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(value, part)
+		if i < 0 {
+			return false
+		}
+		value = value[i+len(part):]
+	}
+	return strings.HasSuffix(value, parts[len(parts)-1])
+}
+
+// issuerCheck requires the iss claim to be one of issuers.
+func issuerCheck(issuers ...string) validator.Check {
+	check := stringClaimCheck("iss", issuers...)
+	return func(claims jwt.MapClaims) error {
+		if err := check(claims); err != nil {
+			return fmt.Errorf("%w: %w", jwt.ErrTokenInvalidIssuer, err)
+		}
+		return nil
+	}
+}
+
+// audienceCheck requires the aud claim to contain one of audiences.
+func audienceCheck(audiences ...string) validator.Check {
+	return func(claims jwt.MapClaims) error {
+		tokenAudiences, err := claims.GetAudience()
+		if err != nil {
+			return err
+		}
+		for _, aud := range audiences {
+			if slices.Contains(tokenAudiences, aud) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %v not accepted", jwt.ErrTokenInvalidAudience, claims["aud"])
+	}
+}
+
+// stringClaimCheck requires the string claim name to be one of values.
+func stringClaimCheck(name string, values ...string) validator.Check {
+	return func(claims jwt.MapClaims) error {
+		actual, _ := claims[name].(string)
+		for _, value := range values {
+			if actual == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%s %q not accepted", name, actual)
+	}
+}
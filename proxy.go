@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/robbilie/nginx-jwt-auth/policy"
+)
+
+// Supported values of PROXY_MODE. They select how the validation parameters
+// and the original request are read from an incoming /validate call.
+const (
+	// nginx auth_request: parameters are passed in the subrequest's query string.
+	proxyModeNginx = "nginx"
+	// Envoy HTTP ext_authz: the original request is forwarded as-is, so the
+	// parameters come from a header set by Envoy instead of the client's query.
+	proxyModeEnvoy = "envoy"
+	// Traefik forwardAuth: the original request is described by X-Forwarded-*
+	// headers and response headers are copied upstream via authResponseHeaders.
+	proxyModeTraefik = "traefik"
+	// Caddy forward_auth: same contract as Traefik, headers are copied
+	// upstream with copy_headers.
+	proxyModeCaddy = "caddy"
+)
+
+// originalRequest describes the client request a /validate call is made for.
+type originalRequest struct {
+	Method string `json:"method"`
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	URI    string `json:"uri"`
+}
+
+// originalRequest reconstructs the client request from the headers the
+// configured proxy sets on the validation request.
+func (s *server) originalRequest(r *http.Request) originalRequest {
+	switch s.ProxyMode {
+	case proxyModeEnvoy:
+		return originalRequest{
+			Method: r.Method,
+			Scheme: r.Header.Get("X-Forwarded-Proto"),
+			Host:   r.Host,
+			URI:    strings.TrimPrefix(r.URL.RequestURI(), "/validate"),
+		}
+	case proxyModeTraefik, proxyModeCaddy:
+		return originalRequest{
+			Method: r.Header.Get("X-Forwarded-Method"),
+			Scheme: r.Header.Get("X-Forwarded-Proto"),
+			Host:   r.Header.Get("X-Forwarded-Host"),
+			URI:    r.Header.Get("X-Forwarded-Uri"),
+		}
+	default:
+		orig := originalRequest{
+			Method: r.Header.Get("X-Original-Method"),
+			Scheme: r.Header.Get("X-Forwarded-Proto"),
+			Host:   r.Header.Get("X-Forwarded-Host"),
+			URI:    r.Header.Get("X-Original-URI"),
+		}
+		// ingress-nginx sends the full URL instead
+		if u, err := url.Parse(r.Header.Get("X-Original-URL")); err == nil && u.Host != "" {
+			orig.Scheme, orig.Host, orig.URI = u.Scheme, u.Host, u.RequestURI()
+		}
+		return orig
+	}
+}
+
+// requestParams returns the validation parameters (claims_*, headers_*,
+// cookie, ...) for r along with their compiled claim requirements. Falls
+// back to DEFAULT_PARAMS when none are given.
+func (s *server) requestParams(r *http.Request) (url.Values, *policy.Policy) {
+	var raw string
+	switch s.ProxyMode {
+	case proxyModeEnvoy:
+		// The query string belongs to the client's request, never trust it.
+		raw = r.Header.Get(s.ParamsHeader)
+	default:
+		raw = r.URL.RawQuery
+	}
+	if raw == "" {
+		if params, policy := s.defaults(); params != nil {
+			return params, policy
+		}
+	}
+	return s.parseParams(raw)
+}
+
+// methodAllowed reports whether the /validate endpoint accepts r's method.
+// Envoy forwards the original request method to the authorization service.
+func (s *server) methodAllowed(r *http.Request) bool {
+	if s.ProxyMode == proxyModeEnvoy {
+		return true
+	}
+	return r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+// writeDenied ends a request that failed validation. Envoy relays the
+// response to the client as-is, so it gets a body there.
+func (s *server) writeDenied(w http.ResponseWriter, status int) {
+	if s.ProxyMode == proxyModeEnvoy {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// loginLocation returns where to send the client of r to log in, or "" if
+// the denial d isn't answered with a redirect. Only requests lacking a valid
+// token are, if they accept HTML or have the login=true param; login=false
+// turns it off.
+func (s *server) loginLocation(r *http.Request, params url.Values, d denial) string {
+	if s.LoginURL == "" || d.status != http.StatusUnauthorized || d.internal || (d.stage != "request" && d.stage != "token") {
+		return ""
+	}
+	switch params.Get("login") {
+	case "false":
+		return ""
+	case "true":
+	default:
+		if !strings.Contains(r.Header.Get("Accept"), "text/html") {
+			return ""
+		}
+	}
+	orig := s.originalRequest(r)
+	rd := orig.URI
+	if orig.Host != "" {
+		scheme := orig.Scheme
+		if scheme == "" {
+			scheme = "https"
+		}
+		rd = scheme + "://" + orig.Host + orig.URI
+	}
+	if rd == "" {
+		return s.LoginURL
+	}
+	return appendQuery(s.LoginURL, url.Values{s.LoginRedirectParam: {rd}})
+}
+
+// writeLoginRedirect sends the client to location. nginx's auth_request
+// can't pass a redirect on, so it gets a 401 with the Location to redirect
+// to from an error_page.
+func (s *server) writeLoginRedirect(w http.ResponseWriter, r *http.Request, location string) {
+	if s.ProxyMode == proxyModeNginx {
+		w.Header().Set("Location", location)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+// setBearerChallenge sets the WWW-Authenticate header of RFC 6750 on a
+// denial, so API clients can tell a missing token from an invalid one or
+// one lacking claims. Other denials, like those of the method, get none.
+func (s *server) setBearerChallenge(w http.ResponseWriter, d denial) {
+	var params []string
+	if s.BearerRealm != "" {
+		params = append(params, "realm="+quote(s.BearerRealm))
+	}
+	var code string
+	switch {
+	case d.reason == ErrNoToken:
+		// A request without a token gets no error code
+	case d.stage == "token":
+		code = "invalid_token"
+	case d.stage == "policy" || d.stage == "authorization":
+		code = "insufficient_scope"
+	default:
+		return
+	}
+	if code != "" {
+		params = append(params, "error="+quote(code))
+		if s.BearerDescriptions {
+			params = append(params, "error_description="+quote(d.reason.Error()))
+		}
+	}
+	challenge := "Bearer"
+	if len(params) > 0 {
+		challenge += " " + strings.Join(params, ", ")
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+}
+
+// quote makes s a quoted-string of RFC 9110.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
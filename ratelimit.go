@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var rateLimitedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "nginx_subrequest_auth_jwt_rate_limited_total",
+	Help: "Number of validations refused because the client exceeded RATE_LIMIT",
+})
+
+func init() {
+	prometheus.MustRegister(rateLimitedTotal)
+}
+
+// Keys to rate limit clients by
+const (
+	rateLimitKeyIP  = "ip"
+	rateLimitKeySub = "sub"
+)
+
+// rateLimiter is a token bucket per client, so a client hammering /validate
+// with bad tokens can't keep the CPU busy checking signatures.
+type rateLimiter struct {
+	Limit rate.Limit
+	Burst int
+	// Key is what identifies a client, rateLimitKeyIP or rateLimitKeySub
+	Key string
+	// TrustedProxies are the peers whose X-Forwarded-For is believed
+	TrustedProxies []netip.Prefix
+
+	mu      sync.Mutex
+	buckets *lruCache[*rate.Limiter]
+}
+
+// rateLimitIdle is how long the bucket of a client is kept after its last
+// request. A full bucket is as good as a new one by then.
+const rateLimitIdle = 10 * time.Minute
+
+func newRateLimiter() (*rateLimiter, error) {
+	limit, err := strconv.ParseFloat(getenv("RATE_LIMIT", "0"), 64)
+	if err != nil || limit < 0 {
+		return nil, fmt.Errorf("couldn't parse RATE_LIMIT %q as requests per second", getenv("RATE_LIMIT", "0"))
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	burst, err := strconv.Atoi(getenv("RATE_LIMIT_BURST", strconv.Itoa(max(1, int(limit)))))
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("couldn't parse RATE_LIMIT_BURST %q as a positive number", getenv("RATE_LIMIT_BURST", ""))
+	}
+	key := getenv("RATE_LIMIT_KEY", rateLimitKeyIP)
+	if key != rateLimitKeyIP && key != rateLimitKeySub {
+		return nil, fmt.Errorf("unknown RATE_LIMIT_KEY %q, expected ip or sub", key)
+	}
+	var trusted []netip.Prefix
+	for _, entry := range splitList(getenv("RATE_LIMIT_TRUSTED_PROXIES", "")) {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("couldn't parse RATE_LIMIT_TRUSTED_PROXIES entry %q as an address or CIDR", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	size, err := strconv.Atoi(getenv("RATE_LIMIT_CLIENTS", "100000"))
+	if err != nil || size < 1 {
+		return nil, fmt.Errorf("couldn't parse RATE_LIMIT_CLIENTS %q as a positive number", getenv("RATE_LIMIT_CLIENTS", ""))
+	}
+	return &rateLimiter{
+		Limit:          rate.Limit(limit),
+		Burst:          burst,
+		Key:            key,
+		TrustedProxies: trusted,
+		buckets:        newLRUCache[*rate.Limiter](size),
+	}, nil
+}
+
+// allow returns ErrRateLimited if the client r comes from may not have a
+// token verified now. By IP, it takes a token from the client's bucket. By
+// sub, the sub isn't known before the token is verified, so only the IPs
+// whose failed verifications emptied their bucket are refused.
+func (l *rateLimiter) allow(r *http.Request) error {
+	client := "ip:" + l.clientIP(r)
+	bucket := l.bucket(client)
+	if l.Key == rateLimitKeySub {
+		if bucket.Tokens() < 1 {
+			return l.limited(client)
+		}
+		return nil
+	}
+	if !bucket.Allow() {
+		return l.limited(client)
+	}
+	return nil
+}
+
+// verified counts the verification of a token of r by sub, with err being
+// its outcome: a failed one against the IP r comes from, so forged tokens
+// can't claim another sub, an accepted one against its sub. Tokens without
+// a sub count against the IP too. It returns ErrRateLimited for accepted
+// tokens whose bucket is empty, and err otherwise.
+func (l *rateLimiter) verified(r *http.Request, claims jwt.MapClaims, err error) error {
+	if l.Key != rateLimitKeySub {
+		return err
+	}
+	client := "ip:" + l.clientIP(r)
+	if sub, _ := claims["sub"].(string); err == nil && sub != "" {
+		client = "sub:" + sub
+	}
+	if !l.bucket(client).Allow() && err == nil {
+		return l.limited(client)
+	}
+	return err
+}
+
+// bucket returns the bucket of client, keeping it for rateLimitIdle.
+func (l *rateLimiter) bucket(client string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket, ok := l.buckets.get(client)
+	if !ok {
+		bucket = rate.NewLimiter(l.Limit, l.Burst)
+	}
+	// Set anew to keep it for rateLimitIdle after this request
+	l.buckets.set(client, bucket, rateLimitIdle)
+	return bucket
+}
+
+func (l *rateLimiter) limited(client string) error {
+	rateLimitedTotal.Inc()
+	return fmt.Errorf("%w: %s", ErrRateLimited, client)
+}
+
+// clientIP returns the address the request to validate came from: the peer
+// address, unless that is one of the TrustedProxies. Then it's the last
+// X-Forwarded-For entry that isn't one of them, the one the proxies in
+// front added for the client.
+func (l *rateLimiter) clientIP(r *http.Request) string {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !l.trusted(client) {
+		return client
+	}
+	var entries []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		entries = append(entries, strings.Split(value, ",")...)
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := strings.TrimSpace(entries[i])
+		if entry == "" {
+			continue
+		}
+		client = entry
+		if !l.trusted(entry) {
+			break
+		}
+	}
+	return client
+}
+
+// trusted reports whether addr is one of the TrustedProxies.
+func (l *rateLimiter) trusted(addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return false
+	}
+	ip = ip.Unmap()
+	for _, prefix := range l.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+// redisKeyPrefix namespaces result keys in shared caches
+const redisKeyPrefix = "jwt-auth:result:"
+
+// redisCache shares results between replicas through Redis. Redis being
+// unavailable only costs the cache: errors are logged and count as misses.
+type redisCache struct {
+	client  *redis.Client
+	logger  logger.Logger
+	timeout time.Duration
+}
+
+func newRedisCache(logger logger.Logger) (*redisCache, error) {
+	client, err := newRedisClient()
+	if err != nil {
+		return nil, err
+	}
+	return &redisCache{client: client, logger: logger, timeout: 100 * time.Millisecond}, nil
+}
+
+// newRedisClient connects to the Redis at REDIS_URL.
+func newRedisClient() (*redis.Client, error) {
+	opts, err := redis.ParseURL(getenv("REDIS_URL", "redis://localhost:6379/0"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+func (c *redisCache) get(key string) (jwt.MapClaims, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	value, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false
+	}
+	if err != nil {
+		c.logger.Warnw("Failed to read from Redis", "err", err)
+		return nil, false
+	}
+	claims, err := decodeResult(value)
+	if err != nil {
+		c.logger.Warnw("Failed to decode cached result", "err", err)
+		return nil, false
+	}
+	return claims, true
+}
+
+func (c *redisCache) set(key string, claims jwt.MapClaims, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	value, err := encodeResult(claims)
+	if err != nil {
+		c.logger.Warnw("Failed to encode result", "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.client.Set(ctx, redisKeyPrefix+key, value, ttl).Err(); err != nil {
+		c.logger.Warnw("Failed to write to Redis", "err", err)
+	}
+}
+
+// redisKeySetPrefix namespaces key set responses, followed by their URL
+const redisKeySetPrefix = "jwt-auth:keyset:"
+
+// redisKeySets shares the responses of key set URLs between replicas. A
+// replica starting up uses a set another one fetched lately instead of
+// fetching it too, and the last one fetched if the IdP is down. Like the
+// result cache, Redis failing only costs the sharing.
+type redisKeySets struct {
+	client  *redis.Client
+	logger  logger.Logger
+	timeout time.Duration
+}
+
+// get returns the last response of url any replica fetched, however old.
+func (c *redisKeySets) get(url string) (warmKeySet, bool) {
+	if c == nil {
+		return warmKeySet{}, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	value, err := c.client.Get(ctx, redisKeySetPrefix+url).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return warmKeySet{}, false
+	}
+	var set warmKeySet
+	if err == nil {
+		err = json.Unmarshal(value, &set)
+	}
+	if err != nil {
+		c.logger.Warnw("Failed to read key set from Redis", "url", url, "err", err)
+		return warmKeySet{}, false
+	}
+	return set, true
+}
+
+func (c *redisKeySets) set(url string, set warmKeySet) {
+	if c == nil {
+		return
+	}
+	value, err := json.Marshal(set)
+	if err != nil {
+		c.logger.Warnw("Failed to encode key set", "url", url, "err", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	if err := c.client.Set(ctx, redisKeySetPrefix+url, value, 0).Err(); err != nil {
+		c.logger.Warnw("Failed to write key set to Redis", "url", url, "err", err)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadAll runs every reloader, even if one of them fails. Whatever fails
+// to reload stays as it was. Tokens rejected before may pass now, and those
+// accepted may have been verified with a key that was removed, so both are
+// forgotten.
+func (s *server) reloadAll() (reloaded []string, failed map[string]string) {
+	reloaded = []string{}
+	for _, rl := range s.Reloaders {
+		if err := rl.reload(); err != nil {
+			s.Logger.Errorw("Reload failed", "name", rl.name, "err", err)
+			if failed == nil {
+				failed = map[string]string{}
+			}
+			failed[rl.name] = err.Error()
+			continue
+		}
+		reloaded = append(reloaded, rl.name)
+	}
+	if s.Rejected != nil {
+		s.Rejected.purge()
+	}
+	s.purgeResults()
+	s.Logger.Infow("Reloaded configuration", "reloaded", reloaded)
+	return reloaded, failed
+}
+
+// reloadDelay is how long to wait for more changes before reloading, as
+// editors and the kubelet write files in several steps.
+const reloadDelay = 200 * time.Millisecond
+
+// watchReloads reloads on SIGHUP and, if watch is set, whenever one of
+// paths, or a file in one that is a directory, changes. It watches their
+// directories, as Kubernetes updates
+// mounted ConfigMaps and Secrets by swapping a symlink rather than writing
+// the files.
+func (s *server) watchReloads(paths []string, watch bool) error {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	var changes <-chan fsnotify.Event
+	var errs <-chan error
+	watched := map[string]bool{}
+	if watch && len(paths) > 0 {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		for _, path := range paths {
+			path = filepath.Clean(path)
+			watched[path] = true
+			dir := filepath.Dir(path)
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				// Any change of a file in it counts
+				dir = path
+			}
+			if err := watcher.Add(dir); err != nil {
+				watcher.Close()
+				return err
+			}
+		}
+		changes, errs = watcher.Events, watcher.Errors
+	}
+
+	go func() {
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-hangups:
+				s.Logger.Infow("Received SIGHUP, reloading")
+				s.reloadAll()
+			case event := <-changes:
+				name := filepath.Clean(event.Name)
+				if watched[name] || watched[filepath.Dir(name)] || filepath.Base(name) == "..data" {
+					pending = time.After(reloadDelay)
+				}
+			case <-pending:
+				pending = nil
+				s.reloadAll()
+			case err := <-errs:
+				s.Logger.Warnw("Watching configuration files failed", "err", err)
+			}
+		}
+	}()
+	return nil
+}
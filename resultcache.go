@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+var resultCacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "nginx_subrequest_auth_jwt_result_cache_total",
+	Help: "Number of result cache lookups, by whether they found a valid token, an invalid one or nothing",
+}, []string{"result"})
+
+func init() {
+	for _, result := range []string{"hit", "negative_hit", "miss"} {
+		resultCacheLookups.WithLabelValues(result)
+	}
+	prometheus.MustRegister(resultCacheLookups)
+}
+
+// resultCache stores the outcome of verifying a token, keyed by its hash:
+// the verified and enriched claims, or nil for an invalid token. Claim
+// requirements are checked on every request, cached or not. Cached claims
+// are shared between requests and must not be modified.
+type resultCache interface {
+	get(key string) (claims jwt.MapClaims, found bool)
+	set(key string, claims jwt.MapClaims, ttl time.Duration)
+}
+
+// cachedResults wraps a resultCache with the TTLs to apply. Positive results
+// never outlive the token.
+type cachedResults struct {
+	cache       resultCache
+	ttl         time.Duration
+	negativeTTL time.Duration
+}
+
+func newCachedResults(logger logger.Logger) (*cachedResults, error) {
+	ttl, err := time.ParseDuration(getenv("RESULT_CACHE_TTL", "1m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RESULT_CACHE_TTL: %w", err)
+	}
+	negativeTTL, err := time.ParseDuration(getenv("RESULT_CACHE_NEGATIVE_TTL", "10s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid RESULT_CACHE_NEGATIVE_TTL: %w", err)
+	}
+	c := &cachedResults{ttl: ttl, negativeTTL: negativeTTL}
+	switch backend := getenv("RESULT_CACHE", ""); backend {
+	case "memory":
+		size, err := strconv.Atoi(getenv("RESULT_CACHE_SIZE", "10000"))
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid RESULT_CACHE_SIZE %q", getenv("RESULT_CACHE_SIZE", ""))
+		}
+		c.cache = &memoryCache{lru: newLRUCache[jwt.MapClaims](size)}
+	case "redis":
+		c.cache, err = newRedisCache(logger)
+	case "memcached":
+		c.cache, err = newMemcachedCache(logger)
+	default:
+		return nil, fmt.Errorf("unknown RESULT_CACHE %q", backend)
+	}
+	return c, err
+}
+
+func (c *cachedResults) get(raw string) (jwt.MapClaims, bool) {
+	claims, found := c.cache.get(tokenHash(raw))
+	resultCacheLookups.WithLabelValues(cacheResult(claims, found)).Inc()
+	return claims, found
+}
+
+// cacheResult names the result of a lookup: hit, negative_hit or miss.
+func cacheResult(claims jwt.MapClaims, found bool) string {
+	switch {
+	case !found:
+		return "miss"
+	case claims == nil:
+		return "negative_hit"
+	}
+	return "hit"
+}
+
+func (c *cachedResults) set(raw string, claims jwt.MapClaims) {
+	if claims == nil {
+		c.cache.set(tokenHash(raw), nil, c.negativeTTL)
+		return
+	}
+	c.cache.set(tokenHash(raw), claims, ttlUntilExpiry(claims, c.ttl))
+}
+
+// encodeResult and decodeResult serialize results for remote caches. An
+// invalid token is stored as JSON null.
+func encodeResult(claims jwt.MapClaims) ([]byte, error) {
+	return json.Marshal(claims)
+}
+
+func decodeResult(value []byte) (jwt.MapClaims, error) {
+	var claims jwt.MapClaims
+	err := json.Unmarshal(value, &claims)
+	return claims, err
+}
+
+// purgeResults empties the in-process result cache, returning the number of
+// results dropped and whether there is one. Results in redis or memcached
+// are shared with other replicas and left alone.
+func (s *server) purgeResults() (int, bool) {
+	if s.Results == nil {
+		return 0, false
+	}
+	memory, ok := s.Results.cache.(*memoryCache)
+	if !ok {
+		return 0, false
+	}
+	return memory.lru.purge(), true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+)
+
+// Claims a revocation list entry can refer to
+const (
+	revokeJTI = "jti"
+	revokeSub = "sub"
+)
+
+// redisRevokedPrefix namespaces revocations in Redis, followed by the claim
+// and its value, e.g. jwt-auth:revoked:jti:<id>.
+const redisRevokedPrefix = "jwt-auth:revoked:"
+
+// revocations is a list of revoked token ids and subjects, read from a file
+// with one "jti:<id>" or "sub:<subject>" entry per line. The file is reread
+// whenever it changes, and OnChange is called with the new entries. Admins
+// can revoke more through the API, in process or, with Redis, for all
+// replicas.
+type revocations struct {
+	// path is empty without REVOCATION_FILE
+	path   string
+	logger logger.Logger
+	// refreshing serializes the watcher and reloads requested by admins
+	refreshing sync.Mutex
+
+	mu      sync.RWMutex
+	entries map[string]string // claim:value -> claim
+	modTime time.Time
+	// added are revoked through the admin API, by claim:value, until they
+	// expire; the zero time never does
+	added    map[string]time.Time
+	OnChange func(entries map[string]string)
+
+	// redis, if set, holds the revocations shared by all replicas
+	redis   *redis.Client
+	timeout time.Duration
+}
+
+func newRevocations(logger logger.Logger, path string) (*revocations, error) {
+	r := &revocations{path: path, logger: logger, entries: map[string]string{}, added: map[string]time.Time{}, timeout: 100 * time.Millisecond}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload rereads the file if it changed, reporting whether it did.
+func (r *revocations) reload() (bool, error) {
+	if r.path == "" {
+		return false, nil
+	}
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(r.modTime) {
+		return false, nil
+	}
+	content, err := readConfigFile(r.path)
+	if err != nil {
+		return false, err
+	}
+
+	entries := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		claimName, value, found := strings.Cut(entry, ":")
+		if !found || (claimName != revokeJTI && claimName != revokeSub) || value == "" {
+			return false, fmt.Errorf("%s:%d: expected jti:<id> or sub:<subject>", r.path, line)
+		}
+		entries[entry] = claimName
+	}
+	if err := scanner.Err(); err != nil {
+		return false, err
+	}
+
+	r.mu.Lock()
+	r.entries = entries
+	r.modTime = info.ModTime()
+	r.mu.Unlock()
+	return true, nil
+}
+
+// watch polls the file for changes every interval.
+func (r *revocations) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := r.refresh(); err != nil {
+			r.logger.Errorw("Failed to reload revocation list", "path", r.path, "err", err)
+		}
+	}
+}
+
+// refresh reloads the file if it changed and passes the new entries on.
+func (r *revocations) refresh() error {
+	r.refreshing.Lock()
+	defer r.refreshing.Unlock()
+	changed, err := r.reload()
+	if err != nil || !changed {
+		return err
+	}
+	r.logger.Infow("Reloaded revocation list", "path", r.path, "entries", len(r.snapshot()))
+	if r.OnChange != nil {
+		r.OnChange(r.snapshot())
+	}
+	return nil
+}
+
+// snapshot returns the entries of the file along with those added that
+// haven't expired, by claim:value.
+func (r *revocations) snapshot() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.added) == 0 {
+		return r.entries
+	}
+	entries := maps.Clone(r.entries)
+	now := time.Now()
+	for key, expires := range r.added {
+		if expires.IsZero() || now.Before(expires) {
+			claimName, _, _ := strings.Cut(key, ":")
+			entries[key] = claimName
+		}
+	}
+	return entries
+}
+
+// check is checked on every request, even for cached results, so tokens
+// are denied as soon as they are revoked. Should Redis fail, only the
+// revocations in process apply.
+func (r *revocations) check(claims jwt.MapClaims) error {
+	if err := r.checkLocal(claims); err != nil {
+		return err
+	}
+	if r.redis != nil {
+		return r.checkRedis(claims)
+	}
+	return nil
+}
+
+func (r *revocations) checkLocal(claims jwt.MapClaims) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, claimName := range []string{revokeJTI, revokeSub} {
+		value, ok := claims[claimName].(string)
+		if !ok {
+			continue
+		}
+		key := claimName + ":" + value
+		expires, added := r.added[key]
+		if r.entries[key] != "" || (added && (expires.IsZero() || time.Now().Before(expires))) {
+			return fmt.Errorf("%s %q is revoked", claimName, value)
+		}
+	}
+	return nil
+}
+
+func (r *revocations) checkRedis(claims jwt.MapClaims) error {
+	var keys, names []string
+	for _, claimName := range []string{revokeJTI, revokeSub} {
+		if value, ok := claims[claimName].(string); ok {
+			keys = append(keys, redisRevokedPrefix+claimName+":"+value)
+			names = append(names, fmt.Sprintf("%s %q", claimName, value))
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	values, err := r.redis.MGet(ctx, keys...).Result()
+	if err != nil {
+		r.logger.Warnw("Failed to read revocations from Redis", "err", err)
+		return nil
+	}
+	for i, value := range values {
+		if value != nil {
+			return fmt.Errorf("%s is revoked", names[i])
+		}
+	}
+	return nil
+}
+
+// revoke adds a revocation, for ttl unless that is 0. With Redis, it
+// applies to all replicas.
+func (r *revocations) revoke(claimName, value string, ttl time.Duration) error {
+	if r.redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return r.redis.Set(ctx, redisRevokedPrefix+claimName+":"+value, "1", ttl).Err()
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = time.Now().Add(ttl)
+	}
+	r.mu.Lock()
+	now := time.Now()
+	for key, expires := range r.added {
+		if !expires.IsZero() && now.After(expires) {
+			delete(r.added, key)
+		}
+	}
+	r.added[claimName+":"+value] = expires
+	r.mu.Unlock()
+	r.changed()
+	return nil
+}
+
+// unrevoke removes a revocation added by revoke. Those of the file stay.
+func (r *revocations) unrevoke(claimName, value string) error {
+	if r.redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return r.redis.Del(ctx, redisRevokedPrefix+claimName+":"+value).Err()
+	}
+	r.mu.Lock()
+	delete(r.added, claimName+":"+value)
+	r.mu.Unlock()
+	r.changed()
+	return nil
+}
+
+func (r *revocations) changed() {
+	if r.OnChange != nil {
+		r.OnChange(r.snapshot())
+	}
+}
+
+// checkRevoked denies revoked tokens like a Check would.
+func (s *server) checkRevoked(claims jwt.MapClaims) error {
+	if s.Revocations == nil {
+		return nil
+	}
+	if err := s.Revocations.check(claims); err != nil {
+		return fmt.Errorf("%w: %w", validator.ErrClaims, err)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+)
+
+// drainer shuts the servers down gracefully on SIGTERM, so rolling deploys
+// don't cut off requests: health checks fail first, so that nginx and
+// Kubernetes stop sending requests, then the requests in flight finish.
+type drainer struct {
+	// Delay is how long health checks fail before the listeners close,
+	// long enough for readiness probes to notice.
+	Delay time.Duration
+	// Timeout bounds waiting for the requests in flight.
+	Timeout time.Duration
+	// GRPC is drained alike if not nil, GRPCHealth reports it.
+	GRPC       *grpc.Server
+	GRPCHealth *health.Server
+	// Admin is the server of ADMIN_PORT, shut down last as it answers the
+	// health checks.
+	Admin httpServer
+
+	draining atomic.Bool
+}
+
+func newDrainer() (*drainer, error) {
+	delay, err := time.ParseDuration(getenv("SHUTDOWN_DELAY", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse SHUTDOWN_DELAY: %w", err)
+	}
+	timeout, err := time.ParseDuration(getenv("SHUTDOWN_TIMEOUT", "20s"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse SHUTDOWN_TIMEOUT: %w", err)
+	}
+	return &drainer{Delay: delay, Timeout: timeout}, nil
+}
+
+// healthz answers health checks, with 503 once draining.
+func (d *drainer) healthz(w http.ResponseWriter, r *http.Request) {
+	if d.draining.Load() {
+		http.Error(w, "draining", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
+
+// drainOnSignal waits for SIGTERM or an interrupt and then drains srv,
+// calling stopped once it's done.
+func (d *drainer) drainOnSignal(s *server, srv httpServer, stopped func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	s.Logger.Infow("Draining", "delay", d.Delay, "timeout", d.Timeout)
+	d.draining.Store(true)
+	if d.GRPCHealth != nil {
+		// Reports NOT_SERVING from now on
+		d.GRPCHealth.Shutdown()
+	}
+	time.Sleep(d.Delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	if d.GRPC != nil {
+		go func() {
+			<-ctx.Done()
+			// Cuts off the streams still open
+			d.GRPC.Stop()
+		}()
+		go func() {
+			d.GRPC.GracefulStop()
+			close(grpcStopped)
+		}()
+	} else {
+		close(grpcStopped)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		s.Logger.Warnw("Requests still in flight were cut off", "err", err)
+	}
+	<-grpcStopped
+	if d.Admin != nil {
+		if err := d.Admin.Shutdown(ctx); err != nil {
+			s.Logger.Warnw("Admin requests still in flight were cut off", "err", err)
+		}
+	}
+	stopped()
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadedConfig records the configuration the service runs with: the
+// environment variables it read and the files it loaded.
+var loadedConfig = &configSnapshot{env: map[string]struct{}{}, files: map[string]loadedFile{}}
+
+type configSnapshot struct {
+	mu    sync.Mutex
+	env   map[string]struct{}
+	files map[string]loadedFile
+}
+
+type loadedFile struct {
+	// content is only kept for files whose diffs can be shown, see
+	// readPolicyFile
+	content []byte
+	hash    string
+	loaded  time.Time
+}
+
+// useEnv records that the environment variable name is read.
+func (c *configSnapshot) useEnv(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.env[name] = struct{}{}
+}
+
+// readConfigFile reads a file the service is configured with, recording
+// its hash. Its content isn't kept, as keys, secrets and credentials must
+// not show up in drift diffs.
+func readConfigFile(path string) ([]byte, error) {
+	return loadedConfig.read(path, false)
+}
+
+// readPolicyFile reads the file at CONFIG_PATH like readConfigFile, but
+// keeps its content, so its drift can be shown line by line.
+func readPolicyFile(path string) ([]byte, error) {
+	return loadedConfig.read(path, true)
+}
+
+func (c *configSnapshot) read(path string, keep bool) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	file := loadedFile{hash: sha256Hex(content), loaded: time.Now()}
+	if keep {
+		file.content = content
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[path] = file
+	return content, nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// secretEnv reports whether the value of an environment variable must not
+// be shown.
+func secretEnv(name string) bool {
+	for _, word := range []string{"SECRET", "TOKEN", "PASSWORD", "CREDENTIALS"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// snapshotFile is a loaded file as the admin API shows it.
+type snapshotFile struct {
+	Hash   string    `json:"hash"`
+	Loaded time.Time `json:"loaded"`
+}
+
+// snapshot is the configuration as the admin API shows it. Hash covers the
+// values of all environment variables set, secrets included, and the hashes
+// of the files, so it changes whenever any of them does.
+type snapshot struct {
+	Hash  string                  `json:"hash"`
+	Taken time.Time               `json:"taken"`
+	Env   map[string]string       `json:"env"`
+	Files map[string]snapshotFile `json:"files"`
+}
+
+func (c *configSnapshot) snapshot() snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := snapshot{Taken: time.Now(), Env: map[string]string{}, Files: map[string]snapshotFile{}}
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(c.env)) {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(h, "%s=%s\n", name, value)
+		if secretEnv(name) {
+			value = "xxxxx"
+		} else if u, err := url.Parse(value); err == nil && u.User != nil {
+			// e.g. the password of REDIS_URL
+			value = u.Redacted()
+		}
+		s.Env[name] = value
+	}
+	for _, path := range slices.Sorted(maps.Keys(c.files)) {
+		file := c.files[path]
+		fmt.Fprintf(h, "%s %s\n", path, file.hash)
+		s.Files[path] = snapshotFile{Hash: file.hash, Loaded: file.loaded}
+	}
+	s.Hash = hex.EncodeToString(h.Sum(nil))
+	return s
+}
+
+// fileDrift compares a loaded file with the file on disk.
+type fileDrift struct {
+	Loaded  string `json:"loaded"`
+	OnDisk  string `json:"on_disk,omitempty"`
+	Drifted bool   `json:"drifted"`
+	Error   string `json:"error,omitempty"`
+	// Diff lists the lines removed from (-) and added to (+) the loaded
+	// file, unless the files are too large to compare. Only the file at
+	// CONFIG_PATH has one.
+	Diff []string `json:"diff,omitempty"`
+}
+
+func (c *configSnapshot) drift() map[string]fileDrift {
+	c.mu.Lock()
+	files := make(map[string]loadedFile, len(c.files))
+	for path, file := range c.files {
+		files[path] = file
+	}
+	c.mu.Unlock()
+
+	drifts := make(map[string]fileDrift, len(files))
+	for path, file := range files {
+		d := fileDrift{Loaded: file.hash}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			d.Drifted, d.Error = true, err.Error()
+		} else if d.OnDisk = sha256Hex(content); d.OnDisk != d.Loaded {
+			d.Drifted = true
+			if file.content != nil {
+				d.Diff = lineDiff(string(file.content), string(content))
+			}
+		}
+		drifts[path] = d
+	}
+	return drifts
+}
+
+// maxDiffCells bounds the size of the table lineDiff builds.
+const maxDiffCells = 1 << 22
+
+// lineDiff returns the lines to remove from a and add to get b, based on
+// their longest common subsequence. It returns nil for large inputs.
+func lineDiff(a, b string) []string {
+	as, bs := strings.Split(a, "\n"), strings.Split(b, "\n")
+	if len(as)*len(bs) > maxDiffCells {
+		return nil
+	}
+	// lcs[i][j] is the length of the LCS of as[i:] and bs[j:]
+	lcs := make([][]int, len(as)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bs)+1)
+	}
+	for i := len(as) - 1; i >= 0; i-- {
+		for j := len(bs) - 1; j >= 0; j-- {
+			if as[i] == bs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(as) || j < len(bs) {
+		switch {
+		case i < len(as) && j < len(bs) && as[i] == bs[j]:
+			i, j = i+1, j+1
+		case i < len(as) && (j == len(bs) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, "-"+as[i])
+			i++
+		default:
+			diff = append(diff, "+"+bs[j])
+			j++
+		}
+	}
+	return diff
+}
+
+// adminConfig shows the loaded configuration.
+func (s *server) adminConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, loadedConfig.snapshot())
+}
+
+// adminConfigDrift compares the loaded files with those on disk.
+func (s *server) adminConfigDrift(w http.ResponseWriter, r *http.Request) {
+	drifts := loadedConfig.drift()
+	drifted := false
+	for _, d := range drifts {
+		drifted = drifted || d.Drifted
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Hash    string               `json:"hash"`
+		Drifted bool                 `json:"drifted"`
+		Files   map[string]fileDrift `json:"files"`
+	}{loadedConfig.snapshot().Hash, drifted, drifts})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/validator"
+	"github.com/spiffe/go-spiffe/v2/spiffeid"
+	"github.com/spiffe/go-spiffe/v2/workloadapi"
+)
+
+// newSPIFFEKeyfunc returns a Keyfunc resolving JWT-SVID signing keys from the
+// trust bundles the SPIRE Workload API hands out. The socket is taken from
+// SPIFFE_ENDPOINT_SOCKET. The bundle for the token's trust domain is picked by
+// its subject, so federated trust domains work too.
+func newSPIFFEKeyfunc(ctx context.Context) (jwt.Keyfunc, error) {
+	source, err := workloadapi.NewJWTSource(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the Workload API: %w", err)
+	}
+	return func(token *jwt.Token) (interface{}, error) {
+		sub, _ := token.Claims.(jwt.MapClaims)["sub"].(string)
+		id, err := spiffeid.FromString(sub)
+		if err != nil {
+			return nil, fmt.Errorf("subject is not a SPIFFE ID: %w", err)
+		}
+		bundle, err := source.GetJWTBundleForTrustDomain(id.TrustDomain())
+		if err != nil {
+			return nil, err
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, ok := bundle.FindJWTAuthority(kid)
+		if !ok {
+			return nil, fmt.Errorf("no JWT authority %q in bundle for %s", kid, id.TrustDomain())
+		}
+		return key, nil
+	}, nil
+}
+
+// spiffeCheck enforces the JWT-SVID rules: an expiry, one of the expected
+// audiences and a subject matching one of allowedIDs. Entries of allowedIDs
+// are exact SPIFFE IDs, trust domains (spiffe://example.org) or path
+// prefixes ending in /* (spiffe://example.org/ns/prod/*).
+func spiffeCheck(audiences, allowedIDs []string) validator.Check {
+	return func(claims jwt.MapClaims) error {
+		if _, ok := claims["exp"]; !ok {
+			return errors.New("JWT-SVID has no exp claim")
+		}
+		if err := audienceCheck(audiences...)(claims); err != nil {
+			return err
+		}
+
+		sub, _ := claims["sub"].(string)
+		id, err := spiffeid.FromString(sub)
+		if err != nil {
+			return fmt.Errorf("subject is not a SPIFFE ID: %w", err)
+		}
+		if len(allowedIDs) == 0 {
+			return nil
+		}
+		for _, allowed := range allowedIDs {
+			if td, err := spiffeid.TrustDomainFromString(allowed); err == nil && !strings.Contains(strings.TrimPrefix(allowed, "spiffe://"), "/") {
+				if id.MemberOf(td) {
+					return nil
+				}
+			} else if prefix, ok := strings.CutSuffix(allowed, "*"); ok {
+				if strings.HasPrefix(id.String(), prefix) {
+					return nil
+				}
+			} else if id.String() == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("SPIFFE ID %s is not allowed", id)
+	}
+}
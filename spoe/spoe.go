@@ -0,0 +1,388 @@
+// Package spoe implements the agent side of HAProxy's Stream Processing
+// Offload Protocol (SPOP) version 2.0, as described in
+// https://www.haproxy.org/download/2.8/doc/SPOE.txt.
+package spoe
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// Frame types
+const (
+	frameHaproxyHello      = 1
+	frameHaproxyDisconnect = 2
+	frameNotify            = 3
+	frameAgentHello        = 101
+	frameAgentDisconnect   = 102
+	frameAck               = 103
+)
+
+// Data types
+const (
+	typeNull   = 0
+	typeBool   = 1
+	typeInt32  = 2
+	typeUint32 = 3
+	typeInt64  = 4
+	typeUint64 = 5
+	typeIPv4   = 6
+	typeIPv6   = 7
+	typeString = 8
+	typeBinary = 9
+)
+
+// Variable scopes for SetVar actions
+const (
+	ScopeProcess     = 0
+	ScopeSession     = 1
+	ScopeTransaction = 2
+	ScopeRequest     = 3
+	ScopeResponse    = 4
+)
+
+const (
+	flagFin        = 1
+	actionSetVar   = 1
+	version        = "2.0"
+	maxFrameSize   = 16380
+	statusNormal   = 0
+	statusBadFrame = 3
+)
+
+// Message is a single SPOE message sent by HAProxy.
+type Message struct {
+	Name string
+	Args map[string]interface{}
+}
+
+// Action sets a variable in HAProxy. Supported value types are bool, int,
+// int64, string, []byte and net.IP.
+type Action struct {
+	Scope byte
+	Name  string
+	Value interface{}
+}
+
+// Handler processes the messages of one NOTIFY frame and returns the
+// actions to send back.
+type Handler func(messages []Message) []Action
+
+// ErrorHandler receives errors that terminate a connection.
+type ErrorHandler func(err error)
+
+// Serve accepts SPOP connections on l until it fails.
+func Serve(l net.Listener, handler Handler, onError ErrorHandler) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := serveConn(conn, handler); err != nil && onError != nil {
+				onError(err)
+			}
+		}()
+	}
+}
+
+type frame struct {
+	typ      byte
+	flags    uint32
+	streamID uint64
+	frameID  uint64
+	payload  []byte
+}
+
+func serveConn(conn net.Conn, handler Handler) error {
+	r := bufio.NewReader(conn)
+	frameSize := uint32(maxFrameSize)
+
+	hello, err := readFrame(r, frameSize)
+	if err != nil {
+		return err
+	}
+	if hello.typ != frameHaproxyHello {
+		return disconnect(conn, statusBadFrame, fmt.Sprintf("expected HAPROXY-HELLO, got frame type %d", hello.typ))
+	}
+	kv, err := decodeKVList(hello.payload)
+	if err != nil {
+		return disconnect(conn, statusBadFrame, err.Error())
+	}
+	if versions, _ := kv["supported-versions"].(string); !strings.Contains(versions, version) {
+		return disconnect(conn, statusBadFrame, "unsupported SPOP versions "+versions)
+	}
+	if size, ok := kv["max-frame-size"].(uint32); ok && size < frameSize {
+		frameSize = size
+	}
+	capabilities := ""
+	if caps, _ := kv["capabilities"].(string); strings.Contains(caps, "pipelining") {
+		capabilities = "pipelining"
+	}
+
+	var payload []byte
+	payload = appendKV(payload, "version", version)
+	payload = appendKV(payload, "max-frame-size", frameSize)
+	payload = appendKV(payload, "capabilities", capabilities)
+	if err := writeFrame(conn, frame{typ: frameAgentHello, flags: flagFin, payload: payload}); err != nil {
+		return err
+	}
+	if healthcheck, _ := kv["healthcheck"].(bool); healthcheck {
+		return nil
+	}
+
+	for {
+		f, err := readFrame(r, frameSize)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		switch f.typ {
+		case frameNotify:
+			messages, err := decodeMessages(f.payload)
+			if err != nil {
+				return disconnect(conn, statusBadFrame, err.Error())
+			}
+			ack := frame{typ: frameAck, flags: flagFin, streamID: f.streamID, frameID: f.frameID}
+			for _, action := range handler(messages) {
+				ack.payload = appendSetVar(ack.payload, action)
+			}
+			if err := writeFrame(conn, ack); err != nil {
+				return err
+			}
+		case frameHaproxyDisconnect:
+			return disconnect(conn, statusNormal, "")
+		default:
+			return disconnect(conn, statusBadFrame, fmt.Sprintf("unexpected frame type %d", f.typ))
+		}
+	}
+}
+
+func disconnect(conn net.Conn, status uint32, message string) error {
+	var payload []byte
+	payload = appendKV(payload, "status-code", status)
+	payload = appendKV(payload, "message", message)
+	if err := writeFrame(conn, frame{typ: frameAgentDisconnect, flags: flagFin, payload: payload}); err != nil {
+		return err
+	}
+	if status != statusNormal {
+		return errors.New(message)
+	}
+	return nil
+}
+
+func readFrame(r *bufio.Reader, maxSize uint32) (frame, error) {
+	var f frame
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return f, err
+	}
+	if size > maxSize {
+		return f, fmt.Errorf("frame of %d bytes exceeds max-frame-size %d", size, maxSize)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return f, err
+	}
+	if len(buf) < 5 {
+		return f, errors.New("short frame")
+	}
+	f.typ = buf[0]
+	f.flags = binary.BigEndian.Uint32(buf[1:5])
+	d := decoder{buf: buf[5:]}
+	f.streamID = d.varint()
+	f.frameID = d.varint()
+	if d.err != nil {
+		return f, d.err
+	}
+	f.payload = d.buf
+	return f, nil
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	buf := make([]byte, 4, 4+5+20+len(f.payload))
+	buf = append(buf, f.typ)
+	buf = append(buf, byte(f.flags>>24), byte(f.flags>>16), byte(f.flags>>8), byte(f.flags))
+	buf = appendVarint(buf, f.streamID)
+	buf = appendVarint(buf, f.frameID)
+	buf = append(buf, f.payload...)
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	_, err := w.Write(buf)
+	return err
+}
+
+func decodeKVList(payload []byte) (map[string]interface{}, error) {
+	kv := make(map[string]interface{})
+	d := decoder{buf: payload}
+	for len(d.buf) > 0 && d.err == nil {
+		key := d.string()
+		kv[key] = d.typed()
+	}
+	return kv, d.err
+}
+
+func decodeMessages(payload []byte) ([]Message, error) {
+	var messages []Message
+	d := decoder{buf: payload}
+	for len(d.buf) > 0 && d.err == nil {
+		msg := Message{Name: d.string(), Args: make(map[string]interface{})}
+		nbArgs := d.byte()
+		for i := 0; i < int(nbArgs) && d.err == nil; i++ {
+			name := d.string()
+			msg.Args[name] = d.typed()
+		}
+		messages = append(messages, msg)
+	}
+	return messages, d.err
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) < 1 {
+		d.fail(io.ErrUnexpectedEOF)
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if uint64(len(d.buf)) < n {
+		d.fail(io.ErrUnexpectedEOF)
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) varint() uint64 {
+	b := d.byte()
+	i := uint64(b)
+	if i < 240 {
+		return i
+	}
+	for shift := uint(4); d.err == nil; shift += 7 {
+		if shift > 63 {
+			d.fail(errors.New("varint overflow"))
+			return 0
+		}
+		b = d.byte()
+		i += uint64(b) << shift
+		if b < 128 {
+			break
+		}
+	}
+	return i
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.varint()))
+}
+
+func (d *decoder) typed() interface{} {
+	b := d.byte()
+	switch b & 0x0f {
+	case typeNull:
+		return nil
+	case typeBool:
+		return b&0x10 != 0
+	case typeInt32:
+		return int32(d.varint())
+	case typeUint32:
+		return uint32(d.varint())
+	case typeInt64:
+		return int64(d.varint())
+	case typeUint64:
+		return d.varint()
+	case typeIPv4:
+		return net.IP(d.bytes(net.IPv4len))
+	case typeIPv6:
+		return net.IP(d.bytes(net.IPv6len))
+	case typeString:
+		return d.string()
+	case typeBinary:
+		return d.bytes(d.varint())
+	default:
+		d.fail(fmt.Errorf("unknown data type %d", b&0x0f))
+		return nil
+	}
+}
+
+func appendVarint(buf []byte, i uint64) []byte {
+	if i < 240 {
+		return append(buf, byte(i))
+	}
+	buf = append(buf, byte(i)|240)
+	i = (i - 240) >> 4
+	for i >= 128 {
+		buf = append(buf, byte(i)|128)
+		i = (i - 128) >> 7
+	}
+	return append(buf, byte(i))
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendVarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendTyped(buf []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, typeNull)
+	case bool:
+		if v {
+			return append(buf, typeBool|0x10)
+		}
+		return append(buf, typeBool)
+	case int:
+		return appendVarint(append(buf, typeInt64), uint64(v))
+	case int64:
+		return appendVarint(append(buf, typeInt64), uint64(v))
+	case uint32:
+		return appendVarint(append(buf, typeUint32), uint64(v))
+	case string:
+		return appendString(append(buf, typeString), v)
+	case []byte:
+		buf = appendVarint(append(buf, typeBinary), uint64(len(v)))
+		return append(buf, v...)
+	case net.IP:
+		if ip4 := v.To4(); ip4 != nil {
+			return append(append(buf, typeIPv4), ip4...)
+		}
+		return append(append(buf, typeIPv6), v.To16()...)
+	default:
+		return appendString(append(buf, typeString), fmt.Sprint(v))
+	}
+}
+
+func appendKV(buf []byte, key string, value interface{}) []byte {
+	return appendTyped(appendString(buf, key), value)
+}
+
+func appendSetVar(buf []byte, action Action) []byte {
+	buf = append(buf, actionSetVar, 3, action.Scope)
+	buf = appendString(buf, action.Name)
+	return appendTyped(buf, action.Value)
+}
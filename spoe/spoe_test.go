@@ -0,0 +1,220 @@
+package spoe
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// appendMessage encodes a message like HAProxy does in NOTIFY frames, with
+// the name/value pairs of args in the given order.
+func appendMessage(buf []byte, name string, args ...interface{}) []byte {
+	buf = appendString(buf, name)
+	buf = append(buf, byte(len(args)/2))
+	for i := 0; i < len(args); i += 2 {
+		buf = appendKV(buf, args[i].(string), args[i+1])
+	}
+	return buf
+}
+
+func TestTypedRoundTrip(t *testing.T) {
+	for _, value := range []interface{}{
+		nil,
+		true,
+		false,
+		int64(0),
+		int64(239),
+		int64(240),
+		int64(1 << 40),
+		int64(-1),
+		int64(math.MinInt64),
+		uint32(0),
+		uint32(math.MaxUint32),
+		"",
+		"eyJhbGciOiJFUzI1NiJ9.e30.sig",
+		[]byte{},
+		[]byte{0, 1, 0xff},
+		net.IPv4(10, 0, 0, 1).To4(),
+		net.ParseIP("2001:db8::1"),
+	} {
+		d := decoder{buf: appendTyped(nil, value)}
+		got := d.typed()
+		if d.err != nil {
+			t.Errorf("%#v: %v", value, d.err)
+			continue
+		}
+		if len(d.buf) > 0 {
+			t.Errorf("%#v: %d bytes left over", value, len(d.buf))
+		}
+		if !reflect.DeepEqual(got, value) {
+			t.Errorf("%#v decoded as %#v", value, got)
+		}
+	}
+}
+
+func TestVarintRoundTrip(t *testing.T) {
+	for _, i := range []uint64{0, 1, 239, 240, 2287, 2288, 264431, 264432, 1 << 32, math.MaxInt64, math.MaxUint64} {
+		d := decoder{buf: appendVarint(nil, i)}
+		if got := d.varint(); d.err != nil || got != i || len(d.buf) > 0 {
+			t.Errorf("%d decoded as %d (err %v, %d bytes left over)", i, got, d.err, len(d.buf))
+		}
+	}
+}
+
+// TestNotifyAck runs the handshake and a NOTIFY→ACK exchange through
+// serveConn, as HAProxy would.
+func TestNotifyAck(t *testing.T) {
+	client, agent := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	var received []Message
+	go func() {
+		served <- serveConn(agent, func(messages []Message) []Action {
+			received = messages
+			return []Action{
+				{Scope: ScopeTransaction, Name: "valid", Value: true},
+				{Scope: ScopeRequest, Name: "sub", Value: "alice"},
+			}
+		})
+	}()
+	r := bufio.NewReader(client)
+
+	var hello []byte
+	hello = appendKV(hello, "supported-versions", "2.0")
+	hello = appendKV(hello, "max-frame-size", uint32(maxFrameSize))
+	hello = appendKV(hello, "capabilities", "pipelining")
+	if err := writeFrame(client, frame{typ: frameHaproxyHello, flags: flagFin, payload: hello}); err != nil {
+		t.Fatal(err)
+	}
+	f, err := readFrame(r, maxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := decodeKVList(f.payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.typ != frameAgentHello || kv["version"] != version || kv["capabilities"] != "pipelining" {
+		t.Fatalf("AGENT-HELLO = type %d %v", f.typ, kv)
+	}
+
+	notify := appendMessage(nil, "check-jwt", "token", "abc", "params", "claims_sub=alice")
+	if err := writeFrame(client, frame{typ: frameNotify, flags: flagFin, streamID: 7, frameID: 300, payload: notify}); err != nil {
+		t.Fatal(err)
+	}
+	f, err = readFrame(r, maxFrameSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.typ != frameAck || f.streamID != 7 || f.frameID != 300 {
+		t.Fatalf("ACK = type %d stream %d frame %d", f.typ, f.streamID, f.frameID)
+	}
+	want := []Message{{Name: "check-jwt", Args: map[string]interface{}{"token": "abc", "params": "claims_sub=alice"}}}
+	if !reflect.DeepEqual(received, want) {
+		t.Errorf("handler got %v, want %v", received, want)
+	}
+	d := decoder{buf: f.payload}
+	var actions []Action
+	for len(d.buf) > 0 && d.err == nil {
+		if typ, nbArgs := d.byte(), d.byte(); typ != actionSetVar || nbArgs != 3 {
+			t.Fatalf("action type %d with %d args", typ, nbArgs)
+		}
+		actions = append(actions, Action{Scope: d.byte(), Name: d.string(), Value: d.typed()})
+	}
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	wantActions := []Action{
+		{Scope: ScopeTransaction, Name: "valid", Value: true},
+		{Scope: ScopeRequest, Name: "sub", Value: "alice"},
+	}
+	if !reflect.DeepEqual(actions, wantActions) {
+		t.Errorf("ACK actions = %v, want %v", actions, wantActions)
+	}
+
+	if err := writeFrame(client, frame{typ: frameHaproxyDisconnect, flags: flagFin}); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = readFrame(r, maxFrameSize); err != nil || f.typ != frameAgentDisconnect {
+		t.Fatalf("got frame type %d (%v), want AGENT-DISCONNECT", f.typ, err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serveConn: %v", err)
+	}
+}
+
+// FuzzDecodeMessages checks that no NOTIFY payload panics, that frames
+// carry it unchanged, and that decoded messages encode to the same messages.
+func FuzzDecodeMessages(f *testing.F) {
+	for _, seed := range [][]byte{
+		appendMessage(nil, "check-jwt", "token", "abc", "params", "claims_sub=alice"),
+		appendMessage(appendMessage(nil, "a"), "b", "ip", net.IPv4(10, 0, 0, 1), "v6", net.ParseIP("::1"), "n", int64(-1)),
+		appendMessage(nil, "m", "bin", []byte{0xff}, "bool", true, "nil", nil, "u", uint32(1<<31)),
+		{0xf0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		{1, 'm', 1, 1, 'a', 0x0e},
+		{},
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		var buf bytes.Buffer
+		if err := writeFrame(&buf, frame{typ: frameNotify, flags: flagFin, streamID: 1, frameID: 2, payload: payload}); err != nil {
+			t.Fatal(err)
+		}
+		fr, err := readFrame(bufio.NewReader(&buf), math.MaxUint32)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fr.typ != frameNotify || fr.streamID != 1 || fr.frameID != 2 || !bytes.Equal(fr.payload, payload) {
+			t.Fatalf("frame changed to type %d stream %d frame %d payload %x", fr.typ, fr.streamID, fr.frameID, fr.payload)
+		}
+
+		messages, err := decodeMessages(payload)
+		if err != nil {
+			return
+		}
+		var encoded []byte
+		for _, msg := range messages {
+			args := make([]interface{}, 0, 2*len(msg.Args))
+			for name, value := range msg.Args {
+				args = append(args, name, value)
+			}
+			encoded = appendMessage(encoded, msg.Name, args...)
+		}
+		again, err := decodeMessages(encoded)
+		if err != nil {
+			t.Fatalf("re-encoded messages don't decode: %v", err)
+		}
+		if len(again) != len(messages) {
+			t.Fatalf("%d messages decoded as %d", len(messages), len(again))
+		}
+		for i, msg := range messages {
+			if again[i].Name != msg.Name || len(again[i].Args) != len(msg.Args) {
+				t.Fatalf("message %v decoded as %v", msg, again[i])
+			}
+			for name, value := range msg.Args {
+				if !sameValue(again[i].Args[name], value) {
+					t.Fatalf("arg %s = %#v decoded as %#v", name, value, again[i].Args[name])
+				}
+			}
+		}
+	})
+}
+
+// sameValue reports whether got is want after a round trip. appendTyped
+// encodes int32 and uint64 as strings, and IPv4-mapped IPv6 addresses as
+// IPv4.
+func sameValue(got, want interface{}) bool {
+	switch want := want.(type) {
+	case int32, uint64:
+		return got == fmt.Sprint(want)
+	case net.IP:
+		ip, ok := got.(net.IP)
+		return ok && ip.Equal(want)
+	}
+	return reflect.DeepEqual(got, want)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Formats of the key at JWKS_PATH
+const (
+	keyFormatPEM = "pem"
+	// a shared secret for HS256, HS384 and HS512
+	keyFormatHMAC = "hmac"
+)
+
+// staticKey holds the keys at JWKS_PATH by kid. Validations load them
+// atomically, so reloading them never holds them up.
+type staticKey struct {
+	path   string
+	format string
+	keys   atomic.Pointer[map[string]interface{}]
+}
+
+// reload reads the keys at the path, a file or a directory of them. The
+// kid of a PEM block is its kid header, else the name of its file without
+// extension if it is the only block of a file in the directory, else the
+// x5t of a certificate or the RFC 7638 thumbprint of a key. Secrets in a
+// directory are named by their file.
+func (k *staticKey) reload() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read key from file: %s. Error: %s", k.path, err.Error())
+	}
+	keys := map[string]interface{}{}
+	if !info.IsDir() {
+		if err := k.readKeys(k.path, "", keys); err != nil {
+			return err
+		}
+	} else {
+		entries, err := os.ReadDir(k.path)
+		if err != nil {
+			return fmt.Errorf("Couldn't read keys from directory: %s. Error: %s", k.path, err.Error())
+		}
+		for _, entry := range entries {
+			// Skipping the ..data links of mounted ConfigMaps and Secrets
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			path := filepath.Join(k.path, entry.Name())
+			if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			name := strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			if err := k.readKeys(path, name, keys); err != nil {
+				return err
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("No keys in %s", k.path)
+	}
+	k.keys.Store(&keys)
+	return nil
+}
+
+// readKeys adds the keys in the file at path to keys, name being the kid
+// of a single one.
+func (k *staticKey) readKeys(path, name string, keys map[string]interface{}) error {
+	keyBytes, err := readConfigFile(path)
+	if err != nil {
+		return fmt.Errorf("Couldn't read key from file: %s. Error: %s", path, err.Error())
+	}
+	add := func(kid string, key interface{}) error {
+		if _, ok := keys[kid]; ok {
+			return fmt.Errorf("Duplicate kid %q in %s", kid, path)
+		}
+		keys[kid] = key
+		return nil
+	}
+
+	if k.format == keyFormatHMAC {
+		secret := bytes.TrimRight(keyBytes, "\r\n")
+		if len(secret) == 0 {
+			return fmt.Errorf("HMAC secret in %s is empty", path)
+		}
+		return add(name, secret)
+	}
+
+	var blocks []*pem.Block
+	for block, rest := pem.Decode(keyBytes); block != nil; block, rest = pem.Decode(rest) {
+		blocks = append(blocks, block)
+	}
+	if len(blocks) == 0 {
+		return fmt.Errorf("Failed to parse PEM block containing the public key in %s", path)
+	}
+	for _, block := range blocks {
+		key, err := parsePublicKeyBlock(block)
+		if err != nil {
+			return fmt.Errorf("%s in %s", err.Error(), path)
+		}
+		kid := block.Headers["kid"]
+		switch {
+		case kid != "":
+		case name != "" && len(blocks) == 1:
+			kid = name
+		case block.Type == "CERTIFICATE":
+			sum := sha1.Sum(block.Bytes)
+			kid = base64.RawURLEncoding.EncodeToString(sum[:])
+		default:
+			kid = describeKey(key)["thumbprint"]
+		}
+		if err := add(kid, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePublicKeyBlock parses an EC, RSA or Ed25519 public key, given as
+// such or by an X.509 certificate.
+func parsePublicKeyBlock(block *pem.Block) (interface{}, error) {
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Failed to parse certificate: %s", err.Error())
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		if key, err = x509.ParsePKCS1PublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Failed to parse RSA public key: %s", err.Error())
+		}
+	default:
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("Failed to parse public key: %s", err.Error())
+		}
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("Given key is not an EC, RSA or Ed25519 public key, but %T", key)
+	}
+}
+
+// Keyfunc returns the key named by the token's kid, or every key if it has
+// none. A single key is used whatever the kid. Keys are only returned for
+// algorithms of their type, so the algorithm follows from the key rather
+// than from the token.
+func (k *staticKey) Keyfunc(token *jwt.Token) (interface{}, error) {
+	keys := *k.keys.Load()
+	var key interface{}
+	if len(keys) == 1 {
+		for _, only := range keys {
+			key = only
+		}
+	} else if kid, ok := token.Header["kid"].(string); ok {
+		if key = keys[kid]; key == nil {
+			return nil, fmt.Errorf("no key with kid %q", kid)
+		}
+	} else {
+		// Without a kid, any of the keys may have signed it
+		var set jwt.VerificationKeySet
+		for _, key := range keys {
+			if keyAllows(key, token.Method) {
+				set.Keys = append(set.Keys, key)
+			}
+		}
+		if len(set.Keys) == 0 {
+			return nil, fmt.Errorf("no key for algorithm %s", token.Method.Alg())
+		}
+		return set, nil
+	}
+	if !keyAllows(key, token.Method) {
+		return nil, fmt.Errorf("algorithm %s doesn't fit a %s key", token.Method.Alg(), describeKey(key)["type"])
+	}
+	return key, nil
+}
+
+// keyAllows reports whether tokens signed with method are verified with
+// key.
+func keyAllows(key interface{}, method jwt.SigningMethod) bool {
+	var ok bool
+	switch key.(type) {
+	case *ecdsa.PublicKey:
+		_, ok = method.(*jwt.SigningMethodECDSA)
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			ok = true
+		}
+	case ed25519.PublicKey:
+		_, ok = method.(*jwt.SigningMethodEd25519)
+	case []byte:
+		_, ok = method.(*jwt.SigningMethodHMAC)
+	}
+	return ok
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+)
+
+// servingCert is the certificate of TLS_CERT_FILE and TLS_KEY_FILE the
+// server is reached with, along with the CAs of TLS_CLIENT_CA_FILE that
+// client certificates are verified with. Reloading swaps them for new
+// connections, so renewed certificates are picked up without a restart.
+type servingCert struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	cert         atomic.Pointer[tls.Certificate]
+	clientCAs    atomic.Pointer[x509.CertPool]
+}
+
+func loadServingCert(certFile, keyFile, clientCAFile string) (*servingCert, error) {
+	c := &servingCert{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files again. The certificate in use is kept if they
+// don't hold a valid pair, e.g. when only one of them was replaced yet.
+func (c *servingCert) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("couldn't load TLS_CERT_FILE and TLS_KEY_FILE: %w", err)
+	}
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		pem, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("couldn't read TLS_CLIENT_CA_FILE: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in TLS_CLIENT_CA_FILE")
+		}
+	}
+	c.cert.Store(&cert)
+	c.clientCAs.Store(clientCAs)
+	return nil
+}
+
+func (c *servingCert) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return c.cert.Load(), nil
+		},
+	}
+	if c.clientCAFile == "" {
+		return config
+	}
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		clientConfig := config.Clone()
+		clientConfig.GetConfigForClient = nil
+		// Health checks and scrapers can't present one, requireClientCert
+		// insists on it for the endpoints that need it
+		clientConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		clientConfig.ClientCAs = c.clientCAs.Load()
+		return clientConfig, nil
+	}
+	return config
+}
+
+// requireClientCert only lets requests with a client certificate of the
+// TLS_CLIENT_CA_FILE through to next, if that is set, so only the proxies
+// can have tokens validated.
+func (c *servingCert) requireClientCert(next http.HandlerFunc) http.HandlerFunc {
+	if c == nil || c.clientCAFile == "" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "client certificate required", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// runToken implements the token subcommand. Its only command, issue, signs
+// tokens for local development with a key it generates on first use, and
+// writes the public key both as PEM for JWKS_PATH and as a JWKS to serve at
+// JWKS_URL.
+func runToken(args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] != "issue" {
+		return errors.New("usage: token issue [-key dev.pem] [-claims JSON] [-ttl 1h]")
+	}
+	flags := flag.NewFlagSet("token issue", flag.ContinueOnError)
+	keyFile := flags.String("key", "dev.pem", "PEM encoded EC private key to sign with, created along with <key>.pub for JWKS_PATH if missing")
+	jwksFile := flags.String("jwks", "", "file to write the JWKS of the key to (default <key>.jwks.json)")
+	claimsJSON := flags.String("claims", `{"sub":"dev"}`, "claims of the token as a JSON object")
+	issuer := flags.String("issuer", getenv("OIDC_ISSUER", ""), "iss claim of the token, unless set in -claims")
+	ttl := flags.Duration("ttl", time.Hour, "lifetime of the token, unless -claims sets exp")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *jwksFile == "" {
+		*jwksFile = strings.TrimSuffix(*keyFile, ".pem") + ".jwks.json"
+	}
+
+	var claims jwt.MapClaims
+	if err := json.Unmarshal([]byte(*claimsJSON), &claims); err != nil {
+		return fmt.Errorf("invalid claims: %w", err)
+	}
+	private, err := signingKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	key := newDevKey(private)
+	jwks, err := json.MarshalIndent(key.jwks(), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*jwksFile, append(jwks, '\n'), 0o644); err != nil {
+		return err
+	}
+	signed, err := key.sign(claims, *issuer, *ttl)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, signed)
+	return err
+}
+
+// devKey signs development tokens.
+type devKey struct {
+	private *ecdsa.PrivateKey
+	// jwk is the public key, with a kid the tokens name it by
+	jwk map[string]string
+}
+
+func newDevKey(private *ecdsa.PrivateKey) *devKey {
+	jwk := ecJWK(&private.PublicKey)
+	jwk["kid"] = jwkThumbprint(jwk)
+	jwk["alg"] = jwt.SigningMethodES256.Alg()
+	jwk["use"] = "sig"
+	return &devKey{private: private, jwk: jwk}
+}
+
+func (k *devKey) jwks() map[string]interface{} {
+	return map[string]interface{}{"keys": []map[string]string{k.jwk}}
+}
+
+// sign signs claims, adding iat, exp after ttl and, if not empty, iss
+// unless claims has them.
+func (k *devKey) sign(claims jwt.MapClaims, issuer string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	setDefault := func(name string, value interface{}) {
+		if _, ok := claims[name]; !ok {
+			claims[name] = value
+		}
+	}
+	setDefault("iat", now.Unix())
+	setDefault("exp", now.Add(ttl).Unix())
+	if issuer != "" {
+		setDefault("iss", issuer)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, claims)
+	token.Header["kid"] = k.jwk["kid"]
+	return token.SignedString(k.private)
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of an EC JWK, a stable key id.
+func jwkThumbprint(jwk map[string]string) string {
+	// The required members in lexicographic order, without whitespace
+	sum := sha256.Sum256([]byte(fmt.Sprintf(`{"crv":%q,"kty":%q,"x":%q,"y":%q}`, jwk["crv"], jwk["kty"], jwk["x"], jwk["y"])))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5/request"
+)
+
+// Kinds of token sources
+const (
+	tokenSourceCookie = "cookie"
+	tokenSourceHeader = "header"
+	// a query param of the original request
+	tokenSourceQuery = "query"
+)
+
+// tokenSource is a place a request may carry its token in.
+type tokenSource struct {
+	kind string
+	name string
+	// prefix is stripped off header values, which must start with it
+	prefix string
+}
+
+func (src tokenSource) String() string {
+	if src.prefix != "" {
+		return src.kind + ":" + src.name + ":" + src.prefix
+	}
+	return src.kind + ":" + src.name
+}
+
+// parseTokenSources parses TOKEN_SOURCES, a comma separated list of
+// kind:name sources, e.g. cookie:session,header:Authorization. Header
+// sources may add the prefix to strip, header:X-Auth:Token.
+func parseTokenSources(spec string) ([]tokenSource, error) {
+	var sources []tokenSource
+	for _, entry := range splitList(spec) {
+		kind, name, _ := strings.Cut(entry, ":")
+		src := tokenSource{kind: kind, name: name}
+		if kind == tokenSourceHeader {
+			src.name, src.prefix, _ = strings.Cut(name, ":")
+		}
+		switch {
+		case kind != tokenSourceCookie && kind != tokenSourceHeader && kind != tokenSourceQuery:
+			return nil, fmt.Errorf("unknown token source %q, expected cookie, header or query", entry)
+		case src.name == "":
+			return nil, fmt.Errorf("token source %q lacks a name", entry)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// tokenSources returns where to look for the token of a request, in order.
+// The cookie, header and query params replace the TokenSources, as do
+// TokenQuery and TokenHeader in their absence. Without any of them, the
+// token is read from the Authorization header or else the session cookie.
+func (s *server) tokenSources(params url.Values) []tokenSource {
+	query := params.Get("query")
+	if query == "" && len(cookieNames(params)) == 0 && params.Get("header") == "" && len(s.TokenSources) > 0 {
+		return s.TokenSources
+	}
+	if query == "" {
+		query = s.TokenQuery
+	}
+	var sources []tokenSource
+	if query != "" {
+		sources = append(sources, tokenSource{kind: tokenSourceQuery, name: query})
+	}
+	header, prefix := s.tokenHeader(params)
+	switch cookies := cookieNames(params); {
+	case len(cookies) > 0:
+		// Tried in order, e.g. a cookie and the one it replaces
+		for _, cookie := range cookies {
+			sources = append(sources, tokenSource{kind: tokenSourceCookie, name: cookie})
+		}
+	case header != "":
+		sources = append(sources, tokenSource{kind: tokenSourceHeader, name: header, prefix: prefix})
+	default:
+		sources = append(sources, tokenSource{kind: tokenSourceHeader, name: "Authorization"})
+		if s.Login != nil {
+			sources = append(sources, tokenSource{kind: tokenSourceCookie, name: s.Login.CookieName})
+		}
+	}
+	return sources
+}
+
+// cookieNames returns the cookies named by the cookie params, which may be
+// comma separated lists.
+func cookieNames(params url.Values) []string {
+	var names []string
+	for _, value := range params["cookie"] {
+		names = append(names, splitList(value)...)
+	}
+	return names
+}
+
+// tokenHeader returns the header to read the token from and the prefix to
+// strip off it, those of the params if they name one.
+func (s *server) tokenHeader(params url.Values) (header, prefix string) {
+	if header := params.Get("header"); header != "" {
+		return header, params.Get("header_prefix")
+	}
+	return s.TokenHeader, s.TokenPrefix
+}
+
+// extractToken returns the token of the first source r has one in. The
+// error, wrapping ErrNoToken, tells why each of them has none.
+func (s *server) extractToken(r *http.Request, sources []tokenSource) (string, error) {
+	reasons := make([]string, 0, len(sources))
+	for _, src := range sources {
+		token, err := s.sourceToken(r, src)
+		if err == nil {
+			return token, nil
+		}
+		reasons = append(reasons, err.Error())
+	}
+	return "", fmt.Errorf("%w: %s", ErrNoToken, strings.Join(reasons, "; "))
+}
+
+// sourceToken returns the token in src, or an error if it holds none.
+func (s *server) sourceToken(r *http.Request, src tokenSource) (string, error) {
+	switch src.kind {
+	case tokenSourceCookie:
+		cookie, err := r.Cookie(src.name)
+		if err != nil && s.CookieChunks {
+			if token := chunkedCookie(r, src.name); token != "" {
+				return token, nil
+			}
+		}
+		if err != nil {
+			return "", fmt.Errorf("cookie %s: %w", src.name, err)
+		}
+		if cookie.Value == "" {
+			return "", fmt.Errorf("cookie %s is empty", src.name)
+		}
+		return cookie.Value, nil
+	case tokenSourceQuery:
+		_, rawQuery, _ := strings.Cut(s.originalRequest(r).URI, "?")
+		// Whatever parses of a malformed query is still used
+		query, _ := url.ParseQuery(rawQuery)
+		if token := query.Get(src.name); token != "" {
+			return token, nil
+		}
+		return "", fmt.Errorf("query param %s is missing", src.name)
+	}
+	if src.prefix == "" && strings.EqualFold(src.name, "Authorization") {
+		// Bearer is stripped if present
+		token, err := request.AuthorizationHeaderExtractor.ExtractToken(r)
+		if err != nil {
+			return "", fmt.Errorf("Authorization header: %w", err)
+		}
+		return token, nil
+	}
+	token := r.Header.Get(src.name)
+	if token == "" {
+		return "", fmt.Errorf("header %s is empty", src.name)
+	}
+	if src.prefix != "" {
+		if len(token) < len(src.prefix) || !strings.EqualFold(token[:len(src.prefix)], src.prefix) {
+			return "", fmt.Errorf("header %s lacks prefix %q", src.name, src.prefix)
+		}
+		token = strings.TrimSpace(token[len(src.prefix):])
+	}
+	if token == "" {
+		return "", fmt.Errorf("header %s holds just the prefix", src.name)
+	}
+	return token, nil
+}
+
+// chunkedCookie reassembles a token split across the cookies name_0,
+// name_1, ... because of the size limit of cookies, as oauth2-proxy does.
+// It returns "" if r has no name_0.
+func chunkedCookie(r *http.Request, name string) string {
+	var token strings.Builder
+	for i := 0; ; i++ {
+		chunk, err := r.Cookie(name + "_" + strconv.Itoa(i))
+		if err != nil {
+			return token.String()
+		}
+		token.WriteString(chunk.Value)
+	}
+}
+
+// forwardToken adds the token to the response headers for the upstream: as
+// it is in the header named by the forward_token param or the
+// ForwardTokenHeader, and as a bearer token in Authorization if the
+// forward_authorization param or ForwardAuthorization says so. The
+// upstream then gets the token whatever the proxy did to the client's
+// headers.
+func (s *server) forwardToken(values map[string]string, params url.Values, token string) {
+	header := s.ForwardTokenHeader
+	if params.Has("forward_token") {
+		header = params.Get("forward_token")
+	}
+	if header != "" {
+		values[header] = token
+	}
+	authorization := s.ForwardAuthorization
+	if params.Has("forward_authorization") {
+		authorization = params.Get("forward_authorization") == "true"
+	}
+	if authorization {
+		values["Authorization"] = "Bearer " + token
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// traceContext reads the W3C traceparent nginx passes on, so spans of
+// validations join the trace of the request they authorize.
+var traceContext = propagation.TraceContext{}
+
+// newTracerProvider returns a provider exporting spans by OTLP over HTTP, or
+// nil if OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// are unset. The exporter, sampler and resource are configured by the
+// standard OTEL_* variables.
+func newTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	if getenv("OTEL_EXPORTER_OTLP_ENDPOINT", "") == "" && getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "") == "" {
+		return nil, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create the OTLP exporter: %w", err)
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "nginx-jwt-auth")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't describe the service: %w", err)
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res)), nil
+}
+
+// noopTracer is the Tracer while tracing is disabled.
+var noopTracer = noop.NewTracerProvider().Tracer("")
+
+// startSpan starts the span of the validation request r, a child of the
+// trace in its traceparent header. The returned request carries it. Servers
+// without a Tracer, like those of tests, use noopTracer.
+func (s *server) startSpan(r *http.Request) (*http.Request, trace.Span) {
+	tracer := s.Tracer
+	if tracer == nil {
+		tracer = noopTracer
+	}
+	ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "validate", trace.WithSpanKind(trace.SpanKindServer))
+	return r.WithContext(ctx), span
+}
+
+// endSpan records the outcome of the validation on span and ends it: the
+// status written to w, and allowed or the code of the denial. Only internal
+// denials are errors, the others are the service doing its job.
+func endSpan(span trace.Span, w *statusWriter, err error) {
+	span.SetAttributes(attribute.Int("http.response.status_code", w.status))
+	if err == nil {
+		span.SetAttributes(attribute.String("jwt_auth.outcome", "allowed"))
+	} else {
+		d := denialOf(err)
+		span.SetAttributes(attribute.String("jwt_auth.outcome", d.code))
+		if d.internal {
+			span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	span.End()
+}
+
+// traceToken records the issuer of the token on the span of ctx. It's read
+// unverified, to tell which issuer the rejected tokens claim to be from too.
+func traceToken(ctx context.Context, token string) {
+	span := trace.SpanFromContext(ctx)
+	if !span.IsRecording() {
+		return
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(token, claims); err == nil {
+		if iss, _ := claims["iss"].(string); iss != "" {
+			span.SetAttributes(attribute.String("jwt_auth.issuer", iss))
+		}
+	}
+}
+
+// traceCache records on the span of ctx what the result cache had for the
+// token: hit, negative_hit or miss, as counted by resultCacheLookups.
+func traceCache(ctx context.Context, result string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("jwt_auth.cache", result))
+}
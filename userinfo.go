@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// userInfo fetches the claims of the UserInfo endpoint with the presented
+// access token, for providers that issue thin access tokens.
+type userInfo struct {
+	Client   *http.Client
+	Endpoint string
+	// MaxTTL caps how long responses are cached; the token's exp caps it
+	// further.
+	MaxTTL time.Duration
+
+	cache *ttlCache[map[string]interface{}]
+}
+
+func newUserInfo(client *http.Client, endpoint string) *userInfo {
+	ttl, err := time.ParseDuration(getenv("USERINFO_CACHE_TTL", "5m"))
+	if err != nil {
+		ttl = 5 * time.Minute
+	}
+	return &userInfo{
+		Client:   client,
+		Endpoint: endpoint,
+		MaxTTL:   ttl,
+		cache:    newTTLCache[map[string]interface{}](10000),
+	}
+}
+
+// enrich adds the UserInfo claims the token doesn't have itself.
+func (u *userInfo) enrich(raw string, claims jwt.MapClaims) error {
+	key := tokenHash(raw)
+	info, ok := u.cache.get(key)
+	if !ok {
+		var err error
+		if info, err = u.fetch(raw); err != nil {
+			return fmt.Errorf("UserInfo request failed: %w", err)
+		}
+		// The response has to be about the token's subject (OIDC Core 5.3.2)
+		if sub, ok := claims["sub"]; ok && info["sub"] != sub {
+			return fmt.Errorf("UserInfo sub %v does not match token sub %v", info["sub"], sub)
+		}
+		u.cache.set(key, info, ttlUntilExpiry(claims, u.MaxTTL))
+	}
+	for name, value := range info {
+		if _, exists := claims[name]; !exists {
+			claims[name] = value
+		}
+	}
+	return nil
+}
+
+func (u *userInfo) fetch(raw string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, u.Endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+raw)
+	req.Header.Set("Accept", "application/json")
+	resp, err := u.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var info map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// tokenHash is the cache key for a raw token, so tokens themselves are never
+// kept around as keys.
+func tokenHash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	var buf [2 * sha256.Size]byte
+	hex.Encode(buf[:], sum[:])
+	return string(buf[:])
+}
+
+// ttlUntilExpiry returns maxTTL, shortened to the time left until the
+// token's exp.
+func ttlUntilExpiry(claims jwt.MapClaims, maxTTL time.Duration) time.Duration {
+	if exp, ok := claims["exp"].(float64); ok {
+		if left := time.Until(time.Unix(int64(exp), 0)); left < maxTTL {
+			return left
+		}
+	}
+	return maxTTL
+}
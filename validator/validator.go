@@ -0,0 +1,201 @@
+// Package validator verifies JWTs the way nginx-jwt-auth does: it checks the
+// signature and registered claims, applies the configured checks, normalizes
+// provider specific claims and merges in claims from other sources. Claim
+// requirements are evaluated with package policy.
+package validator
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/policy"
+)
+
+// Check rejects tokens whose claims break a rule of the configured token
+// type.
+type Check func(claims jwt.MapClaims) error
+
+// Enricher merges claims from another source into those of the raw token.
+// Errors deny the request, as policies may depend on the claims, unless
+// they wrap ErrIncomplete.
+type Enricher func(raw string, claims jwt.MapClaims) error
+
+// The reasons a token is rejected. Errors returned by a Validator wrap one
+// of them, along with the details.
+var (
+	// ErrMalformed is returned for input that isn't a JWT at all.
+	ErrMalformed = errors.New("malformed token")
+	// ErrSignature is returned when the signature doesn't verify, or no key
+	// to verify it with was found.
+	ErrSignature = errors.New("invalid signature")
+	// ErrAlgorithm is returned for tokens signed with an algorithm that
+	// isn't one of the Algorithms.
+	ErrAlgorithm = errors.New("algorithm not allowed")
+	// ErrExpired is returned for tokens outside of their exp, nbf and iat.
+	ErrExpired = errors.New("token expired or not valid yet")
+	// ErrClaims is returned when the registered claims or Checks reject the
+	// token.
+	ErrClaims = errors.New("invalid claims")
+	// ErrEnrichment wraps errors of Enrichers. They are usually transient,
+	// unlike the other reasons to reject a token.
+	ErrEnrichment = errors.New("failed to enrich claims")
+	// ErrPolicy is returned for valid tokens whose claims don't satisfy the
+	// policy.
+	ErrPolicy = errors.New("claims do not satisfy the policy")
+	// ErrIncomplete is wrapped by Enrichers that failed, but let the token
+	// pass without their claims. Verify then returns the claims along with
+	// it: the token is valid, but its claims must not be cached, as they
+	// would lack the enrichment once the source recovers.
+	ErrIncomplete = errors.New("claims are incomplete")
+)
+
+// Validator verifies tokens. Its fields must not be changed once it is in
+// use, it is safe for concurrent use from then on.
+type Validator struct {
+	// Keyfunc returns the key to verify a token's signature with.
+	Keyfunc jwt.Keyfunc
+	// Algorithms restricts the algorithms tokens may be signed with, if
+	// not empty.
+	Algorithms []string
+	// ParserOptions configure how golang-jwt validates the registered
+	// claims, e.g. jwt.WithLeeway or jwt.WithAudience. Note that iat is only
+	// checked with jwt.WithIssuedAt.
+	ParserOptions []jwt.ParserOption
+	// Checks are applied to the claims of every valid token, before any
+	// policy.
+	Checks []Check
+	// ClaimAliases copies provider specific claims to their common name
+	// (alias -> claim), unless the token already has a claim by that name.
+	ClaimAliases map[string]string
+	// ClaimTransforms derive additional claims after ClaimAliases applied.
+	ClaimTransforms []func(claims jwt.MapClaims)
+	// ClaimNamespaces are prefixes stripped from claim names, e.g. the
+	// https://example.com/ Auth0 requires on custom claims.
+	ClaimNamespaces []string
+	// Enrichers add claims from other sources once a token is valid.
+	Enrichers []Enricher
+}
+
+// Verify checks the signature and validity of raw and returns its
+// normalized and enriched claims. If an Enricher failed open, the claims
+// come with an error wrapping ErrIncomplete.
+func (v *Validator) Verify(raw string) (jwt.MapClaims, error) {
+	keyfunc := v.Keyfunc
+	if len(v.Algorithms) > 0 {
+		keyfunc = v.allowedKeyfunc
+	}
+	token, err := jwt.Parse(raw, keyfunc, v.ParserOptions...)
+	if err != nil {
+		return nil, parseError(err)
+	}
+	if !token.Valid {
+		return nil, ErrSignature
+	}
+	return v.check(token.Raw, token.Claims.(jwt.MapClaims))
+}
+
+// VerifyClaims checks claims that were vouched for otherwise than by a
+// signature, e.g. by an OAuth 2.0 introspection endpoint for the opaque
+// token raw, like Verify checks those of a JWT: the registered claims as
+// configured by the ParserOptions, then the Checks. It returns them
+// normalized and enriched.
+func (v *Validator) VerifyClaims(raw string, claims jwt.MapClaims) (jwt.MapClaims, error) {
+	if err := jwt.NewValidator(v.ParserOptions...).Validate(claims); err != nil {
+		return nil, parseError(fmt.Errorf("%w: %w", jwt.ErrTokenInvalidClaims, err))
+	}
+	return v.check(raw, claims)
+}
+
+// check applies the Checks to the claims of a valid token, then normalizes
+// and enriches them.
+func (v *Validator) check(raw string, claims jwt.MapClaims) (jwt.MapClaims, error) {
+	for _, check := range v.Checks {
+		if err := check(claims); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrClaims, err)
+		}
+	}
+	v.Normalize(claims)
+	var incomplete error
+	for _, enrich := range v.Enrichers {
+		if err := enrich(raw, claims); errors.Is(err, ErrIncomplete) {
+			incomplete = err
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrEnrichment, err)
+		}
+	}
+	return claims, incomplete
+}
+
+// allowedKeyfunc rejects tokens whose algorithm isn't allowed before
+// looking up their key.
+func (v *Validator) allowedKeyfunc(token *jwt.Token) (interface{}, error) {
+	if alg := token.Method.Alg(); !slices.Contains(v.Algorithms, alg) {
+		return nil, fmt.Errorf("%w: %s", ErrAlgorithm, alg)
+	}
+	return v.Keyfunc(token)
+}
+
+// Validate verifies raw and checks its claims against p. A nil p has no
+// requirements.
+func (v *Validator) Validate(raw string, p *policy.Policy) (jwt.MapClaims, error) {
+	claims, err := v.Verify(raw)
+	if err != nil && !errors.Is(err, ErrIncomplete) {
+		return nil, err
+	}
+	if !p.Empty() && !p.Allows(claims) {
+		return nil, fmt.Errorf("%w: %w", ErrPolicy, p.Check(claims))
+	}
+	return claims, nil
+}
+
+// parseError wraps an error of golang-jwt in the matching reason.
+func parseError(err error) error {
+	var reason error
+	switch {
+	case errors.Is(err, ErrAlgorithm):
+		// allowedKeyfunc's error already names it
+		return err
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		reason = ErrMalformed
+	case errors.Is(err, jwt.ErrTokenExpired), errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		reason = ErrExpired
+	case errors.Is(err, jwt.ErrTokenInvalidClaims):
+		reason = ErrClaims
+	default:
+		// Unverifiable tokens, e.g. without a key, too
+		reason = ErrSignature
+	}
+	return fmt.Errorf("%w: %w", reason, err)
+}
+
+// Normalize rewrites provider specific claims in place so policies and
+// headers can refer to them by their common names.
+func (v *Validator) Normalize(claims jwt.MapClaims) {
+	for _, namespace := range v.ClaimNamespaces {
+		for name, value := range claims {
+			stripped, ok := strings.CutPrefix(name, namespace)
+			if !ok || stripped == "" {
+				continue
+			}
+			delete(claims, name)
+			// Never shadow a claim the token already has by that name
+			if _, exists := claims[stripped]; !exists {
+				claims[stripped] = value
+			}
+		}
+	}
+	for alias, claimName := range v.ClaimAliases {
+		if _, ok := claims[alias]; ok {
+			continue
+		}
+		if value, ok := claims[claimName]; ok {
+			claims[alias] = value
+		}
+	}
+	for _, transform := range v.ClaimTransforms {
+		transform(claims)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/robbilie/nginx-jwt-auth/logger"
+)
+
+var errDenied = errors.New("token denied")
+
+// runVerify implements the verify subcommand. It validates a token the way
+// the server configured by the environment would, and prints the decision,
+// the reason for denying it and the token's claims. The exit status is 1 if
+// the token is denied.
+func runVerify(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	token := flags.String("token", "", "the token to verify, - reads it from stdin")
+	params := flags.String("params", getenv("DEFAULT_PARAMS", ""), "validation parameters in query string form")
+	method := flags.String("method", "GET", "method of the original request, for OPA")
+	host := flags.String("host", "", "host of the original request, for OPA")
+	uri := flags.String("uri", "/", "URI of the original request, for OPA")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *token == "-" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		*token = line
+	}
+	*token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(*token), "Bearer "))
+	if *token == "" {
+		return errors.New("verify requires a token, set -token")
+	}
+	values, err := url.ParseQuery(*params)
+	if err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+
+	// Only errors, so the output isn't buried in startup logs
+	s, _ := configure(logger.NewLogger(getenv("LOG_LEVEL", "error")), nil)
+	// Named policies are resolved like by /validate
+	values, p, err := s.resolveParams(values)
+	if err != nil {
+		return fmt.Errorf("invalid params: %w", err)
+	}
+	claims, _, reason := s.evaluate(*token, p, originalRequest{Method: *method, Scheme: "https", Host: *host, URI: *uri})
+
+	if reason == nil {
+		fmt.Fprintln(out, "Decision: allow")
+	} else {
+		fmt.Fprintln(out, "Decision: deny")
+		fmt.Fprintf(out, "Reason: %s (%v)\n", denialOf(reason).code, reason)
+		// Still show what the token claims, as far as it can be decoded
+		claims = jwt.MapClaims{}
+		if _, _, err := jwt.NewParser().ParseUnverified(*token, claims); err != nil {
+			claims = nil
+		}
+	}
+	if claims != nil {
+		encoded, err := json.MarshalIndent(claims, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Claims: %s\n", encoded)
+	}
+	if reason == nil {
+		headers := s.responseHeaderValues(values, claims)
+		for _, header := range slices.Sorted(maps.Keys(headers)) {
+			fmt.Fprintf(out, "Header: %s: %s\n", header, headers[header])
+		}
+		return nil
+	}
+	return errDenied
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// warmCache carries verified token results and fetched key sets over to the
+// next run, so a restarted replica doesn't verify every token and fetch
+// every key set again at once. The snapshot of the previous run is read at
+// startup and a new one written on shutdown.
+type warmCache struct {
+	path     string
+	restored warmSnapshot
+	// devKeys is set if the tokens of the dev IdP are accepted
+	devKeys bool
+
+	mu      sync.Mutex
+	keySets map[string]*keySet
+}
+
+type warmSnapshot struct {
+	Saved time.Time `json:"saved"`
+	// Fingerprint is that of the verification the results passed
+	Fingerprint string                `json:"fingerprint,omitempty"`
+	KeySets     map[string]warmKeySet `json:"keySets,omitempty"`
+	Results     []warmResult          `json:"results,omitempty"`
+}
+
+// warmKeySet is the last response of a key set URL.
+type warmKeySet struct {
+	Raw      json.RawMessage `json:"raw"`
+	Fetched  time.Time       `json:"fetched"`
+	Interval time.Duration   `json:"interval"`
+}
+
+// warmResult is an entry of the in-process result cache. Claims are null
+// for an invalid token.
+type warmResult struct {
+	Key     string        `json:"key"`
+	Claims  jwt.MapClaims `json:"claims"`
+	Expires time.Time     `json:"expires"`
+}
+
+// newWarmCache reads the snapshot at path. A missing file is not an error.
+// The cache is usable even if the snapshot couldn't be read, it just starts
+// out empty.
+func newWarmCache(path string) (*warmCache, error) {
+	w := &warmCache{path: path, keySets: map[string]*keySet{}}
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return w, nil
+	}
+	if err != nil {
+		return w, err
+	}
+	if err := json.Unmarshal(raw, &w.restored); err != nil {
+		w.restored = warmSnapshot{}
+		return w, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return w, nil
+}
+
+// keySet returns the key set url had in the previous run, unless its
+// refresh is overdue.
+func (w *warmCache) keySet(url string) (warmKeySet, bool) {
+	if w == nil {
+		return warmKeySet{}, false
+	}
+	set, ok := w.restored.KeySets[url]
+	if !ok || time.Since(set.Fetched) >= set.Interval {
+		return warmKeySet{}, false
+	}
+	return set, true
+}
+
+// addKeySet has the key set of url included in the snapshot.
+func (w *warmCache) addKeySet(url string, set *keySet) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.keySets[url] = set
+}
+
+// verificationSettings are the prefixes of the settings that decide
+// whether a token verifies and which claims it ends up with.
+var verificationSettings = []string{
+	"ALB_", "ALLOWED_ISSUERS", "AZURE_", "CHECKS", "CLAIMS_NAMESPACES", "CLOCK_SKEW_LEEWAY",
+	"CLOUDFLARE_", "COGNITO_", "CONFIG_PATH", "ENTITLEMENTS_", "EXTRACTORS", "FIREBASE_",
+	"GITHUB_ACTIONS_", "GITLAB_", "GOOGLE_", "IAP_", "INTROSPECTION_", "JWKS_", "JWT_",
+	"KEY_PROVIDERS", "LDAP_", "OIDC_ISSUER", "OKTA_", "PRESET", "SPIFFE_", "USERINFO_",
+}
+
+// verificationFiles are the settings naming files whose content does too.
+var verificationFiles = []string{"JWKS_PATH", "CONFIG_PATH", "DEV_KEY_FILE"}
+
+// fingerprint hashes the verification settings, the files they name and the
+// key sets currently loaded. Results cached under another fingerprint may
+// have passed with a key, issuer or audience that is no longer accepted.
+func (w *warmCache) fingerprint() string {
+	hash := sha256.New()
+	var settings []string
+	for _, env := range os.Environ() {
+		if slices.ContainsFunc(verificationSettings, func(prefix string) bool { return strings.HasPrefix(env, prefix) }) {
+			settings = append(settings, env)
+		}
+	}
+	slices.Sort(settings)
+	for _, setting := range settings {
+		fmt.Fprintf(hash, "%s\n", setting)
+	}
+	for _, name := range verificationFiles {
+		if path := getenv(name, ""); path != "" {
+			// A file that can't be read hashes like an empty one, which
+			// fails verification alike
+			content, _ := os.ReadFile(path)
+			fmt.Fprintf(hash, "%s %d\n", name, len(content))
+			hash.Write(content)
+		}
+	}
+	fmt.Fprintf(hash, "dev %t\n", w.devKeys)
+	w.mu.Lock()
+	urls := slices.Sorted(maps.Keys(w.keySets))
+	for _, url := range urls {
+		var raw []byte
+		if set := w.keySets[url].raw.Load(); set != nil {
+			raw = set.Raw
+		}
+		fmt.Fprintf(hash, "%s %d\n", url, len(raw))
+		hash.Write(raw)
+	}
+	w.mu.Unlock()
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// restoreResults fills the in-process result cache with the results that
+// haven't expired yet, unless the fingerprint changed since they were saved.
+// Other backends are shared and outlive restarts anyway.
+func (w *warmCache) restoreResults(results *cachedResults) (int, error) {
+	memory, ok := results.cache.(*memoryCache)
+	if !ok || len(w.restored.Results) == 0 {
+		return 0, nil
+	}
+	if w.restored.Fingerprint != w.fingerprint() {
+		return 0, errors.New("keys or verification settings changed since the results were cached")
+	}
+	restored := 0
+	// Oldest first, so the most recently used end up in front again
+	for i := len(w.restored.Results) - 1; i >= 0; i-- {
+		result := w.restored.Results[i]
+		if ttl := time.Until(result.Expires); ttl > 0 {
+			memory.lru.set(result.Key, result.Claims, ttl)
+			restored++
+		}
+	}
+	return restored, nil
+}
+
+// save writes the current key sets and, for the in-process backend, cached
+// results. The file is replaced atomically and only readable by the owner,
+// as it holds claims.
+func (w *warmCache) save(results *cachedResults) error {
+	snapshot := warmSnapshot{Saved: time.Now(), KeySets: map[string]warmKeySet{}, Fingerprint: w.fingerprint()}
+	w.mu.Lock()
+	for url, set := range w.keySets {
+		if raw := set.raw.Load(); raw != nil {
+			snapshot.KeySets[url] = *raw
+		}
+	}
+	w.mu.Unlock()
+	if results != nil {
+		if memory, ok := results.cache.(*memoryCache); ok {
+			for _, entry := range memory.lru.snapshot() {
+				snapshot.Results = append(snapshot.Results, warmResult{Key: entry.key, Claims: entry.value, Expires: entry.expires})
+			}
+		}
+	}
+
+	raw, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), w.path)
+}